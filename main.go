@@ -8,8 +8,11 @@ import (
 	"image"
 	"image/png"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/unixpickle/polish/polish"
+	"github.com/unixpickle/polish/polish/nn"
 
 	"github.com/unixpickle/essentials"
 )
@@ -20,12 +23,47 @@ func main() {
 	var patchBorder int
 	var albedoPath string
 	var incidencePath string
+	var modelFile string
+	var hiddenSize int
+	var kernelSize int
+	var deepChannels string
+	var unetChannels string
+	var showMemory bool
+	var numWorkers int
+	var deterministic bool
+	var float64Accum bool
+	var compareFloat bool
+	var borderMode string
+	var wrap string
 	flag.StringVar(&model, "model", "deep", "type of model to use "+
-		"('shallow', 'deep', 'shallow-aux', 'deep-aux', 'bilateral')")
+		"('shallow', 'deep', 'shallow-aux', 'deep-aux', 'bilateral', "+
+		"'deep-int8', 'deep-fp16', 'deep-aux-int8', 'deep-aux-fp16', 'kpcn', 'kpcn-aux', "+
+		"'bilateral-aux', 'wavelet-aux', 'nlmeans', 'unet', 'unet-aux')")
 	flag.IntVar(&patchSize, "patch", 0, "image patch size to process at once (0 to disable)")
-	flag.IntVar(&patchBorder, "patch-border", -1, "border for image patches (-1 uses default)")
+	flag.IntVar(&patchBorder, "patch-border", -1, "border for image patches "+
+		"(-1 uses the receptive field of the model, or half the patch size if it is unbounded)")
 	flag.StringVar(&albedoPath, "albedo", "", "path to albedo map image (for aux models)")
 	flag.StringVar(&incidencePath, "incidence", "", "path to incidence map image (for aux models)")
+	flag.StringVar(&modelFile, "model-file", "", "path to custom model parameters "+
+		"(-model specifies the architecture)")
+	flag.IntVar(&hiddenSize, "hidden-size", 0, "hidden channels for custom shallow models "+
+		"(0 uses default)")
+	flag.IntVar(&kernelSize, "kernel-size", 0, "kernel size for custom shallow models, or "+
+		"predicted kernel size for custom KPCN models (0 uses default)")
+	flag.StringVar(&deepChannels, "deep-channels", "", "comma-separated channel counts for "+
+		"custom deep and KPCN models (empty uses default 64,128,256,32)")
+	flag.StringVar(&unetChannels, "unet-channels", "", "comma-separated channel counts for "+
+		"each level of custom U-Net models (empty uses default 32,64,128)")
+	flag.IntVar(&numWorkers, "workers", 0, "number of CPU threads to use (0 uses all CPUs)")
+	flag.BoolVar(&deterministic, "deterministic", false, "produce identical outputs on every machine")
+	flag.BoolVar(&float64Accum, "float64", false, "accumulate sums in float64 (implies -deterministic)")
+	flag.BoolVar(&compareFloat, "compare-float", false,
+		"print the PSNR of a quantized model's output relative to the float model")
+	flag.StringVar(&borderMode, "border-mode", "zero", "padding for the edges of the image "+
+		"('zero', 'reflect', 'replicate', 'circular')")
+	flag.StringVar(&wrap, "wrap", "none", "edges of the image which wrap around "+
+		"('none', 'horizontal' for panoramas, 'both' for tileable textures)")
+	flag.BoolVar(&showMemory, "show-memory", false, "print the peak memory used by the model")
 
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: "+os.Args[0]+" [flags] <input.png> <output.png>")
@@ -47,10 +85,56 @@ func main() {
 		modelType = polish.ModelTypeDeep
 	} else if model == "bilateral" {
 		modelType = polish.ModelTypeBilateral
+	} else if model == "nlmeans" {
+		modelType = polish.ModelTypeNonLocalMeans
+	} else if model == "bilateral-aux" {
+		modelType = polish.ModelTypeBilateralAux
+	} else if model == "wavelet-aux" {
+		modelType = polish.ModelTypeWaveletAux
 	} else if model == "shallow-aux" {
 		modelType = polish.ModelTypeShallowAux
 	} else if model == "deep-aux" {
 		modelType = polish.ModelTypeDeepAux
+	} else if model == "deep-int8" {
+		modelType = polish.ModelTypeDeepInt8
+	} else if model == "deep-fp16" {
+		modelType = polish.ModelTypeDeepFloat16
+	} else if model == "deep-aux-int8" {
+		modelType = polish.ModelTypeDeepAuxInt8
+	} else if model == "deep-aux-fp16" {
+		modelType = polish.ModelTypeDeepAuxFloat16
+	} else if model == "kpcn" {
+		modelType = polish.ModelTypeKPCN
+	} else if model == "kpcn-aux" {
+		modelType = polish.ModelTypeKPCNAux
+	} else if model == "unet" {
+		modelType = polish.ModelTypeUNet
+	} else if model == "unet-aux" {
+		modelType = polish.ModelTypeUNetAux
+	} else {
+		flag.Usage()
+	}
+
+	var padMode nn.PadMode
+	if borderMode == "zero" {
+		padMode = nn.PadZero
+	} else if borderMode == "reflect" {
+		padMode = nn.PadReflect
+	} else if borderMode == "replicate" {
+		padMode = nn.PadReplicate
+	} else if borderMode == "circular" {
+		padMode = nn.PadCircular
+	} else {
+		flag.Usage()
+	}
+
+	var wrapMode polish.WrapMode
+	if wrap == "none" {
+		wrapMode = polish.WrapNone
+	} else if wrap == "horizontal" {
+		wrapMode = polish.WrapHorizontal
+	} else if wrap == "both" {
+		wrapMode = polish.WrapBoth
 	} else {
 		flag.Usage()
 	}
@@ -67,27 +151,60 @@ func main() {
 		}
 	}
 
+	if !modelType.Builtin() && modelFile == "" {
+		fmt.Fprintln(os.Stderr, "model has no built-in parameters and requires the -model-file flag")
+		os.Exit(1)
+	}
+
+	if numWorkers != 0 {
+		nn.SetDefaultContext(nn.NewContext(numWorkers))
+	}
+
+	if float64Accum {
+		nn.SetDefaultDeterminism(nn.DeterminismFloat64)
+	} else if deterministic {
+		nn.SetDefaultDeterminism(nn.DeterminismStrict)
+	}
+
+	arch := polish.Architecture{
+		Type:         modelType,
+		HiddenSize:   hiddenSize,
+		KernelSize:   kernelSize,
+		DeepChannels: parseChannels("deep-channels", deepChannels),
+		UNetChannels: parseChannels("unet-channels", unetChannels),
+	}
+	denoiser := loadDenoiser(arch, modelFile)
+	denoiser = denoiser.WithBorderMode(padMode).WithWrapMode(wrapMode)
+
 	inPath := flag.Args()[0]
 	outPath := flag.Args()[1]
 
 	inImage := readPNG(inPath)
 
-	var outImage image.Image
-	if !modelType.Aux() {
-		if patchSize != 0 {
-			outImage = polish.PolishImagePatches(modelType, inImage, patchSize, patchBorder)
-		} else {
-			outImage = polish.PolishImage(modelType, inImage)
-		}
-	} else {
+	if showMemory {
+		printPeakMemory(denoiser, inImage.Bounds(), patchSize, patchBorder)
+	}
+
+	var auxTensor *nn.Tensor
+	if modelType.Aux() {
 		albedo := readPNG(albedoPath)
 		incidence := readPNG(incidencePath)
-		inTensor := polish.CreateAuxTensorImages(inImage, albedo, incidence)
-		if patchSize != 0 {
-			outImage = polish.PolishAuxPatches(modelType, inTensor, patchSize, patchBorder)
-		} else {
-			outImage = polish.PolishAux(modelType, inTensor)
+		auxTensor = polish.CreateAuxTensorImages(inImage, albedo, incidence)
+	}
+	outImage := runDenoiser(denoiser, inImage, auxTensor, patchSize, patchBorder)
+
+	if compareFloat {
+		if _, ok := modelType.Quantization(); !ok {
+			fmt.Fprintln(os.Stderr, "-compare-float requires a quantized model")
+			os.Exit(1)
 		}
+		floatArch := arch
+		floatArch.Type = modelType.FloatModel()
+		floatDenoiser := loadDenoiser(floatArch, modelFile)
+		floatDenoiser = floatDenoiser.WithBorderMode(padMode).WithWrapMode(wrapMode)
+		floatImage := runDenoiser(floatDenoiser, inImage, auxTensor, patchSize, patchBorder)
+		fmt.Fprintf(os.Stderr, "PSNR relative to float model: %.2f dB\n",
+			polish.PSNR(floatImage, outImage))
 	}
 
 	w, err := os.Create(outPath)
@@ -95,6 +212,63 @@ func main() {
 	essentials.Must(png.Encode(w, outImage))
 }
 
+func loadDenoiser(arch polish.Architecture, modelFile string) *polish.Denoiser {
+	if modelFile == "" {
+		return polish.NewDenoiser(arch.Type)
+	}
+	denoiser, err := polish.LoadModel(modelFile, arch)
+	essentials.Must(err)
+	return denoiser
+}
+
+func parseChannels(name, s string) []int {
+	if s == "" {
+		return nil
+	}
+	var res []int
+	for _, field := range strings.Split(s, ",") {
+		c, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -%s value: %s\n", name, s)
+			os.Exit(1)
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+func runDenoiser(d *polish.Denoiser, img image.Image, auxTensor *nn.Tensor, patchSize,
+	border int) image.Image {
+	if auxTensor == nil {
+		if patchSize != 0 {
+			return d.PolishImagePatches(img, patchSize, border)
+		}
+		return d.PolishImage(img)
+	}
+	if patchSize != 0 {
+		return d.PolishAuxPatches(auxTensor, patchSize, border)
+	}
+	return d.PolishAux(auxTensor)
+}
+
+func printPeakMemory(d *polish.Denoiser, bounds image.Rectangle, patchSize, border int) {
+	width, height := bounds.Dx(), bounds.Dy()
+	if patchSize != 0 {
+		if border == -1 {
+			border = d.RF()
+			if border == -1 {
+				border = patchSize / 2
+			}
+		}
+		width = essentials.MinInt(width, patchSize+2*border)
+		height = essentials.MinInt(height, patchSize+2*border)
+	}
+	peak, err := d.PeakMemory(width, height)
+	essentials.Must(err)
+	fmt.Fprintf(os.Stderr, "peak memory for %dx%d input: %.1f MiB\n", width, height,
+		float64(peak)/(1<<20))
+}
+
 func readPNG(path string) image.Image {
 	r, err := os.Open(path)
 	essentials.Must(err)
@@ -0,0 +1,367 @@
+package polish
+
+import (
+	"image"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/polish/polish/nn"
+)
+
+// maxCachedPlans is the maximum number of input shapes
+// for which a Denoiser caches execution plans.
+const maxCachedPlans = 16
+
+// WrapMode determines which edges of an image wrap around
+// to the opposite edges.
+type WrapMode int
+
+const (
+	// WrapNone treats the image as bounded.
+	WrapNone WrapMode = iota
+
+	// WrapHorizontal wraps the left edge around to the
+	// right edge, as in 360 degree panoramas such as
+	// equirectangular environment maps.
+	WrapHorizontal
+
+	// WrapBoth wraps around horizontally and vertically,
+	// as in tileable textures.
+	WrapBoth
+)
+
+// A Denoiser applies a pre-trained model to images.
+//
+// Creating a Denoiser decodes and optimizes the model
+// once, so it is much cheaper to reuse a Denoiser for many
+// images than to call PolishImage() for each one.
+//
+// A Denoiser is safe to use from multiple Goroutines
+// concurrently.
+type Denoiser struct {
+	modelType ModelType
+	layer     nn.Layer
+
+	lcd        int
+	rf         int
+	borderMode nn.PadMode
+	wrapMode   WrapMode
+
+	plansLock sync.Mutex
+	plans     map[nn.Shape]*nn.Plan
+}
+
+// NewDenoiser creates a Denoiser for the model type.
+//
+// This panics if the model is not built in (see
+// ModelType.Builtin).
+func NewDenoiser(t ModelType) *Denoiser {
+	return newDenoiserLayer(t, t.Layer())
+}
+
+// NewDenoiserChecked is like NewDenoiser, but it returns
+// an error if the model is not built in.
+func NewDenoiserChecked(t ModelType) (*Denoiser, error) {
+	layer, err := t.layerChecked()
+	if err != nil {
+		return nil, err
+	}
+	return newDenoiserLayer(t, layer), nil
+}
+
+func newDenoiserLayer(t ModelType, layer nn.Layer) *Denoiser {
+	depth := 3
+	if t.Aux() {
+		depth = 7
+	}
+	lcd, err := nn.DimensionDivisor(layer, depth)
+	if err != nil {
+		// The error will be reported when the model is
+		// applied to an image.
+		lcd = 1
+	}
+	rf, err := nn.ReceptiveField(layer)
+	if err != nil {
+		rf = -1
+	}
+	return &Denoiser{
+		modelType: t,
+		layer:     nn.Optimize(layer),
+		lcd:       lcd,
+		rf:        rf,
+		plans:     map[nn.Shape]*nn.Plan{},
+	}
+}
+
+// WithBorderMode creates a Denoiser which shares d's
+// model, but which uses the given mode to pad the edges
+// of images.
+//
+// By default, images are only padded with zeros when the
+// model does not support their size. With other modes,
+// images are also padded by the receptive field of the
+// model (see RF) if it is bounded, so that the model sees
+// mirrored, repeated, or wrapped-around pixels past the
+// edges of the image instead of zeros. This reduces dark
+// halos along the edges, but costs extra computation.
+func (d *Denoiser) WithBorderMode(mode nn.PadMode) *Denoiser {
+	res := d.clone()
+	res.borderMode = mode
+	return res
+}
+
+// BorderMode gets the mode used to pad the edges of
+// images.
+func (d *Denoiser) BorderMode() nn.PadMode {
+	return d.borderMode
+}
+
+// WithWrapMode creates a Denoiser which shares d's model,
+// but which treats the edges of images as wrapping around
+// to the opposite edges.
+//
+// The model sees the pixels from the opposite edges past
+// the edges of the image, both when it is padded and when
+// it is split into patches, so that the output has no
+// seams when it is tiled. The border mode is only used
+// for edges which do not wrap around.
+//
+// Images are padded by the receptive field of the model
+// (see RF), or by half of their size if the receptive
+// field is unbounded.
+func (d *Denoiser) WithWrapMode(mode WrapMode) *Denoiser {
+	res := d.clone()
+	res.wrapMode = mode
+	return res
+}
+
+// WrapMode gets the edges of images which wrap around.
+func (d *Denoiser) WrapMode() WrapMode {
+	return d.wrapMode
+}
+
+func (d *Denoiser) clone() *Denoiser {
+	return &Denoiser{
+		modelType:  d.modelType,
+		layer:      d.layer,
+		lcd:        d.lcd,
+		rf:         d.rf,
+		borderMode: d.borderMode,
+		wrapMode:   d.wrapMode,
+		plans:      map[nn.Shape]*nn.Plan{},
+	}
+}
+
+// ModelType gets the type of model used by d.
+func (d *Denoiser) ModelType() ModelType {
+	return d.modelType
+}
+
+// LCD gets a factor which must divide the dimensions of
+// images fed to the model.
+//
+// Images of other sizes are padded automatically.
+//
+// The result is derived from the structure of the model.
+func (d *Denoiser) LCD() int {
+	return d.lcd
+}
+
+// RF gets the radius of the receptive field of the model,
+// or -1 if the model can see the entire image (e.g. due
+// to normalization layers).
+//
+// The result is derived from the structure of the model.
+func (d *Denoiser) RF() int {
+	return d.rf
+}
+
+// PolishImage is like the top-level PolishImage, but
+// uses the Denoiser's cached model.
+func (d *Denoiser) PolishImage(img image.Image) image.Image {
+	patchSize := essentials.MaxInt(img.Bounds().Dx(), img.Bounds().Dy())
+	return d.PolishImagePatches(img, patchSize, 0)
+}
+
+// PolishImageChecked is like PolishImage, but it returns
+// an error instead of panicking.
+func (d *Denoiser) PolishImageChecked(img image.Image) (image.Image, error) {
+	patchSize := essentials.MaxInt(img.Bounds().Dx(), img.Bounds().Dy())
+	return d.PolishImagePatchesChecked(img, patchSize, 0)
+}
+
+// PolishImagePatches is like the top-level
+// PolishImagePatches, but uses the Denoiser's cached
+// model.
+func (d *Denoiser) PolishImagePatches(img image.Image, patchSize, border int) image.Image {
+	res, err := d.PolishImagePatchesChecked(img, patchSize, border)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// PolishImagePatchesChecked is like PolishImagePatches,
+// but it returns an error instead of panicking.
+func (d *Denoiser) PolishImagePatchesChecked(img image.Image, patchSize,
+	border int) (image.Image, error) {
+	if d.modelType.Aux() {
+		return nil, errors.New("model requires auxiliary features")
+	}
+	inTensor := nn.NewTensorRGB(img)
+	outTensor, err := d.operatePatches(inTensor, patchSize, border)
+	if err != nil {
+		return nil, err
+	}
+	return tensorToRGB(outTensor)
+}
+
+// PolishAux is like the top-level PolishAux, but uses the
+// Denoiser's cached model.
+func (d *Denoiser) PolishAux(auxImage *nn.Tensor) image.Image {
+	patchSize := essentials.MaxInt(auxImage.Width, auxImage.Height)
+	return d.PolishAuxPatches(auxImage, patchSize, 0)
+}
+
+// PolishAuxChecked is like PolishAux, but it returns an
+// error instead of panicking.
+func (d *Denoiser) PolishAuxChecked(auxImage *nn.Tensor) (image.Image, error) {
+	patchSize := essentials.MaxInt(auxImage.Width, auxImage.Height)
+	return d.PolishAuxPatchesChecked(auxImage, patchSize, 0)
+}
+
+// PolishAuxPatches is like the top-level
+// PolishAuxPatches, but uses the Denoiser's cached model.
+func (d *Denoiser) PolishAuxPatches(auxImage *nn.Tensor, patchSize, border int) image.Image {
+	res, err := d.PolishAuxPatchesChecked(auxImage, patchSize, border)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// PolishAuxPatchesChecked is like PolishAuxPatches, but
+// it returns an error instead of panicking.
+func (d *Denoiser) PolishAuxPatchesChecked(auxImage *nn.Tensor, patchSize,
+	border int) (image.Image, error) {
+	if !d.modelType.Aux() {
+		return nil, errors.New("model does not support auxiliary features")
+	}
+	outTensor, err := d.operatePatches(auxImage, patchSize, border)
+	if err != nil {
+		return nil, err
+	}
+	return tensorToRGB(outTensor)
+}
+
+func (d *Denoiser) operatePatches(t *nn.Tensor, patchSize, border int) (*nn.Tensor, error) {
+	if border == -1 {
+		if d.rf >= 0 {
+			border = d.rf
+		} else {
+			border = patchSize / 2
+		}
+	}
+	apply := d.apply
+	if d.wrapMode != WrapNone && (patchSize < t.Width || patchSize < t.Height) {
+		// The image wraps around before it is split into
+		// patches, but the patches themselves do not.
+		apply = func(in *nn.Tensor) (*nn.Tensor, error) {
+			return d.applyWrap(in, WrapNone)
+		}
+	}
+	return operatePatches(t, patchSize, border, d.lcd, d.wrapMode, apply)
+}
+
+// PeakMemory computes the number of bytes used by the
+// model's intermediate Tensors when it is applied to an
+// image (or patch) of the given size.
+//
+// Intermediate buffers are reused between layers and
+// between images of the same size, so this is much less
+// than the total size of all the intermediate Tensors.
+func (d *Denoiser) PeakMemory(width, height int) (int, error) {
+	depth := 3
+	if d.modelType.Aux() {
+		depth = 7
+	}
+	plan, _, _, err := d.plan(nn.Shape{Height: height, Width: width, Depth: depth}, d.wrapMode)
+	if err != nil {
+		return 0, err
+	}
+	return plan.PeakMemory(), nil
+}
+
+func (d *Denoiser) apply(in *nn.Tensor) (*nn.Tensor, error) {
+	return d.applyWrap(in, d.wrapMode)
+}
+
+func (d *Denoiser) applyWrap(in *nn.Tensor, wrap WrapMode) (*nn.Tensor, error) {
+	plan, pad, unpad, err := d.plan(in.Shape(), wrap)
+	if err != nil {
+		return nil, err
+	}
+	return unpad.Apply(plan.Apply(pad.Apply(in))), nil
+}
+
+// plan gets a cached execution plan for inputs of the
+// given shape, along with the layers which pad inputs
+// to and unpad outputs from the model.
+func (d *Denoiser) plan(in nn.Shape, wrap WrapMode) (plan *nn.Plan, pad, unpad nn.Layer,
+	err error) {
+	pad, unpad, err = d.padAndUnpad(in, wrap)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	padded, err := nn.OutputShape(pad, in)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	d.plansLock.Lock()
+	defer d.plansLock.Unlock()
+	if plan, ok := d.plans[padded]; ok {
+		return plan, pad, unpad, nil
+	}
+	plan, err = nn.NewPlan(d.layer, padded)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(d.plans) >= maxCachedPlans {
+		// Each plan may hold on to a large arena.
+		d.plans = map[nn.Shape]*nn.Plan{}
+	}
+	d.plans[padded] = plan
+	return plan, pad, unpad, nil
+}
+
+// padAndUnpad creates the layers which pad inputs to and
+// unpad outputs from the model, where the edges given by
+// wrap wrap around.
+//
+// Wrapped edges are padded by the receptive field, or by
+// half of the input size if the receptive field is
+// unbounded, so that pixels near the edges see the pixels
+// past the opposite edges.
+func (d *Denoiser) padAndUnpad(in nn.Shape, wrap WrapMode) (pad, unpad nn.Layer, err error) {
+	margin := essentials.MaxInt(d.rf, 0)
+	horizontal := edgePadding{mode: d.borderMode}
+	if d.borderMode != nn.PadZero {
+		horizontal.margin = margin
+	}
+	vertical := horizontal
+	wrapMargin := func(size int) int {
+		if d.rf >= 0 {
+			return d.rf
+		}
+		return size / 2
+	}
+	if wrap != WrapNone {
+		horizontal = edgePadding{margin: wrapMargin(in.Width), mode: nn.PadCircular}
+	}
+	if wrap == WrapBoth {
+		vertical = edgePadding{margin: wrapMargin(in.Height), mode: nn.PadCircular}
+	}
+	return padAndUnpad(d.layer, in, d.lcd, horizontal, vertical)
+}
@@ -0,0 +1,136 @@
+package polish
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/polish/polish/nn"
+)
+
+// Architecture describes the structure of a custom model,
+// which is needed to interpret a parameter file.
+type Architecture struct {
+	// Type is the kind of network the parameters belong
+	// to. It must be one of ModelTypeShallow,
+	// ModelTypeDeep, ModelTypeShallowAux,
+	// ModelTypeDeepAux, ModelTypeKPCN, ModelTypeKPCNAux,
+	// ModelTypeUNet, or ModelTypeUNetAux, or a quantized
+	// variant of a deep model, in which case the model is
+	// quantized after it is loaded.
+	Type ModelType
+
+	// HiddenSize is the number of hidden channels in a
+	// shallow model.
+	// If 0, the default of 32 is used.
+	HiddenSize int
+
+	// KernelSize is the kernel size of a shallow model,
+	// or the size of the predicted kernels of a KPCN
+	// model. It must be odd.
+	// If 0, the default of 5 or 21, respectively, is used.
+	KernelSize int
+
+	// DeepChannels lists the channel counts of a deep or
+	// KPCN model, like the channels argument of
+	// DeepDenoiser in training/polish/models.py: the
+	// outputs of conv1 (and deconv1), the outputs of conv2
+	// (and the residual blocks), the hidden layers of the
+	// residual blocks, and the outputs of deconv2.
+	// If nil, the default of {64, 128, 256, 32} is used.
+	DeepChannels []int
+
+	// UNetChannels lists the channel counts of each level
+	// of a U-Net, starting at full resolution, like the
+	// channels argument of UNetDenoiser in
+	// training/polish/models.py. There must be at least
+	// two levels.
+	// If nil, the default of {32, 64, 128} is used.
+	UNetChannels []int
+}
+
+// LoadModel reads a custom-trained model from a parameter
+// file and creates a Denoiser for it.
+//
+// The file should be a zip archive with one entry per
+// parameter, where each entry is a flat array of
+// little-endian float32 values, as produced by the
+// training/dump_params.ipynb notebook.
+func LoadModel(path string, arch Architecture) (*Denoiser, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load model")
+	}
+	d, err := NewDenoiserParams(data, arch)
+	if err != nil {
+		return nil, errors.Wrap(err, "load model")
+	}
+	return d, nil
+}
+
+// NewDenoiserParams is like LoadModel, but reads the
+// parameters from an in-memory zip archive.
+func NewDenoiserParams(zipData []byte, arch Architecture) (*Denoiser, error) {
+	params, err := readParameterZip(zipData)
+	if err != nil {
+		return nil, errors.Wrap(err, "read parameters")
+	}
+	hiddenSize := arch.HiddenSize
+	if hiddenSize == 0 {
+		hiddenSize = 32
+	}
+	kernelSize := arch.KernelSize
+	deepChannels := arch.DeepChannels
+	if deepChannels == nil {
+		deepChannels = defaultDeepChannels
+	} else if len(deepChannels) != len(defaultDeepChannels) {
+		return nil, fmt.Errorf("expected %d deep channel counts but got %d",
+			len(defaultDeepChannels), len(deepChannels))
+	}
+	for _, c := range deepChannels {
+		if c < 1 {
+			return nil, errors.New("deep channel counts must be positive")
+		}
+	}
+	unetChannels := arch.UNetChannels
+	if unetChannels == nil {
+		unetChannels = defaultUNetChannels
+	} else if len(unetChannels) < 2 {
+		return nil, fmt.Errorf("expected at least 2 U-Net channel counts but got %d",
+			len(unetChannels))
+	}
+	for _, c := range unetChannels {
+		if c < 1 {
+			return nil, errors.New("U-Net channel counts must be positive")
+		}
+	}
+	var layer nn.Layer
+	switch arch.Type {
+	case ModelTypeShallow, ModelTypeShallowAux:
+		if kernelSize == 0 {
+			kernelSize = 5
+		}
+		layer, err = createShallow(params, arch.Type.Aux(), kernelSize, hiddenSize)
+	case ModelTypeDeep, ModelTypeDeepAux:
+		layer, err = createDeep(params, arch.Type.Aux(), deepChannels)
+	case ModelTypeDeepInt8, ModelTypeDeepFloat16, ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16:
+		layer, err = createDeep(params, arch.Type.Aux(), deepChannels)
+		if err == nil {
+			format, _ := arch.Type.Quantization()
+			layer, err = quantizeModel(layer, format, arch.Type.Aux())
+		}
+	case ModelTypeKPCN, ModelTypeKPCNAux:
+		if kernelSize == 0 {
+			kernelSize = 21
+		}
+		layer, err = createKPCN(params, arch.Type.Aux(), deepChannels, kernelSize)
+	case ModelTypeUNet, ModelTypeUNetAux:
+		layer, err = createUNet(params, arch.Type.Aux(), unetChannels)
+	default:
+		return nil, errors.New("architecture must be a neural network model type")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "create model")
+	}
+	return newDenoiserLayer(arch.Type, layer), nil
+}
@@ -7,67 +7,173 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"sort"
+	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/polish/polish/nn"
 )
 
-func createShallow() nn.Layer {
-	params := readParameterZip(shallowModelZipData)
-	return nn.NN{
-		loadConv(params, "conv1", 5, 1, 3, 32),
+func createShallow(params map[string][]float32, aux bool, kernel, hidden int) (nn.Layer, error) {
+	if kernel < 1 || kernel%2 == 0 {
+		return nil, fmt.Errorf("kernel size must be odd and positive, but got %d", kernel)
+	}
+	if hidden < 1 {
+		return nil, fmt.Errorf("hidden size must be positive, but got %d", hidden)
+	}
+	inChannels := 3
+	if aux {
+		inChannels = 7
+	}
+	p := newParamLoader(params)
+	result := nn.NN{
+		loadConv(p, "conv1", kernel, 1, inChannels, hidden),
 		nn.ReLU{},
-		loadConv(params, "conv2", 5, 1, 32, 3),
+		loadConv(p, "conv2", kernel, 1, hidden, 3),
+	}
+	if err := p.Finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// defaultDeepChannels are the channel counts of the
+// built-in deep models; see Architecture.DeepChannels.
+var defaultDeepChannels = []int{64, 128, 256, 32}
+
+func createDeep(params map[string][]float32, aux bool, channels []int) (nn.Layer, error) {
+	p := newParamLoader(params)
+	result := deepBackbone(p, aux, channels, 3)
+	if err := p.Finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// createKPCN creates a deep model whose output layer
+// predicts a kernel for every pixel, which is applied to
+// the RGB channels of the input.
+func createKPCN(params map[string][]float32, aux bool, channels []int,
+	kernel int) (nn.Layer, error) {
+	if kernel < 1 || kernel%2 == 0 {
+		return nil, fmt.Errorf("kernel size must be odd and positive, but got %d", kernel)
+	}
+	p := newParamLoader(params)
+	result := &nn.Graph{}
+	result.AddLayer("kernels", deepBackbone(p, aux, channels, kernel*kernel), nn.GraphInput)
+	radiance := nn.GraphInput
+	if aux {
+		radiance = "radiance"
+		result.AddLayer(radiance, &nn.ChannelSlice{Start: 0, End: 3}, nn.GraphInput)
+	}
+	result.AddMerge("output", &nn.KernelPrediction{KernelSize: kernel}, radiance, "kernels")
+	if err := p.Finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// defaultUNetChannels are the default channel counts of
+// U-Net models; see Architecture.UNetChannels.
+var defaultUNetChannels = []int{32, 64, 128}
+
+// createUNet creates a U-Net, like UNetDenoiser in
+// training/polish/models.py.
+//
+// Each encoder level halves the resolution of the one
+// before it, and each decoder level upsamples its input
+// and concatenates it with the features of the encoder
+// level at the same resolution.
+func createUNet(params map[string][]float32, aux bool, channels []int) (nn.Layer, error) {
+	inChannels := 3
+	if aux {
+		inChannels = 7
+	}
+	p := newParamLoader(params)
+	result := &nn.Graph{}
+
+	input := nn.GraphInput
+	for i, depth := range channels {
+		if i > 0 {
+			pool := fmt.Sprintf("pool%d", i)
+			result.AddLayer(pool, &nn.MaxPool{Size: 2}, input)
+			input = pool
+		}
+		encoder := fmt.Sprintf("encoders.%d", i)
+		result.AddLayer(encoder, loadUNetBlock(p, encoder, inChannels, depth), input)
+		input = encoder
+		inChannels = depth
+	}
+
+	for i := len(channels) - 2; i >= 0; i-- {
+		up := fmt.Sprintf("up%d", i)
+		result.AddLayer(up, &nn.Upsample{Scale: 2, Mode: nn.UpsampleBilinear}, input)
+		concat := fmt.Sprintf("concat%d", i)
+		result.AddMerge(concat, nn.Concat{}, up, fmt.Sprintf("encoders.%d", i))
+		decoder := fmt.Sprintf("decoders.%d", len(channels)-2-i)
+		result.AddLayer(decoder, loadUNetBlock(p, decoder, inChannels+channels[i], channels[i]),
+			concat)
+		input = decoder
+		inChannels = channels[i]
 	}
+	result.AddLayer("out", loadConv(p, "out", 1, 1, inChannels, 3), input)
+
+	if err := p.Finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func createShallowAux() nn.Layer {
-	params := readParameterZip(shallowAuxModelZipData)
+// loadUNetBlock loads a pair of 3x3 convolutions, each
+// followed by a ReLU.
+func loadUNetBlock(p *paramLoader, key string, inDepth, outDepth int) nn.Layer {
 	return nn.NN{
-		loadConv(params, "conv1", 5, 1, 7, 32),
+		loadConv(p, key+".0", 3, 1, inDepth, outDepth),
+		nn.ReLU{},
+		loadConv(p, key+".2", 3, 1, outDepth, outDepth),
 		nn.ReLU{},
-		loadConv(params, "conv2", 5, 1, 32, 3),
 	}
 }
 
-func createDeep(aux bool) nn.Layer {
-	paramData := deepModelZipData
+// deepBackbone loads the layers of a deep model with the
+// given channel counts (see Architecture.DeepChannels),
+// where the final layer produces outDepth channels.
+func deepBackbone(p *paramLoader, aux bool, channels []int, outDepth int) nn.NN {
 	inChannels := 3
 	if aux {
-		paramData = deepAuxModelZipData
 		inChannels = 7
 	}
-	params := readParameterZip(paramData)
+	c1, c2, hidden, c3 := channels[0], channels[1], channels[2], channels[3]
 
 	result := nn.NN{
-		loadConv(params, "conv1", 5, 2, inChannels, 64),
+		loadConv(p, "conv1", 5, 2, inChannels, c1),
 		nn.ReLU{},
-		loadDepthSepConv(params, "conv2", 5, 2, 64, 128),
+		loadDepthSepConv(p, "conv2", 5, 2, c1, c2),
 	}
 
 	for i := 0; i < 4; i++ {
 		layer := fmt.Sprintf("residuals.%d", i)
 		result = append(result, nn.Residual{
-			loadBatchNorm(params, layer+".0"),
+			loadBatchNorm(p, layer+".0", c2),
 			nn.ReLU{},
-			loadDepthSepConv(params, layer+".2", 3, 1, 128, 256),
+			loadDepthSepConv(p, layer+".2", 3, 1, c2, hidden),
 			nn.ReLU{},
-			loadDepthSepConv(params, layer+".4", 3, 1, 256, 128),
+			loadDepthSepConv(p, layer+".4", 3, 1, hidden, c2),
 		})
 	}
 
 	result = append(result,
-		loadDeconv(params, "deconv1", 4, 2, 128, 64),
+		loadDeconv(p, "deconv1", 4, 2, c2, c1),
 		nn.ReLU{},
-		loadDeconv(params, "deconv2", 4, 2, 64, 32),
+		loadDeconv(p, "deconv2", 4, 2, c1, c3),
 		nn.ReLU{},
-		loadConv(params, "conv3", 3, 1, 32, 3),
+		loadConv(p, "conv3", 3, 1, c3, outDepth),
 	)
-
 	return result
 }
 
-func loadConv(p map[string][]float32, key string, kernel, stride, inDepth, outDepth int) nn.Layer {
+func loadConv(p *paramLoader, key string, kernel, stride, inDepth, outDepth int) nn.Layer {
 	return nn.NN{
 		nn.NewPad(kernel/2, kernel/2, kernel/2, kernel/2),
 		&nn.Conv{
@@ -75,14 +181,13 @@ func loadConv(p map[string][]float32, key string, kernel, stride, inDepth, outDe
 			OutDepth:   outDepth,
 			KernelSize: kernel,
 			Stride:     stride,
-			Weights:    p[key+".weight"],
+			Weights:    p.Get(key+".weight", outDepth*inDepth*kernel*kernel),
 		},
-		&nn.Bias{Data: p[key+".bias"]},
+		&nn.Bias{Data: p.Get(key+".bias", outDepth)},
 	}
 }
 
-func loadDeconv(p map[string][]float32, key string, kernel, stride,
-	inDepth, outDepth int) nn.Layer {
+func loadDeconv(p *paramLoader, key string, kernel, stride, inDepth, outDepth int) nn.Layer {
 	s := (kernel - 1) / 2
 	return nn.NN{
 		&nn.Deconv{
@@ -90,51 +195,57 @@ func loadDeconv(p map[string][]float32, key string, kernel, stride,
 			OutDepth:   outDepth,
 			KernelSize: kernel,
 			Stride:     stride,
-			Weights:    p[key+".weight"],
+			Weights:    p.Get(key+".weight", inDepth*outDepth*kernel*kernel),
 		},
 		nn.NewUnpad(s, s, s, s),
-		&nn.Bias{Data: p[key+".bias"]},
+		&nn.Bias{Data: p.Get(key+".bias", outDepth)},
 	}
 }
 
-func loadDepthSepConv(p map[string][]float32, key string,
-	kernel, stride, inDepth, outDepth int) nn.Layer {
+func loadDepthSepConv(p *paramLoader, key string, kernel, stride, inDepth,
+	outDepth int) nn.Layer {
 	return nn.NN{
 		nn.NewPad(kernel/2, kernel/2, kernel/2, kernel/2),
 		&nn.SpatialConv{
 			Depth:      inDepth,
 			KernelSize: kernel,
 			Stride:     stride,
-			Weights:    p[key+".spatial.weight"],
+			Weights:    p.Get(key+".spatial.weight", inDepth*kernel*kernel),
 		},
-		&nn.Bias{Data: p[key+".spatial.bias"]},
+		&nn.Bias{Data: p.Get(key+".spatial.bias", inDepth)},
 		nn.ReLU{},
 		&nn.Conv{
 			InDepth:    inDepth,
 			OutDepth:   outDepth,
 			KernelSize: 1,
 			Stride:     1,
-			Weights:    p[key+".depthwise.weight"],
+			Weights:    p.Get(key+".depthwise.weight", outDepth*inDepth),
 		},
-		&nn.Bias{Data: p[key+".depthwise.bias"]},
+		&nn.Bias{Data: p.Get(key+".depthwise.bias", outDepth)},
 	}
 }
 
-func loadBatchNorm(p map[string][]float32, key string) nn.Layer {
-	negMean := append([]float32{}, p[key+".running_mean"]...)
+func loadBatchNorm(p *paramLoader, key string, depth int) nn.Layer {
+	negMean := append([]float32{}, p.Get(key+".running_mean", depth)...)
 	for i, x := range negMean {
 		negMean[i] = -x
 	}
-	variance := p[key+".running_var"]
-	weight := p[key+".weight"]
-	bias := p[key+".bias"]
+	variance := p.Get(key+".running_var", depth)
+	weight := p.Get(key+".weight", depth)
+	bias := p.Get(key+".bias", depth)
+
+	// PyTorch includes a step counter in the state dict,
+	// but it is not needed for inference.
+	p.Ignore(key + ".num_batches_tracked")
 
 	scale := make([]float32, len(variance))
 	offset := make([]float32, len(variance))
-	for i, x := range variance {
-		invStd := float32(1.0 / math.Sqrt(float64(x+1e-5)))
-		scale[i] = weight[i] * invStd
-		offset[i] = bias[i]
+	if p.Err() == nil {
+		for i, x := range variance {
+			invStd := float32(1.0 / math.Sqrt(float64(x+1e-5)))
+			scale[i] = weight[i] * invStd
+			offset[i] = bias[i]
+		}
 	}
 	return nn.NN{
 		&nn.Bias{Data: negMean},
@@ -143,22 +254,106 @@ func loadBatchNorm(p map[string][]float32, key string) nn.Layer {
 	}
 }
 
-func readParameterZip(rawZip string) map[string][]float32 {
-	zipData := []byte(rawZip)
+// A paramLoader validates the parameters of a model as
+// they are loaded.
+//
+// After the first error, all calls to Get return nil and
+// the error is reported by Err and Finish.
+type paramLoader struct {
+	params map[string][]float32
+	used   map[string]bool
+	err    error
+}
+
+func newParamLoader(params map[string][]float32) *paramLoader {
+	return &paramLoader{params: params, used: map[string]bool{}}
+}
+
+// Get looks up a parameter and checks that it has the
+// expected number of values.
+func (p *paramLoader) Get(key string, size int) []float32 {
+	if p.err != nil {
+		return nil
+	}
+	value, ok := p.params[key]
+	if !ok {
+		p.err = fmt.Errorf("missing parameter: %s", key)
+		return nil
+	}
+	if len(value) != size {
+		p.err = fmt.Errorf("parameter %s: expected %d values but got %d", key, size,
+			len(value))
+		return nil
+	}
+	p.used[key] = true
+	return value
+}
+
+// Ignore marks an optional parameter as used, so that it
+// is not reported as unexpected.
+func (p *paramLoader) Ignore(key string) {
+	p.used[key] = true
+}
+
+// Err gets the first error encountered while loading.
+func (p *paramLoader) Err() error {
+	return p.err
+}
+
+// Finish checks that every parameter was used and returns
+// the first error encountered while loading, if any.
+func (p *paramLoader) Finish() error {
+	if p.err != nil {
+		return p.err
+	}
+	var unused []string
+	for key := range p.params {
+		if !p.used[key] {
+			unused = append(unused, key)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return errors.New("unexpected parameters: " + strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+func mustReadParameterZip(rawZip string) map[string][]float32 {
+	params, err := readParameterZip([]byte(rawZip))
+	essentials.Must(err)
+	return params
+}
+
+func readParameterZip(zipData []byte) (map[string][]float32, error) {
 	byteReader := bytes.NewReader(zipData)
 	zipReader, err := zip.NewReader(byteReader, int64(len(zipData)))
-	essentials.Must(err)
+	if err != nil {
+		return nil, err
+	}
 
 	params := map[string][]float32{}
 	for _, file := range zipReader.File {
 		r, err := file.Open()
-		essentials.Must(err)
+		if err != nil {
+			return nil, err
+		}
 		data, err := ioutil.ReadAll(r)
-		essentials.Must(err)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data)%4 != 0 {
+			return nil, fmt.Errorf("parameter %s: size %d is not a multiple of 4 bytes",
+				file.Name, len(data))
+		}
+		if _, ok := params[file.Name]; ok {
+			return nil, fmt.Errorf("duplicate parameter: %s", file.Name)
+		}
 		values := make([]float32, len(data)/4)
 		binary.Read(bytes.NewReader(data), binary.LittleEndian, values)
 		params[file.Name] = values
 	}
 
-	return params
+	return params, nil
 }
@@ -1,6 +1,13 @@
 package polish
 
 import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/unixpickle/polish/polish/nn"
@@ -23,3 +30,354 @@ func BenchmarkDeep(b *testing.B) {
 		layer.Apply(input)
 	}
 }
+
+func TestLoadModel(t *testing.T) {
+	f, err := ioutil.TempFile("", "polish_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte(shallowModelZipData))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := LoadModel(f.Name(), Architecture{Type: ModelTypeShallow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := nn.NewTensor(20, 30, 3)
+	for i := range input.Data {
+		input.Data[i] = rand.Float32()
+	}
+	expected := ModelTypeShallow.Layer().Apply(input)
+	actual := d.layer.Apply(input)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Error("loaded model does not match built-in model")
+	}
+
+	if _, err := LoadModel(f.Name()+".missing", Architecture{Type: ModelTypeShallow}); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if _, err := LoadModel(f.Name(), Architecture{Type: ModelTypeBilateral}); err == nil {
+		t.Error("expected error for bilateral architecture")
+	}
+}
+
+func TestLoadModelValidation(t *testing.T) {
+	load := func(f func(params map[string][]float32)) error {
+		params := mustReadParameterZip(shallowModelZipData)
+		f(params)
+		_, err := createShallow(params, false, 5, 32)
+		return err
+	}
+	if err := load(func(p map[string][]float32) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := load(func(p map[string][]float32) {
+		delete(p, "conv2.bias")
+	}); err == nil || !strings.Contains(err.Error(), "conv2.bias") {
+		t.Errorf("unexpected error for missing key: %v", err)
+	}
+	if err := load(func(p map[string][]float32) {
+		p["conv1.weight"] = p["conv1.weight"][1:]
+	}); err == nil || !strings.Contains(err.Error(), "conv1.weight") {
+		t.Errorf("unexpected error for wrong size: %v", err)
+	}
+	if err := load(func(p map[string][]float32) {
+		p["conv3.weight"] = []float32{1}
+	}); err == nil || !strings.Contains(err.Error(), "conv3.weight") {
+		t.Errorf("unexpected error for extra key: %v", err)
+	}
+
+	zipData := []byte(shallowModelZipData)
+	for _, arch := range []Architecture{
+		{Type: ModelTypeShallow, HiddenSize: -1},
+		{Type: ModelTypeShallow, KernelSize: -5},
+		{Type: ModelTypeShallow, KernelSize: 4},
+	} {
+		if _, err := NewDenoiserParams(zipData, arch); err == nil {
+			t.Errorf("expected error for %+v", arch)
+		}
+	}
+}
+
+func TestLoadModelDeepChannels(t *testing.T) {
+	channels := []int{8, 16, 24, 4}
+	params := map[string][]float32{}
+	add := func(key string, size int) {
+		params[key] = make([]float32, size)
+		for i := range params[key] {
+			params[key][i] = float32(rand.NormFloat64() * 0.1)
+		}
+	}
+	conv := func(key string, kernel, inDepth, outDepth int) {
+		add(key+".weight", outDepth*inDepth*kernel*kernel)
+		add(key+".bias", outDepth)
+	}
+	sepConv := func(key string, kernel, inDepth, outDepth int) {
+		conv(key+".spatial", kernel, 1, inDepth)
+		conv(key+".depthwise", 1, inDepth, outDepth)
+	}
+	conv("conv1", 5, 3, 8)
+	sepConv("conv2", 5, 8, 16)
+	for i := 0; i < 4; i++ {
+		layer := fmt.Sprintf("residuals.%d", i)
+		for _, name := range []string{"running_mean", "running_var", "weight", "bias"} {
+			add(layer+".0."+name, 16)
+		}
+		for j := range params[layer+".0.running_var"] {
+			params[layer+".0.running_var"][j] = 1
+		}
+		sepConv(layer+".2", 3, 16, 24)
+		sepConv(layer+".4", 3, 24, 16)
+	}
+	conv("deconv1", 4, 16, 8)
+	conv("deconv2", 4, 8, 4)
+	conv("conv3", 3, 4, 3)
+
+	layer, err := createDeep(params, false, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shape := nn.Shape{Height: 16, Width: 20, Depth: 3}
+	if out, err := nn.OutputShape(layer, shape); err != nil || out != shape {
+		t.Errorf("expected output shape %v but got %v (%v)", shape, out, err)
+	}
+	if _, err := createDeep(params, false, defaultDeepChannels); err == nil {
+		t.Error("expected error for default channels")
+	}
+
+	zipData := []byte(deepModelZipData)
+	for _, channels := range [][]int{{64, 128, 256}, {64, 128, 0, 32}} {
+		_, err := NewDenoiserParams(zipData, Architecture{Type: ModelTypeDeep,
+			DeepChannels: channels})
+		if err == nil {
+			t.Errorf("expected error for channels %v", channels)
+		}
+	}
+}
+
+func TestPadAndUnpad(t *testing.T) {
+	for _, modelType := range []ModelType{ModelTypeBilateral, ModelTypeShallow, ModelTypeDeep,
+		ModelTypeShallowAux, ModelTypeDeepAux, ModelTypeBilateralAux, ModelTypeWaveletAux,
+		ModelTypeNonLocalMeans} {
+		layer := modelType.Layer()
+		depth := 3
+		if modelType.Aux() {
+			depth = 7
+		}
+		lcd := modelType.LCD()
+		for size := 1; size < 10; size++ {
+			pad, _, err := padAndUnpad(layer, nn.Shape{Height: size, Width: size + 1, Depth: depth},
+				lcd, edgePadding{}, edgePadding{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := nn.NewPad(0, (lcd-(size+1)%lcd)%lcd, (lcd-size%lcd)%lcd, 0)
+			if !reflect.DeepEqual(pad, expected) {
+				t.Errorf("model %d size %d: expected %v but got %v", modelType, size,
+					expected, pad)
+			}
+		}
+	}
+}
+
+func TestKPCN(t *testing.T) {
+	for _, modelType := range []ModelType{ModelTypeKPCN, ModelTypeKPCNAux} {
+		params := mustReadParameterZip(deepModelZipData)
+		depth := 3
+		if modelType.Aux() {
+			params = mustReadParameterZip(deepAuxModelZipData)
+			depth = 7
+		}
+		params["conv3.weight"] = make([]float32, 21*21*32*3*3)
+		for i := range params["conv3.weight"] {
+			params["conv3.weight"][i] = float32(rand.NormFloat64() * 0.1)
+		}
+		params["conv3.bias"] = make([]float32, 21*21)
+		layer, err := createKPCN(params, modelType.Aux(), defaultDeepChannels, 21)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := newDenoiserLayer(modelType, layer)
+		if d.LCD() != modelType.LCD() || d.RF() != modelType.RF() {
+			t.Errorf("model %d: expected LCD %d and RF %d but got %d and %d", modelType,
+				modelType.LCD(), modelType.RF(), d.LCD(), d.RF())
+		}
+
+		// The output colors are averages of input colors.
+		input := nn.NewTensor(32, 24, depth)
+		for i := range input.Data {
+			input.Data[i] = rand.Float32()
+			if i%depth < 3 {
+				input.Data[i] = 0.25 + input.Data[i]*0.5
+			}
+		}
+		var output image.Image
+		if modelType.Aux() {
+			output = d.PolishAux(input)
+		} else {
+			output = d.PolishImage(input.RGB())
+		}
+		for y := 0; y < input.Height; y++ {
+			for x := 0; x < input.Width; x++ {
+				r, g, b, _ := output.At(x, y).RGBA()
+				for _, c := range []uint32{r, g, b} {
+					if c < 0xffff/4-0x100 || c > 0xffff*3/4+0x100 {
+						t.Fatalf("model %d: color %d at (%d, %d) is out of range", modelType,
+							c, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUNet(t *testing.T) {
+	unetParams := func(aux bool, channels []int) map[string][]float32 {
+		params := map[string][]float32{}
+		conv := func(key string, kernel, inDepth, outDepth int) {
+			params[key+".weight"] = make([]float32, outDepth*inDepth*kernel*kernel)
+			for i := range params[key+".weight"] {
+				params[key+".weight"][i] = float32(rand.NormFloat64() * 0.1)
+			}
+			params[key+".bias"] = make([]float32, outDepth)
+		}
+		block := func(key string, inDepth, outDepth int) {
+			conv(key+".0", 3, inDepth, outDepth)
+			conv(key+".2", 3, outDepth, outDepth)
+		}
+		inDepth := 3
+		if aux {
+			inDepth = 7
+		}
+		for i, depth := range channels {
+			block(fmt.Sprintf("encoders.%d", i), inDepth, depth)
+			inDepth = depth
+		}
+		for i := len(channels) - 2; i >= 0; i-- {
+			block(fmt.Sprintf("decoders.%d", len(channels)-2-i), inDepth+channels[i], channels[i])
+			inDepth = channels[i]
+		}
+		conv("out", 1, inDepth, 3)
+		return params
+	}
+
+	for _, modelType := range []ModelType{ModelTypeUNet, ModelTypeUNetAux} {
+		layer, err := createUNet(unetParams(modelType.Aux(), defaultUNetChannels),
+			modelType.Aux(), defaultUNetChannels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := newDenoiserLayer(modelType, layer)
+		if d.LCD() != modelType.LCD() || d.RF() != modelType.RF() {
+			t.Errorf("model %d: expected LCD %d and RF %d but got %d and %d", modelType,
+				modelType.LCD(), modelType.RF(), d.LCD(), d.RF())
+		}
+		depth := 3
+		if modelType.Aux() {
+			depth = 7
+		}
+		input := nn.NewTensor(13, 18, depth)
+		var output image.Image
+		if modelType.Aux() {
+			output = d.PolishAux(input)
+		} else {
+			output = d.PolishImage(input.RGB())
+		}
+		if output.Bounds() != image.Rect(0, 0, 18, 13) {
+			t.Errorf("model %d: unexpected output bounds %v", modelType, output.Bounds())
+		}
+	}
+
+	channels := []int{4, 8, 12, 16}
+	params := unetParams(false, channels)
+	layer, err := createUNet(params, false, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lcd, err := nn.DimensionDivisor(layer, 3); err != nil || lcd != 8 {
+		t.Errorf("expected LCD 8 but got %d (%v)", lcd, err)
+	}
+	if _, err := createUNet(params, false, defaultUNetChannels); err == nil {
+		t.Error("expected error for default channels")
+	}
+
+	zipData := []byte(deepModelZipData)
+	for _, channels := range [][]int{{64}, {32, 0, 128}} {
+		_, err := NewDenoiserParams(zipData, Architecture{Type: ModelTypeUNet,
+			UNetChannels: channels})
+		if err == nil {
+			t.Errorf("expected error for channels %v", channels)
+		}
+	}
+}
+
+func TestModelGeometry(t *testing.T) {
+	for _, modelType := range []ModelType{ModelTypeBilateral, ModelTypeShallow, ModelTypeDeep,
+		ModelTypeShallowAux, ModelTypeDeepAux, ModelTypeDeepInt8, ModelTypeDeepFloat16,
+		ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16, ModelTypeBilateralAux,
+		ModelTypeWaveletAux, ModelTypeNonLocalMeans} {
+		d := NewDenoiser(modelType)
+		if d.LCD() != modelType.LCD() {
+			t.Errorf("model %d: expected LCD %d but got %d", modelType, modelType.LCD(), d.LCD())
+		}
+		if d.RF() != modelType.RF() {
+			t.Errorf("model %d: expected RF %d but got %d", modelType, modelType.RF(), d.RF())
+		}
+	}
+}
+
+func TestQuantizedModels(t *testing.T) {
+	for _, modelType := range []ModelType{ModelTypeDeepInt8, ModelTypeDeepFloat16,
+		ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16} {
+		format, _ := modelType.Quantization()
+		minPSNR := 30.0
+		if format == nn.QuantFloat16 {
+			minPSNR = 50
+		}
+		floatModel := NewDenoiser(modelType.FloatModel())
+		quantized := NewDenoiser(modelType)
+		for _, sample := range calibrationSamples(modelType.Aux())[:2] {
+			expected, err := floatModel.apply(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := quantized.apply(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if psnr := PSNR(expected.RGB(), actual.RGB()); psnr < minPSNR {
+				t.Errorf("model %d: PSNR %f is below %f", modelType, psnr, minPSNR)
+			}
+		}
+
+		// The calibrated layer is reused.
+		first, second := modelType.Layer(), modelType.Layer()
+		if reflect.ValueOf(first).Pointer() != reflect.ValueOf(second).Pointer() {
+			t.Errorf("model %d: layer was not cached", modelType)
+		}
+	}
+}
+
+func TestDenoiserQuantize(t *testing.T) {
+	d := NewDenoiser(ModelTypeShallow)
+	samples := calibrationSamples(false)
+	quantized, err := d.Quantize(nn.QuantInt8, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quantized.RF() != d.RF() || quantized.LCD() != d.LCD() {
+		t.Error("quantization changed the model geometry")
+	}
+	expected := d.PolishImage(samples[0].RGB())
+	actual := quantized.PolishImage(samples[0].RGB())
+	if psnr := PSNR(expected, actual); psnr < 30 {
+		t.Errorf("unexpected PSNR: %f", psnr)
+	}
+	if _, err := d.Quantize(nn.QuantInt8, nil); err == nil {
+		t.Error("expected error without samples")
+	}
+}
@@ -1,6 +1,9 @@
 package polish
 
-import "github.com/unixpickle/polish/polish/nn"
+import (
+	"github.com/pkg/errors"
+	"github.com/unixpickle/polish/polish/nn"
+)
 
 type ModelType int
 
@@ -30,16 +33,100 @@ const (
 	// model expects albedo and ray incidence angles as
 	// extra input channels.
 	ModelTypeDeepAux
+
+	// ModelTypeDeepInt8 is ModelTypeDeep with 8-bit
+	// integer weights and activations.
+	//
+	// The activations are calibrated on synthetic
+	// renderings. To calibrate on your own images instead,
+	// see Denoiser.Quantize.
+	ModelTypeDeepInt8
+
+	// ModelTypeDeepFloat16 is ModelTypeDeep with
+	// half-precision weights, activations, and
+	// accumulation.
+	//
+	// The half-precision arithmetic is emulated, so this
+	// model is slower than ModelTypeDeep.
+	ModelTypeDeepFloat16
+
+	// ModelTypeDeepAuxInt8 is like ModelTypeDeepInt8, but
+	// for ModelTypeDeepAux.
+	ModelTypeDeepAuxInt8
+
+	// ModelTypeDeepAuxFloat16 is like ModelTypeDeepFloat16,
+	// but for ModelTypeDeepAux.
+	ModelTypeDeepAuxFloat16
+
+	// ModelTypeKPCN is a kernel-predicting network with
+	// the structure of ModelTypeDeep. Rather than
+	// producing colors, it predicts a 21x21 kernel for
+	// every pixel, which averages the nearby input pixels.
+	//
+	// Since every output pixel is a weighted average of
+	// input pixels, the model preserves textures and does
+	// not shift colors. Near the edges of images, the
+	// average may include zero padding; to avoid this, use
+	// a border mode (see Denoiser.WithBorderMode).
+	//
+	// There are no pre-trained parameters for this model
+	// yet, so it must be loaded with LoadModel.
+	ModelTypeKPCN
+
+	// ModelTypeKPCNAux is like ModelTypeKPCN, but the model
+	// expects albedo and ray incidence angles as extra
+	// input channels.
+	ModelTypeKPCNAux
+
+	// ModelTypeBilateralAux uses a tuned joint bilateral
+	// filter, which is guided by albedo and ray incidence
+	// angles to avoid blurring across texture and geometry
+	// edges. Like ModelTypeBilateral, it does not use a
+	// neural network.
+	ModelTypeBilateralAux
+
+	// ModelTypeWaveletAux uses an edge-avoiding à-trous
+	// wavelet filter, which is guided by albedo and ray
+	// incidence angles. It does not use a neural network,
+	// and it is faster than ModelTypeBilateralAux.
+	ModelTypeWaveletAux
+
+	// ModelTypeNonLocalMeans uses a non-local means filter,
+	// which averages pixels whose surrounding patches look
+	// alike. It does not use a neural network, and it works
+	// well on repetitive textures.
+	ModelTypeNonLocalMeans
+
+	// ModelTypeUNet is a U-Net, which encodes the image at
+	// three resolutions and concatenates the features of
+	// each resolution with the upsampled features of the
+	// next one as it decodes them.
+	//
+	// There are no pre-trained parameters for this model
+	// yet, so it must be loaded with LoadModel.
+	ModelTypeUNet
+
+	// ModelTypeUNetAux is like ModelTypeUNet, but the model
+	// expects albedo and ray incidence angles as extra
+	// input channels.
+	ModelTypeUNetAux
 )
 
 // LCD gets a factor which must divide the dimensions of
 // images fed to this type of model.
+//
+// This agrees with nn.DimensionDivisor for the model's
+// layer; see also Denoiser.LCD.
 func (m ModelType) LCD() int {
 	switch m {
-	case ModelTypeBilateral, ModelTypeShallow, ModelTypeShallowAux:
+	case ModelTypeBilateral, ModelTypeShallow, ModelTypeShallowAux, ModelTypeBilateralAux,
+		ModelTypeWaveletAux, ModelTypeNonLocalMeans:
 		return 1
-	case ModelTypeDeep, ModelTypeDeepAux:
+	case ModelTypeDeep, ModelTypeDeepAux, ModelTypeKPCN, ModelTypeKPCNAux, ModelTypeUNet,
+		ModelTypeUNetAux:
 		return 4
+	case ModelTypeDeepInt8, ModelTypeDeepFloat16, ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16:
+		return m.FloatModel().LCD()
 	default:
 		panic("unknown model type")
 	}
@@ -49,22 +136,64 @@ func (m ModelType) LCD() int {
 //
 // The radius is the maximum number of pixels to the left,
 // right, top, or bottom that the model can "see".
+//
+// This agrees with nn.ReceptiveField for the model's
+// layer; see also Denoiser.RF. For the deep models, it is
+// 45, which corrects an earlier estimate of 42.
+//
+// For U-Nets, this assumes the default channel counts
+// (see Architecture.UNetChannels), since the receptive
+// field grows with the number of levels.
 func (m ModelType) RF() int {
 	switch m {
-	case ModelTypeBilateral:
+	case ModelTypeBilateral, ModelTypeBilateralAux:
 		return 7
-	case ModelTypeShallow, ModelTypeShallowAux:
+	case ModelTypeShallow, ModelTypeShallowAux, ModelTypeNonLocalMeans:
 		return 4
-	case ModelTypeDeep, ModelTypeDeepAux:
-		return 42
+	case ModelTypeWaveletAux:
+		return 14
+	case ModelTypeDeep, ModelTypeDeepAux, ModelTypeKPCN, ModelTypeKPCNAux:
+		return 45
+	case ModelTypeUNet, ModelTypeUNetAux:
+		return 26
+	case ModelTypeDeepInt8, ModelTypeDeepFloat16, ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16:
+		return m.FloatModel().RF()
 	default:
 		panic("unknown model type")
 	}
 }
 
+// Builtin checks if the model has pre-trained parameters
+// in this package, so that Layer can create it.
+//
+// Other models must be loaded with LoadModel.
+func (m ModelType) Builtin() bool {
+	switch m {
+	case ModelTypeKPCN, ModelTypeKPCNAux:
+		return false
+	}
+	return m >= ModelTypeBilateral && m <= ModelTypeNonLocalMeans
+}
+
 // Layer creates a pre-trained layer implementing this
 // model.
+//
+// This panics if the model is not built in (see Builtin).
+//
+// Quantized models are calibrated on the first call, and
+// later calls return the same layer, which should not be
+// modified.
 func (m ModelType) Layer() nn.Layer {
+	layer, err := m.layerChecked()
+	if err != nil {
+		panic(err)
+	}
+	return layer
+}
+
+// layerChecked is like Layer, but returns an error if the
+// model is not built in.
+func (m ModelType) layerChecked() (nn.Layer, error) {
 	switch m {
 	case ModelTypeBilateral:
 		return &nn.Bilateral{
@@ -74,21 +203,94 @@ func (m ModelType) Layer() nn.Layer {
 			SigmaDiff: 0.4821,
 
 			KernelSize: 15,
-		}
+		}, nil
+	case ModelTypeBilateralAux:
+		return &nn.JointBilateral{
+			// Parameters found with a grid search on
+			// path-traced renderings of simple scenes.
+			SigmaBlur: 2,
+			SigmaDiff: 1,
+
+			// Albedo (RGB) followed by incidence.
+			SigmaGuide: []float64{0.05, 0.05, 0.05, 0.3},
+
+			KernelSize: 15,
+			Depth:      3,
+		}, nil
+	case ModelTypeWaveletAux:
+		return &nn.ATrous{
+			// Parameters found with a grid search on
+			// path-traced renderings of simple scenes.
+			SigmaColor: 1,
+
+			// Albedo (RGB) followed by incidence.
+			SigmaGuide: []float64{0.02, 0.02, 0.02, 0.02},
+
+			Iterations: 3,
+			Depth:      3,
+		}, nil
+	case ModelTypeNonLocalMeans:
+		return &nn.NonLocalMeans{
+			// Parameters found with a grid search on
+			// path-traced renderings of simple scenes with
+			// 64 samples per pixel. Noisier images need a
+			// larger strength.
+			Strength: 0.05,
+
+			SearchSize: 7,
+			PatchSize:  3,
+		}, nil
 	case ModelTypeShallow:
-		return createShallow()
+		return createShallow(mustReadParameterZip(shallowModelZipData), false, 5, 32)
 	case ModelTypeDeep:
-		return createDeep(false)
+		return createDeep(mustReadParameterZip(deepModelZipData), false, defaultDeepChannels)
 	case ModelTypeShallowAux:
-		return createShallowAux()
+		return createShallow(mustReadParameterZip(shallowAuxModelZipData), true, 5, 32)
 	case ModelTypeDeepAux:
-		return createDeep(true)
+		return createDeep(mustReadParameterZip(deepAuxModelZipData), true, defaultDeepChannels)
+	case ModelTypeDeepInt8, ModelTypeDeepFloat16, ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16:
+		return quantizedLayer(m)
+	case ModelTypeKPCN, ModelTypeKPCNAux:
+		return nil, errors.New("no pre-trained parameters for KPCN models (see LoadModel)")
+	case ModelTypeUNet, ModelTypeUNetAux:
+		return nil, errors.New("no pre-trained parameters for U-Net models (see LoadModel)")
 	default:
-		panic("unknown model type")
+		return nil, errors.New("unknown model type")
 	}
 }
 
 // Aux checks if the model requires auxiliary features.
 func (m ModelType) Aux() bool {
-	return m == ModelTypeShallowAux || m == ModelTypeDeepAux
+	switch m {
+	case ModelTypeShallowAux, ModelTypeDeepAux, ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16,
+		ModelTypeKPCNAux, ModelTypeBilateralAux, ModelTypeWaveletAux, ModelTypeUNetAux:
+		return true
+	}
+	return false
+}
+
+// Quantization gets the number format of a quantized
+// model. If the model is not quantized, ok is false.
+func (m ModelType) Quantization() (format nn.QuantFormat, ok bool) {
+	switch m {
+	case ModelTypeDeepInt8, ModelTypeDeepAuxInt8:
+		return nn.QuantInt8, true
+	case ModelTypeDeepFloat16, ModelTypeDeepAuxFloat16:
+		return nn.QuantFloat16, true
+	}
+	return 0, false
+}
+
+// FloatModel gets the floating-point model that a
+// quantized model was derived from.
+//
+// For other models, m itself is returned.
+func (m ModelType) FloatModel() ModelType {
+	switch m {
+	case ModelTypeDeepInt8, ModelTypeDeepFloat16:
+		return ModelTypeDeep
+	case ModelTypeDeepAuxInt8, ModelTypeDeepAuxFloat16:
+		return ModelTypeDeepAux
+	}
+	return m
 }
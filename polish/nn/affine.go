@@ -1,5 +1,7 @@
 package nn
 
+import "image"
+
 // A Bias layer adds a per-channel constant to a Tensor.
 type Bias struct {
 	Data []float32
@@ -7,22 +9,46 @@ type Bias struct {
 
 // Apply adds the bias to the Tensor.
 func (b *Bias) Apply(t *Tensor) *Tensor {
-	if len(b.Data) != t.Depth {
-		panic("depth must match number of bias channels")
-	}
-	res := NewTensor(t.Height, t.Width, t.Depth)
-	var idx int
-	for y := 0; y < t.Height; y++ {
-		for x := 0; x < t.Width; x++ {
-			for z := 0; z < t.Depth; z++ {
-				res.Data[idx] = t.Data[idx] + b.Data[z]
-				idx++
-			}
-		}
+	if err := b.Check(t); err != nil {
+		panic(err)
 	}
+	res := copyTensor(t)
+	b.ApplyInPlace(res)
 	return res
 }
 
+// ApplyInPlace adds the bias to the Tensor in place.
+func (b *Bias) ApplyInPlace(t *Tensor) {
+	if err := b.Check(t); err != nil {
+		panic(err)
+	}
+	if !t.IsContiguous() {
+		applyToView(t, b.ApplyInPlace)
+		return
+	}
+	for idx := 0; idx < len(t.Data); idx += t.Depth {
+		pixel := t.Data[idx : idx+t.Depth]
+		addVec(pixel, b.Data, pixel)
+	}
+}
+
+// Check verifies that the Tensor has one channel per
+// bias value.
+func (b *Bias) Check(t *Tensor) error {
+	return checkDepth(t.Shape(), len(b.Data))
+}
+
+// OutputShape returns the input shape if it is valid.
+func (b *Bias) OutputShape(in Shape) (Shape, error) {
+	return in, checkDepth(in, len(b.Data))
+}
+
+// InputRegion returns the output region, since the bias
+// is applied to each pixel independently.
+func (b *Bias) InputRegion(out image.Rectangle) image.Rectangle {
+	return out
+}
+
 // A Mul layer multiplies a per-channel mask to a Tensor.
 type Mul struct {
 	Data []float32
@@ -30,18 +56,118 @@ type Mul struct {
 
 // Apply multiplies the mask to the Tensor.
 func (m *Mul) Apply(t *Tensor) *Tensor {
-	if len(m.Data) != t.Depth {
-		panic("depth must match number of bias channels")
-	}
-	res := NewTensor(t.Height, t.Width, t.Depth)
-	var idx int
-	for y := 0; y < t.Height; y++ {
-		for x := 0; x < t.Width; x++ {
-			for z := 0; z < t.Depth; z++ {
-				res.Data[idx] = t.Data[idx] * m.Data[z]
-				idx++
-			}
-		}
+	if err := m.Check(t); err != nil {
+		panic(err)
 	}
+	res := copyTensor(t)
+	m.ApplyInPlace(res)
 	return res
 }
+
+// ApplyInPlace multiplies the mask to the Tensor in place.
+func (m *Mul) ApplyInPlace(t *Tensor) {
+	if err := m.Check(t); err != nil {
+		panic(err)
+	}
+	if !t.IsContiguous() {
+		applyToView(t, m.ApplyInPlace)
+		return
+	}
+	for idx := 0; idx < len(t.Data); idx += t.Depth {
+		pixel := t.Data[idx : idx+t.Depth]
+		mulVec(pixel, m.Data, pixel)
+	}
+}
+
+// Check verifies that the Tensor has one channel per mask
+// value.
+func (m *Mul) Check(t *Tensor) error {
+	return checkDepth(t.Shape(), len(m.Data))
+}
+
+// OutputShape returns the input shape if it is valid.
+func (m *Mul) OutputShape(in Shape) (Shape, error) {
+	return in, checkDepth(in, len(m.Data))
+}
+
+// InputRegion returns the output region, since the mask
+// is applied to each pixel independently.
+func (m *Mul) InputRegion(out image.Rectangle) image.Rectangle {
+	return out
+}
+
+// An Affine layer multiplies each channel of a Tensor by a
+// scale and then adds a bias, optionally followed by a
+// ReLU.
+//
+// Affine layers are produced by Optimize to fuse chains of
+// Bias, Mul, and ReLU layers into a single operation.
+type Affine struct {
+	// Scale, if non-nil, contains a per-channel scale.
+	Scale []float32
+
+	// Bias, if non-nil, contains a per-channel bias which
+	// is added after scaling.
+	Bias []float32
+
+	// ReLU, if true, applies the rectified linear unit to
+	// the result.
+	ReLU bool
+}
+
+// Apply applies the affine transformation to the Tensor.
+func (a *Affine) Apply(t *Tensor) *Tensor {
+	if err := a.Check(t); err != nil {
+		panic(err)
+	}
+	res := copyTensor(t)
+	a.ApplyInPlace(res)
+	return res
+}
+
+// ApplyInPlace applies the affine transformation to the
+// Tensor in place.
+func (a *Affine) ApplyInPlace(t *Tensor) {
+	if err := a.Check(t); err != nil {
+		panic(err)
+	}
+	if !t.IsContiguous() {
+		applyToView(t, a.ApplyInPlace)
+		return
+	}
+	if a.Scale != nil {
+		for idx := 0; idx < len(t.Data); idx += t.Depth {
+			pixel := t.Data[idx : idx+t.Depth]
+			mulVec(pixel, a.Scale, pixel)
+		}
+	}
+	convEpilogue(t.Data, a.Bias, a.ReLU)
+}
+
+// Check verifies that the Tensor has one channel per
+// scale and bias value.
+func (a *Affine) Check(t *Tensor) error {
+	_, err := a.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape returns the input shape if it is valid.
+func (a *Affine) OutputShape(in Shape) (Shape, error) {
+	if a.Scale != nil {
+		if err := checkDepth(in, len(a.Scale)); err != nil {
+			return Shape{}, err
+		}
+	}
+	if a.Bias != nil {
+		if err := checkDepth(in, len(a.Bias)); err != nil {
+			return Shape{}, err
+		}
+	}
+	return in, nil
+}
+
+// InputRegion returns the output region, since the
+// transformation is applied to each pixel independently.
+func (a *Affine) InputRegion(out image.Rectangle) image.Rectangle {
+	return out
+}
@@ -0,0 +1,176 @@
+package nn
+
+import (
+	"errors"
+	"image"
+)
+
+// atrousKernel is the 1D B3-spline used by every pass of
+// an ATrous filter.
+var atrousKernel = [5]float64{1.0 / 16, 1.0 / 4, 3.0 / 8, 1.0 / 4, 1.0 / 16}
+
+// ATrous is an edge-avoiding à-trous wavelet filter, as
+// used by SVGF. It filters the first Depth channels of
+// its input, using the remaining channels as guides.
+//
+// The filter runs Iterations passes of a 5x5 B3-spline
+// kernel, where pass i spreads the kernel out with a
+// dilation of 2^i. Thus, large blurs take only a few
+// passes, and the cost per pixel does not depend on the
+// size of the image.
+//
+// Each tap of the kernel is multiplied by the edge-stopping
+// weight
+//
+//     exp(-(D^2/SigmaColor_i^2 + sum_j G_j^2/SigmaGuide[j]^2))
+//
+// where D is the Euclidean distance between the filtered
+// channels of the pixels in the output of the previous
+// pass, and G_j is the difference in guide channel j.
+// Since every pass removes noise, SigmaColor_i is
+// SigmaColor divided by 2^i.
+// Taps outside of the input are ignored.
+type ATrous struct {
+	Depth      int
+	Iterations int
+
+	// SigmaColor scales the differences between the
+	// filtered channels. If it is 0, the filtered channels
+	// do not affect the weights.
+	SigmaColor float64
+
+	// SigmaGuide scales the differences in each guide
+	// channel. The input has Depth+len(SigmaGuide)
+	// channels.
+	SigmaGuide []float64
+}
+
+// Apply applies the filter and returns a Tensor with the
+// filtered channels of t.
+func (a *ATrous) Apply(t *Tensor) *Tensor {
+	if err := a.Check(t); err != nil {
+		panic(err)
+	}
+	out := NewTensor(t.Height, t.Width, a.Depth)
+	a.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the filter and writes the result to
+// out.
+func (a *ATrous) ApplyTo(t, out *Tensor) {
+	if err := a.Check(t); err != nil {
+		panic(err)
+	}
+	color := t.Channels(0, a.Depth)
+	guide := t.Channels(a.Depth, t.Depth)
+	if a.Iterations == 0 {
+		out.CopyFrom(color)
+		return
+	}
+	var buffers [2]*Tensor
+	for i := 0; i < a.Iterations; i++ {
+		dst := out
+		if i+1 < a.Iterations {
+			if buffers[i%2] == nil {
+				buffers[i%2] = NewTensor(t.Height, t.Width, a.Depth)
+			}
+			dst = buffers[i%2]
+		}
+		a.pass(color, guide, dst, i)
+		color = dst
+	}
+}
+
+func (a *ATrous) pass(color, guide, out *Tensor, iteration int) {
+	dilation := 1 << uint(iteration)
+	invColor := 0.0
+	if a.SigmaColor != 0 {
+		sigma := a.SigmaColor / float64(dilation)
+		invColor = 1 / (sigma * sigma)
+	}
+	invGuide := make([]float64, len(a.SigmaGuide))
+	for i, s := range a.SigmaGuide {
+		invGuide[i] = 1 / (s * s)
+	}
+
+	interleaveRows(out.Height, func(start, stride int) {
+		sums := make([]float64, a.Depth)
+		for y := start; y < out.Height; y += stride {
+			for x := 0; x < out.Width; x++ {
+				centerColor := color.Pixel(y, x)
+				centerGuide := guide.Pixel(y, x)
+				for i := range sums {
+					sums[i] = 0
+				}
+				weightSum := 0.0
+				for ky, hy := range atrousKernel {
+					srcY := y + (ky-2)*dilation
+					if srcY < 0 || srcY >= color.Height {
+						continue
+					}
+					for kx, hx := range atrousKernel {
+						srcX := x + (kx-2)*dilation
+						if srcX < 0 || srcX >= color.Width {
+							continue
+						}
+						pixel := color.Pixel(srcY, srcX)
+						var energy float64
+						if invColor != 0 {
+							for i, v := range pixel {
+								diff := float64(v - centerColor[i])
+								energy += float64(diff * diff * invColor)
+							}
+						}
+						for i, v := range guide.Pixel(srcY, srcX) {
+							diff := float64(v - centerGuide[i])
+							energy += float64(diff * diff * invGuide[i])
+						}
+						weight := float64(hy * hx * exp(-energy))
+						weightSum += weight
+						for i, v := range pixel {
+							sums[i] += float64(weight * float64(v))
+						}
+					}
+				}
+				dst := out.Pixel(y, x)
+				for i, s := range sums {
+					dst[i] = float32(s / weightSum)
+				}
+			}
+		}
+	})
+}
+
+// Check verifies that the Tensor has the filtered and
+// guide channels.
+func (a *ATrous) Check(t *Tensor) error {
+	_, err := a.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape of the filtered
+// channels.
+func (a *ATrous) OutputShape(in Shape) (Shape, error) {
+	if a.Iterations < 0 || a.Iterations > 30 {
+		return Shape{}, errors.New("number of iterations is out of range")
+	}
+	if a.SigmaColor < 0 {
+		return Shape{}, errors.New("color sigma must be non-negative")
+	}
+	for _, s := range a.SigmaGuide {
+		if s <= 0 {
+			return Shape{}, errors.New("guide sigmas must be positive")
+		}
+	}
+	if err := checkDepth(in, a.Depth+len(a.SigmaGuide)); err != nil {
+		return Shape{}, err
+	}
+	return Shape{Height: in.Height, Width: in.Width, Depth: a.Depth}, nil
+}
+
+// InputRegion expands the output region by the combined
+// radius of every pass.
+func (a *ATrous) InputRegion(out image.Rectangle) image.Rectangle {
+	return out.Inset(-2 * ((1 << uint(a.Iterations)) - 1))
+}
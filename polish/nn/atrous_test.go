@@ -0,0 +1,89 @@
+package nn
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestATrous(t *testing.T) {
+	layer := &ATrous{
+		Depth:      3,
+		Iterations: 3,
+		SigmaColor: 0.8,
+		SigmaGuide: []float64{0.5, 0.3},
+	}
+	in := NewTensor(11, 13, 5)
+	copy(in.Data, randomVector(len(in.Data)))
+
+	kernel := []float64{1.0 / 16, 1.0 / 4, 3.0 / 8, 1.0 / 4, 1.0 / 16}
+	color := in
+	for i := 0; i < layer.Iterations; i++ {
+		dilation := 1 << uint(i)
+		sigmaColor := layer.SigmaColor / float64(dilation)
+		next := NewTensor(in.Height, in.Width, layer.Depth)
+		for y := 0; y < in.Height; y++ {
+			for x := 0; x < in.Width; x++ {
+				var weightSum float64
+				sums := make([]float64, layer.Depth)
+				for ky := 0; ky < 5; ky++ {
+					for kx := 0; kx < 5; kx++ {
+						srcY, srcX := y+(ky-2)*dilation, x+(kx-2)*dilation
+						if srcY < 0 || srcX < 0 || srcY >= in.Height || srcX >= in.Width {
+							continue
+						}
+						var energy float64
+						for z := 0; z < layer.Depth; z++ {
+							diff := float64(*color.At(srcY, srcX, z) - *color.At(y, x, z))
+							energy += diff * diff / (sigmaColor * sigmaColor)
+						}
+						for z, sigma := range layer.SigmaGuide {
+							diff := float64(*in.At(srcY, srcX, z+layer.Depth) -
+								*in.At(y, x, z+layer.Depth))
+							energy += diff * diff / (sigma * sigma)
+						}
+						w := kernel[ky] * kernel[kx] * math.Exp(-energy)
+						weightSum += w
+						for z := range sums {
+							sums[z] += w * float64(*color.At(srcY, srcX, z))
+						}
+					}
+				}
+				for z, s := range sums {
+					*next.At(y, x, z) = float32(s / weightSum)
+				}
+			}
+		}
+		color = next
+	}
+	checkTensorsClose(t, color, layer.Apply(in), 1e-5)
+
+	plan, err := NewPlan(layer, in.Shape())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTensorsClose(t, color, plan.Apply(in), 1e-5)
+
+	if rf, err := ReceptiveField(layer); err != nil || rf != 14 {
+		t.Errorf("expected receptive field 14 but got %d (%v)", rf, err)
+	}
+	region, err := InputRegion(layer, image.Rect(3, 4, 5, 5))
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := image.Rect(-11, -10, 19, 19); region != expected {
+		t.Errorf("expected region %v but got %v", expected, region)
+	}
+
+	for _, bad := range []*ATrous{
+		{Depth: 3, Iterations: 2, SigmaColor: -1, SigmaGuide: []float64{1}},
+		{Depth: 3, Iterations: 2, SigmaColor: 1, SigmaGuide: []float64{1, 0}},
+	} {
+		shape := Shape{Height: 3, Width: 3, Depth: bad.Depth + len(bad.SigmaGuide)}
+		if _, err := bad.OutputShape(shape); err == nil {
+			t.Errorf("expected error for sigmas %f, %v", bad.SigmaColor, bad.SigmaGuide)
+		}
+	}
+
+	noop := &ATrous{Depth: 3, SigmaGuide: layer.SigmaGuide}
+	checkTensorsClose(t, in.Channels(0, 3).Contiguous(), noop.Apply(in), 0)
+}
@@ -1,17 +1,65 @@
 package nn
 
-import "math"
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// BilateralMethod determines how a Bilateral layer
+// computes its output.
+type BilateralMethod int
+
+const (
+	// BilateralExact sums over every pixel in the kernel,
+	// so the cost grows with the square of KernelSize.
+	BilateralExact BilateralMethod = iota
+
+	// BilateralGrid approximates the filter with a
+	// bilateral grid, which takes roughly constant time per
+	// pixel regardless of the blur radius.
+	//
+	// The Gaussian is not cut off by KernelSize, so large
+	// values of SigmaBlur are practical.
+	//
+	// The grid cells are aligned to the top-left corner of
+	// the input, so the output of a pixel changes slightly
+	// if the input is cropped. In particular, denoising an
+	// image in patches may produce faint seams along the
+	// patch boundaries.
+	//
+	// To bound the size of the grid, the range axis is
+	// made coarser for channels with a very large range of
+	// values relative to SigmaDiff, which blurs their edges
+	// more.
+	// If SigmaBlur is less than sqrt(2), the grid cells
+	// would be smaller than pixels, so the filter is
+	// computed directly instead, over the same radius.
+	// Infinite and NaN values are passed through unchanged
+	// and do not affect other pixels.
+	BilateralGrid
+)
 
 // Bilateral is a bilateral filtering layer.
 type Bilateral struct {
 	KernelSize int
 	SigmaBlur  float64
 	SigmaDiff  float64
+
+	// Method determines how the filter is computed.
+	Method BilateralMethod
 }
 
 // Apply applies the bilateral filter and returns a Tensor
 // of the same shape as t.
 func (b *Bilateral) Apply(t *Tensor) *Tensor {
+	if _, err := b.OutputShape(t.Shape()); err != nil {
+		panic(err)
+	}
+	if b.Method == BilateralGrid {
+		return b.applyGrid(t)
+	}
+
 	distances := NewTensor(b.KernelSize, b.KernelSize, 1)
 	center := b.KernelSize / 2
 	for i := 0; i < b.KernelSize; i++ {
@@ -24,13 +72,38 @@ func (b *Bilateral) Apply(t *Tensor) *Tensor {
 	// the filter from incorporating the padding.
 	padded := t.Add(100).Pad(center, center, center, center).Add(-100)
 	out := NewTensor(t.Height, t.Width, t.Depth)
-	Patches(padded, b.KernelSize, 1, func(idx int, patch *Tensor) {
-		b.blurPatch(distances, patch, out.Data[idx*out.Depth:(idx+1)*out.Depth])
+	interleaveRows(out.Height, func(start, stride int) {
+		for y := start; y < out.Height; y += stride {
+			for x := 0; x < out.Width; x++ {
+				patch := padded.View(image.Rect(x, y, x+b.KernelSize, y+b.KernelSize))
+				b.blurPatch(distances, patch, out.Pixel(y, x))
+			}
+		}
 	})
 
 	return out
 }
 
+// OutputShape returns the input shape.
+func (b *Bilateral) OutputShape(in Shape) (Shape, error) {
+	if b.Method < BilateralExact || b.Method > BilateralGrid {
+		return Shape{}, fmt.Errorf("unknown bilateral method: %d", b.Method)
+	}
+	if b.Method == BilateralGrid && (b.SigmaBlur <= 0 || b.SigmaDiff <= 0) {
+		return Shape{}, errors.New("bilateral grid requires positive sigmas")
+	}
+	return in, nil
+}
+
+// InputRegion expands the output region by the radius of
+// the filter.
+func (b *Bilateral) InputRegion(out image.Rectangle) image.Rectangle {
+	if b.Method == BilateralGrid {
+		return out.Inset(-b.gridRadius())
+	}
+	return out.Inset(-(b.KernelSize / 2))
+}
+
 func (b *Bilateral) blurPatch(dists, patch *Tensor, out []float32) {
 	for i := 0; i < patch.Depth; i++ {
 		out[i] = b.blurPatchChannel(dists, patch, i)
@@ -43,16 +116,159 @@ func (b *Bilateral) blurPatchChannel(dists, patch *Tensor, z int) float32 {
 
 	weightedSum := 0.0
 	weightSum := 0.0
-	distsIdx := 0
-	for patchIdx := z; patchIdx < len(patch.Data); patchIdx += patch.Depth {
-		patchVal := float64(patch.Data[patchIdx])
-		dist := dists.Data[distsIdx]
-		distsIdx++
-		weight := math.Exp(-(float64(dist)/(b.SigmaBlur*b.SigmaBlur) +
-			math.Pow(patchVal-center, 2)/(b.SigmaDiff*b.SigmaDiff)))
-		weightSum += weight
-		weightedSum += weight * float64(patchVal)
+	for y := 0; y < patch.Height; y++ {
+		for x := 0; x < patch.Width; x++ {
+			patchVal := float64(*patch.At(y, x, z))
+			dist := *dists.At(y, x, 0)
+			diff := patchVal - center
+			weight := exp(-(float64(dist)/(b.SigmaBlur*b.SigmaBlur) +
+				float64(diff*diff)/(b.SigmaDiff*b.SigmaDiff)))
+			weightSum += weight
+			weightedSum += float64(weight * patchVal)
+		}
 	}
 
 	return float32(weightedSum / weightSum)
 }
+
+// JointBilateral is a joint (or cross) bilateral filtering
+// layer, which filters the first Depth channels of its
+// input using range weights from the remaining guide
+// channels.
+//
+// Guide channels such as albedo and surface orientation
+// are noise-free, so they distinguish texture and
+// geometry edges from noise better than the filtered
+// channels themselves.
+//
+// The weight of a neighbor at distance d is
+//
+//     exp(-(d^2/SigmaBlur^2 + D^2/SigmaDiff^2 +
+//           sum_i G_i^2/SigmaGuide[i]^2))
+//
+// where D is the Euclidean distance between the filtered
+// channels of the pixels, and G_i is the difference in
+// the guide channel i. Neighbors outside of the input are
+// ignored.
+type JointBilateral struct {
+	KernelSize int
+	Depth      int
+	SigmaBlur  float64
+
+	// SigmaDiff scales the differences between the
+	// filtered channels. If it is 0, the filtered channels
+	// do not affect the weights.
+	SigmaDiff float64
+
+	// SigmaGuide scales the differences in each guide
+	// channel. The input has Depth+len(SigmaGuide)
+	// channels.
+	SigmaGuide []float64
+}
+
+// Apply applies the filter and returns a Tensor with the
+// filtered channels of t.
+func (j *JointBilateral) Apply(t *Tensor) *Tensor {
+	if err := j.Check(t); err != nil {
+		panic(err)
+	}
+	out := NewTensor(t.Height, t.Width, j.Depth)
+	j.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the filter and writes the result to
+// out.
+func (j *JointBilateral) ApplyTo(t, out *Tensor) {
+	if err := j.Check(t); err != nil {
+		panic(err)
+	}
+	radius := j.KernelSize / 2
+	invDiff := 0.0
+	if j.SigmaDiff != 0 {
+		invDiff = 1 / (j.SigmaDiff * j.SigmaDiff)
+	}
+	invGuide := make([]float64, len(j.SigmaGuide))
+	for i, s := range j.SigmaGuide {
+		invGuide[i] = 1 / (s * s)
+	}
+	invBlur := 1 / (j.SigmaBlur * j.SigmaBlur)
+
+	interleaveRows(out.Height, func(start, stride int) {
+		sums := make([]float64, j.Depth)
+		for y := start; y < out.Height; y += stride {
+			for x := 0; x < out.Width; x++ {
+				center := t.Pixel(y, x)
+				for i := range sums {
+					sums[i] = 0
+				}
+				weightSum := 0.0
+				for srcY := y - radius; srcY <= y+radius; srcY++ {
+					if srcY < 0 || srcY >= t.Height {
+						continue
+					}
+					for srcX := x - radius; srcX <= x+radius; srcX++ {
+						if srcX < 0 || srcX >= t.Width {
+							continue
+						}
+						pixel := t.Pixel(srcY, srcX)
+						dy, dx := srcY-y, srcX-x
+						energy := float64(dy*dy+dx*dx) * invBlur
+						if invDiff != 0 {
+							for i, v := range pixel[:j.Depth] {
+								diff := float64(v - center[i])
+								energy += float64(diff * diff * invDiff)
+							}
+						}
+						for i, v := range pixel[j.Depth:] {
+							diff := float64(v - center[j.Depth+i])
+							energy += float64(diff * diff * invGuide[i])
+						}
+						weight := exp(-energy)
+						weightSum += weight
+						for i, v := range pixel[:j.Depth] {
+							sums[i] += float64(weight * float64(v))
+						}
+					}
+				}
+				dst := out.Pixel(y, x)
+				for i, s := range sums {
+					dst[i] = float32(s / weightSum)
+				}
+			}
+		}
+	})
+}
+
+// Check verifies that the Tensor has the filtered and
+// guide channels.
+func (j *JointBilateral) Check(t *Tensor) error {
+	_, err := j.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape of the filtered
+// channels.
+func (j *JointBilateral) OutputShape(in Shape) (Shape, error) {
+	if j.KernelSize < 1 {
+		return Shape{}, errors.New("kernel size must be positive")
+	}
+	if j.SigmaBlur <= 0 || j.SigmaDiff < 0 {
+		return Shape{}, errors.New("sigmas must be positive")
+	}
+	for _, s := range j.SigmaGuide {
+		if s <= 0 {
+			return Shape{}, errors.New("guide sigmas must be positive")
+		}
+	}
+	if err := checkDepth(in, j.Depth+len(j.SigmaGuide)); err != nil {
+		return Shape{}, err
+	}
+	return Shape{Height: in.Height, Width: in.Width, Depth: j.Depth}, nil
+}
+
+// InputRegion expands the output region by the radius of
+// the filter.
+func (j *JointBilateral) InputRegion(out image.Rectangle) image.Rectangle {
+	return out.Inset(-(j.KernelSize / 2))
+}
@@ -0,0 +1,269 @@
+package nn
+
+import (
+	"math"
+
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// bilateralGridBlurRadius is the radius, in cells, of
+	// the Gaussian blur applied to a bilateral grid.
+	bilateralGridBlurRadius = 2
+
+	// bilateralGridBlurVariance is the variance, in cells
+	// squared, of the blur applied to a bilateral grid.
+	//
+	// Splatting and slicing with linear interpolation each
+	// add a variance of 1/6, so that the total variance is
+	// one squared cell, like the Gaussian being
+	// approximated.
+	bilateralGridBlurVariance = 2.0 / 3.0
+
+	// bilateralGridMaxRange is the maximum number of cells
+	// along the range axis of a bilateral grid.
+	bilateralGridMaxRange = 256
+)
+
+// applyGrid approximates the filter with a bilateral grid
+// for each channel.
+//
+// The grid has one cell per standard deviation of the
+// Gaussian along each spatial axis and along the range
+// axis. Pixels are splatted into the grid with linear
+// interpolation, the grid is blurred, and the output is
+// sliced out of the grid with linear interpolation.
+func (b *Bilateral) applyGrid(t *Tensor) *Tensor {
+	out := NewTensor(t.Height, t.Width, t.Depth)
+	if len(out.Data) == 0 {
+		return out
+	}
+	interleaveRows(t.Depth, func(start, stride int) {
+		for z := start; z < t.Depth; z += stride {
+			b.filterChannelGrid(t.Channels(z, z+1), out.Channels(z, z+1))
+		}
+	})
+	return out
+}
+
+// gridRadius computes the maximum distance between an
+// output pixel and the input pixels it depends on.
+//
+// A pixel is splatted into cells less than one cell away,
+// the blur moves values by at most the blur radius, and
+// slicing reads cells less than one cell away.
+func (b *Bilateral) gridRadius() int {
+	return int(math.Ceil((bilateralGridBlurRadius + 2) * b.gridCellSize()))
+}
+
+// gridCellSize computes the spatial size of a grid cell,
+// which is the standard deviation of the Gaussian.
+func (b *Bilateral) gridCellSize() float64 {
+	return b.SigmaBlur / math.Sqrt2
+}
+
+func (b *Bilateral) filterChannelGrid(in, out *Tensor) {
+	cellSize := b.gridCellSize()
+	if cellSize < 1 {
+		// The grid would have more cells than the image
+		// has pixels, so it is cheaper to filter directly.
+		b.filterChannelSmall(in, out)
+		return
+	}
+	rangeSize := b.SigmaDiff / math.Sqrt2
+
+	minValue, maxValue := math.Inf(1), math.Inf(-1)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			if v := float64(in.Pixel(y, x)[0]); isFinite(v) {
+				minValue = math.Min(minValue, v)
+				maxValue = math.Max(maxValue, v)
+			}
+		}
+	}
+	if minValue > maxValue {
+		// There are no finite values to filter.
+		out.CopyFrom(in)
+		return
+	}
+	if maxValue-minValue > rangeSize*(bilateralGridMaxRange-3) {
+		rangeSize = (maxValue - minValue) / (bilateralGridMaxRange - 3)
+	}
+
+	// The range axis is aligned to multiples of rangeSize,
+	// so that a pixel's output does not depend on the
+	// values of far away pixels.
+	rangeOffset := math.Floor(minValue / rangeSize)
+
+	grid := newBilateralGrid(
+		int((float64(in.Height)-1)/cellSize)+2,
+		int((float64(in.Width)-1)/cellSize)+2,
+		int(maxValue/rangeSize-rangeOffset)+2,
+	)
+	gridCoord := func(y, x int, v float32) (float64, float64, float64) {
+		return float64(y) / cellSize, float64(x) / cellSize,
+			float64(v)/rangeSize - rangeOffset
+	}
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			v := in.Pixel(y, x)[0]
+			if isFinite(float64(v)) {
+				gy, gx, gz := gridCoord(y, x, v)
+				grid.splat(gy, gx, gz, float64(v))
+			}
+		}
+	}
+	grid.blur()
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			v := in.Pixel(y, x)[0]
+			if isFinite(float64(v)) {
+				gy, gx, gz := gridCoord(y, x, v)
+				v = float32(grid.slice(gy, gx, gz))
+			}
+			out.Pixel(y, x)[0] = v
+		}
+	}
+}
+
+// filterChannelSmall computes the bilateral filter
+// directly for a grid with cells smaller than a pixel.
+//
+// Like the grid, it only reads pixels within gridRadius of
+// the output pixel, and it skips non-finite pixels.
+func (b *Bilateral) filterChannelSmall(in, out *Tensor) {
+	radius := b.gridRadius()
+	invBlur := 1 / (b.SigmaBlur * b.SigmaBlur)
+	invDiff := 1 / (b.SigmaDiff * b.SigmaDiff)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			center := float64(in.Pixel(y, x)[0])
+			if !isFinite(center) {
+				out.Pixel(y, x)[0] = float32(center)
+				continue
+			}
+			var weightedSum, weightSum float64
+			for y1 := essentials.MaxInt(0, y-radius); y1 <= y+radius && y1 < in.Height; y1++ {
+				for x1 := essentials.MaxInt(0, x-radius); x1 <= x+radius && x1 < in.Width; x1++ {
+					v := float64(in.Pixel(y1, x1)[0])
+					if !isFinite(v) {
+						continue
+					}
+					dist := (y1-y)*(y1-y) + (x1-x)*(x1-x)
+					diff := v - center
+					weight := exp(-(float64(float64(dist)*invBlur) + float64(diff*diff*invDiff)))
+					weightSum += weight
+					weightedSum += float64(weight * v)
+				}
+			}
+			out.Pixel(y, x)[0] = float32(weightedSum / weightSum)
+		}
+	}
+}
+
+func isFinite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+// bilateralGrid stores homogeneous values, i.e. pairs of
+// weighted sums and total weights, in a 3D grid.
+type bilateralGrid struct {
+	height int
+	width  int
+	depth  int
+	data   []float64
+}
+
+func newBilateralGrid(height, width, depth int) *bilateralGrid {
+	return &bilateralGrid{
+		height: height,
+		width:  width,
+		depth:  depth,
+		data:   make([]float64, height*width*depth*2),
+	}
+}
+
+// corners computes the indices of the cells around a
+// point in the grid, along with their interpolation
+// weights.
+func (b *bilateralGrid) corners(y, x, z float64, f func(idx int, weight float64)) {
+	y0, x0, z0 := math.Floor(y), math.Floor(x), math.Floor(z)
+	fy, fx, fz := y-y0, x-x0, z-z0
+	iy, ix, iz := int(y0), int(x0), int(z0)
+	for i := 0; i < 8; i++ {
+		cy, cx, cz := iy+i>>2, ix+(i>>1)&1, iz+i&1
+		weight := 1.0
+		weight *= linearWeight(fy, i>>2)
+		weight *= linearWeight(fx, (i>>1)&1)
+		weight *= linearWeight(fz, i&1)
+		f(((cy*b.width+cx)*b.depth+cz)*2, weight)
+	}
+}
+
+func linearWeight(frac float64, upper int) float64 {
+	if upper == 1 {
+		return frac
+	}
+	return 1 - frac
+}
+
+func (b *bilateralGrid) splat(y, x, z, value float64) {
+	b.corners(y, x, z, func(idx int, weight float64) {
+		b.data[idx] += float64(weight * value)
+		b.data[idx+1] += weight
+	})
+}
+
+func (b *bilateralGrid) slice(y, x, z float64) float64 {
+	var sum, weightSum float64
+	b.corners(y, x, z, func(idx int, weight float64) {
+		sum += float64(weight * b.data[idx])
+		weightSum += float64(weight * b.data[idx+1])
+	})
+	return sum / weightSum
+}
+
+// blur applies a separable Gaussian blur along every
+// axis of the grid.
+func (b *bilateralGrid) blur() {
+	var kernel [2*bilateralGridBlurRadius + 1]float64
+	for i := range kernel {
+		d := float64(i - bilateralGridBlurRadius)
+		kernel[i] = exp(-d * d / (2 * bilateralGridBlurVariance))
+	}
+	depthStride := 2
+	widthStride := depthStride * b.depth
+	heightStride := widthStride * b.width
+	b.blurAxis(kernel[:], b.height, heightStride)
+	b.blurAxis(kernel[:], b.width, widthStride)
+	b.blurAxis(kernel[:], b.depth, depthStride)
+}
+
+// blurAxis blurs every line of cells along an axis with
+// the given size and stride between cells.
+func (b *bilateralGrid) blurAxis(kernel []float64, size, stride int) {
+	line := make([]float64, size*2)
+	numLines := len(b.data) / (size * 2)
+	for i := 0; i < numLines; i++ {
+		// Every cell is the start of a line unless it is
+		// offset along the blurred axis.
+		start := (i/(stride/2))*stride*size + (i%(stride/2))*2
+		for j := 0; j < size; j++ {
+			idx := start + j*stride
+			line[j*2], line[j*2+1] = b.data[idx], b.data[idx+1]
+		}
+		for j := 0; j < size; j++ {
+			var sum, weightSum float64
+			for k, w := range kernel {
+				src := j + k - bilateralGridBlurRadius
+				if src < 0 || src >= size {
+					continue
+				}
+				sum += float64(w * line[src*2])
+				weightSum += float64(w * line[src*2+1])
+			}
+			idx := start + j*stride
+			b.data[idx], b.data[idx+1] = sum, weightSum
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package nn
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestJointBilateral(t *testing.T) {
+	layer := &JointBilateral{
+		KernelSize: 5,
+		Depth:      3,
+		SigmaBlur:  1.5,
+		SigmaDiff:  0.7,
+		SigmaGuide: []float64{0.3, 0.5},
+	}
+	in := NewTensor(7, 9, 5)
+	copy(in.Data, randomVector(len(in.Data)))
+
+	expected := NewTensor(in.Height, in.Width, layer.Depth)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			var weightSum float64
+			sums := make([]float64, layer.Depth)
+			for srcY := 0; srcY < in.Height; srcY++ {
+				for srcX := 0; srcX < in.Width; srcX++ {
+					if math.Abs(float64(srcY-y)) > 2 || math.Abs(float64(srcX-x)) > 2 {
+						continue
+					}
+					energy := float64((srcY-y)*(srcY-y)+(srcX-x)*(srcX-x)) / (1.5 * 1.5)
+					for z := 0; z < in.Depth; z++ {
+						diff := float64(*in.At(srcY, srcX, z) - *in.At(y, x, z))
+						if z < layer.Depth {
+							energy += diff * diff / (0.7 * 0.7)
+						} else {
+							sigma := layer.SigmaGuide[z-layer.Depth]
+							energy += diff * diff / (sigma * sigma)
+						}
+					}
+					w := math.Exp(-energy)
+					weightSum += w
+					for z := range sums {
+						sums[z] += w * float64(*in.At(srcY, srcX, z))
+					}
+				}
+			}
+			for z, s := range sums {
+				*expected.At(y, x, z) = float32(s / weightSum)
+			}
+		}
+	}
+	checkTensorsClose(t, expected, layer.Apply(in), 1e-5)
+
+	if _, err := layer.OutputShape(Shape{Height: 3, Width: 3, Depth: 3}); err == nil {
+		t.Error("expected error for missing guide channels")
+	}
+	for _, bad := range []*JointBilateral{
+		{KernelSize: 5, Depth: 3, SigmaDiff: 1, SigmaGuide: []float64{1}},
+		{KernelSize: 5, Depth: 3, SigmaBlur: 1, SigmaDiff: -1, SigmaGuide: []float64{1}},
+		{KernelSize: 5, Depth: 3, SigmaBlur: 1, SigmaGuide: []float64{1, 0}},
+	} {
+		shape := Shape{Height: 3, Width: 3, Depth: bad.Depth + len(bad.SigmaGuide)}
+		if _, err := bad.OutputShape(shape); err == nil {
+			t.Errorf("expected error for sigmas %f, %f, %v", bad.SigmaBlur, bad.SigmaDiff,
+				bad.SigmaGuide)
+		}
+	}
+}
+
+func TestJointBilateralUnguided(t *testing.T) {
+	// Without guides, a single channel is filtered like a
+	// regular bilateral filter.
+	in := NewTensor(8, 6, 1)
+	copy(in.Data, randomVector(len(in.Data)))
+	expected := (&Bilateral{KernelSize: 5, SigmaBlur: 1.2, SigmaDiff: 0.5}).Apply(in)
+	actual := (&JointBilateral{KernelSize: 5, Depth: 1, SigmaBlur: 1.2, SigmaDiff: 0.5}).Apply(in)
+	checkTensorsClose(t, expected, actual, 1e-5)
+}
+
+func TestBilateralGrid(t *testing.T) {
+	in := NewTensor(40, 50, 2)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			for z := 0; z < in.Depth; z++ {
+				v := 0.2
+				if x > 20+y/3 {
+					v = 0.8
+				}
+				*in.At(y, x, z) = float32(v + 0.1*math.Sin(float64(y*(z+1))/7) +
+					0.1*rand.NormFloat64())
+			}
+		}
+	}
+	for _, sigmaBlur := range []float64{1, 1.7, 4} {
+		for _, sigmaDiff := range []float64{0.2, 1} {
+			exact := &Bilateral{
+				KernelSize: int(sigmaBlur*3)*2 + 1,
+				SigmaBlur:  sigmaBlur,
+				SigmaDiff:  sigmaDiff,
+			}
+			grid := *exact
+			grid.Method = BilateralGrid
+			expected := exact.Apply(in)
+			actual := grid.Apply(in)
+			var sqErr float64
+			for i, x := range expected.Data {
+				sqErr += math.Pow(float64(x-actual.Data[i]), 2)
+			}
+			if rmse := math.Sqrt(sqErr / float64(len(expected.Data))); rmse > 0.01 {
+				t.Errorf("sigmas (%f, %f): RMSE %f is too large", sigmaBlur, sigmaDiff, rmse)
+			}
+		}
+	}
+	// Extreme values neither blow up the grid nor leak
+	// into other pixels.
+	hdr := copyTensor(in)
+	*hdr.At(3, 4, 0) = float32(math.Inf(1))
+	*hdr.At(5, 6, 0) = float32(math.NaN())
+	*hdr.At(30, 40, 1) = 1e30
+	for _, sigmaBlur := range []float64{1, 2} {
+		layer := &Bilateral{SigmaBlur: sigmaBlur, SigmaDiff: 0.1, Method: BilateralGrid}
+		out := layer.Apply(hdr)
+		for y := 0; y < out.Height; y++ {
+			for x := 0; x < out.Width; x++ {
+				for z := 0; z < out.Depth; z++ {
+					actual, input := *out.At(y, x, z), *hdr.At(y, x, z)
+					if !isFinite(float64(input)) {
+						if !math.IsNaN(float64(input)) && actual != input {
+							t.Errorf("non-finite value %f became %f", input, actual)
+						}
+					} else if !isFinite(float64(actual)) {
+						t.Errorf("output (%d, %d, %d) is %f", x, y, z, actual)
+					}
+				}
+			}
+		}
+	}
+
+	// A tiny blur does not allocate a grid with many
+	// cells per pixel, and it leaves the input unchanged.
+	out := (&Bilateral{SigmaBlur: 0.01, SigmaDiff: 1, Method: BilateralGrid}).Apply(in)
+	checkTensorsClose(t, in, out, 0)
+
+	if _, err := (&Bilateral{Method: BilateralGrid}).OutputShape(in.Shape()); err == nil {
+		t.Error("expected error for zero sigmas")
+	}
+}
+
+func TestBilateralGridInputRegion(t *testing.T) {
+	layer := &Bilateral{SigmaBlur: 2, SigmaDiff: 0.5, Method: BilateralGrid}
+	in := NewTensor(30, 30, 1)
+	for i := range in.Data {
+		in.Data[i] = rand.Float32()
+	}
+	in.Data[0], in.Data[1] = 0, 1
+	expected := layer.Apply(in)
+
+	// Changing a pixel (without changing the range of the
+	// input) only affects the outputs which depend on it.
+	*in.At(15, 12, 0) = 0.5
+	actual := layer.Apply(in)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			region := layer.InputRegion(image.Rect(x, y, x+1, y+1))
+			if image.Pt(12, 15).In(region) {
+				continue
+			}
+			if a, e := *actual.At(y, x, 0), *expected.At(y, x, 0); math.Abs(float64(a-e)) > 1e-6 {
+				t.Errorf("output (%d, %d) changed from %f to %f", x, y, e, a)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package nn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Checker is a Layer that can verify that an input
+// Tensor is valid before the Layer is applied to it.
+//
+// The Apply method of a Checker panics with the error
+// returned by Check when the input is invalid.
+type Checker interface {
+	Layer
+
+	// Check returns an error if the Tensor cannot be
+	// passed to Apply.
+	Check(t *Tensor) error
+}
+
+// A LayerError is an error caused by a specific Layer in
+// a network.
+type LayerError struct {
+	// Path contains the index of the Layer in every
+	// nested NN, Residual, or Graph, starting from the
+	// outermost.
+	Path []int
+
+	// Layer is the offending Layer.
+	Layer Layer
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error describes the error, including the path and type
+// of the offending Layer.
+func (l *LayerError) Error() string {
+	strPath := make([]string, len(l.Path))
+	for i, x := range l.Path {
+		strPath[i] = strconv.Itoa(x)
+	}
+	loc := strings.Join(strPath, ".")
+	if loc == "" {
+		loc = "root"
+	}
+	return fmt.Sprintf("layer %s (%T): %s", loc, l.Layer, l.Err.Error())
+}
+
+// ApplyChecked is like l.Apply(t), but it returns an
+// error instead of panicking if any Layer in the network
+// receives an invalid input.
+//
+// Layers which do not implement Checker are assumed to
+// accept any input.
+func ApplyChecked(l Layer, t *Tensor) (*Tensor, error) {
+	return applyChecked(l, t, nil)
+}
+
+func applyChecked(l Layer, t *Tensor, path []int) (*Tensor, error) {
+	switch l := l.(type) {
+	case NN:
+		res := t
+		for i, subLayer := range l {
+			var err error
+			res, err = applyChecked(subLayer, res, appendPath(path, i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case Residual:
+		out, err := applyChecked(NN(l), t, path)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSameShape(t, out); err != nil {
+			return nil, &LayerError{Path: path, Layer: l, Err: err}
+		}
+		return addTensors(t, out), nil
+	case *Graph:
+		return l.evaluate(t, path, applyChecked)
+	case Checker:
+		if err := l.Check(t); err != nil {
+			return nil, &LayerError{Path: path, Layer: l, Err: err}
+		}
+	}
+	return l.Apply(t), nil
+}
+
+func appendPath(path []int, idx int) []int {
+	return append(append([]int{}, path...), idx)
+}
+
+func checkSameShape(t1, t2 *Tensor) error {
+	if t1.Shape() != t2.Shape() {
+		return fmt.Errorf("output shape %v does not match input shape %v", t2.Shape(),
+			t1.Shape())
+	}
+	return nil
+}
+
+func checkDepth(s Shape, depth int) error {
+	if s.Depth != depth {
+		return fmt.Errorf("input has %d channels but expected %d", s.Depth, depth)
+	}
+	return nil
+}
+
+func checkKernelStride(kernelSize, stride int) error {
+	if kernelSize < 1 {
+		return fmt.Errorf("kernel size must be positive, but got %d", kernelSize)
+	}
+	if stride < 1 {
+		return fmt.Errorf("stride must be positive, but got %d", stride)
+	}
+	return nil
+}
+
+func checkKernel(s Shape, kernelSize int) error {
+	if s.Height < kernelSize || s.Width < kernelSize {
+		return fmt.Errorf("input size %dx%d is smaller than kernel size %d",
+			s.Height, s.Width, kernelSize)
+	}
+	return nil
+}
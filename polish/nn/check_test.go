@@ -0,0 +1,52 @@
+package nn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyChecked(t *testing.T) {
+	net := NN{
+		&Bias{Data: []float32{1, 2}},
+		Residual{
+			ReLU{},
+			&Mul{Data: []float32{2, 3}},
+		},
+		&Conv{InDepth: 3, OutDepth: 1, KernelSize: 1, Stride: 1, Weights: []float32{1, 1, 1}},
+	}
+	in := NewTensor(3, 4, 2)
+	_, err := ApplyChecked(net, in)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	layerErr, ok := err.(*LayerError)
+	if !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+	if !reflect.DeepEqual(layerErr.Path, []int{2}) || layerErr.Layer != net[2] {
+		t.Errorf("unexpected error location: %v", err)
+	}
+
+	net[1] = Residual{&Mul{Data: []float32{1}}}
+	_, err = ApplyChecked(net, in)
+	if layerErr, ok := err.(*LayerError); !ok || !reflect.DeepEqual(layerErr.Path, []int{1, 0}) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	net[1] = Residual{&Conv{InDepth: 2, OutDepth: 2, KernelSize: 3, Stride: 1,
+		Weights: make([]float32, 36)}}
+	_, err = ApplyChecked(net, in)
+	if layerErr, ok := err.(*LayerError); !ok || !reflect.DeepEqual(layerErr.Path, []int{1}) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	net[1] = ReLU{}
+	net[2] = &Conv{InDepth: 2, OutDepth: 1, KernelSize: 1, Stride: 1, Weights: []float32{1, 1}}
+	actual, err := ApplyChecked(net, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := net.Apply(in); !reflect.DeepEqual(actual, expected) {
+		t.Error("unexpected output")
+	}
+}
@@ -0,0 +1,116 @@
+package nn
+
+import (
+	"runtime"
+	"sync"
+)
+
+// A Context runs the parallel parts of Layers on a
+// persistent pool of worker Goroutines.
+//
+// Every Layer uses the default Context, which can be
+// changed with SetDefaultContext to bound the number of
+// CPUs used by this package.
+type Context struct {
+	numWorkers int
+	tasks      chan func()
+	closeOnce  sync.Once
+}
+
+// NewContext creates a Context which runs at most
+// numWorkers pieces of work in parallel.
+//
+// If numWorkers is 0 or negative, runtime.GOMAXPROCS(0)
+// is used.
+func NewContext(numWorkers int) *Context {
+	if numWorkers <= 0 {
+		numWorkers = runtime.GOMAXPROCS(0)
+	}
+	c := &Context{
+		numWorkers: numWorkers,
+		tasks:      make(chan func()),
+	}
+	// The calling Goroutine also does work, so only
+	// numWorkers-1 background workers are needed.
+	for i := 1; i < numWorkers; i++ {
+		go c.worker()
+	}
+	return c
+}
+
+// NumWorkers gets the maximum number of pieces of work
+// that the Context runs in parallel.
+func (c *Context) NumWorkers() int {
+	return c.numWorkers
+}
+
+// Close stops the background workers.
+//
+// The Context should not be used after it is closed.
+func (c *Context) Close() {
+	c.closeOnce.Do(func() {
+		close(c.tasks)
+	})
+}
+
+// Run calls f(i) for every i in [0, n), potentially in
+// parallel, and waits for all the calls to finish.
+//
+// If every worker is busy, for example because Run is
+// called from multiple Goroutines, some calls are made on
+// the calling Goroutine instead.
+func (c *Context) Run(n int, f func(i int)) {
+	if n <= 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		idx := i
+		task := func() {
+			defer wg.Done()
+			f(idx)
+		}
+		select {
+		case c.tasks <- task:
+		default:
+			task()
+		}
+	}
+	f(0)
+	wg.Wait()
+}
+
+func (c *Context) worker() {
+	for task := range c.tasks {
+		task()
+	}
+}
+
+var defaultContextLock sync.Mutex
+var defaultContext *Context
+
+// DefaultContext gets the Context used by all Layers.
+//
+// Unless SetDefaultContext has been called, this is a
+// Context with runtime.GOMAXPROCS(0) workers, created
+// the first time it is needed.
+func DefaultContext() *Context {
+	defaultContextLock.Lock()
+	defer defaultContextLock.Unlock()
+	if defaultContext == nil {
+		defaultContext = NewContext(0)
+	}
+	return defaultContext
+}
+
+// SetDefaultContext changes the Context used by all
+// Layers.
+//
+// The previous default Context is not closed, since it
+// may still be in use by running Layers.
+func SetDefaultContext(c *Context) {
+	defaultContextLock.Lock()
+	defer defaultContextLock.Unlock()
+	defaultContext = c
+}
@@ -0,0 +1,32 @@
+package nn
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestContextRun(t *testing.T) {
+	ctx := NewContext(3)
+	defer ctx.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, n := range []int{0, 1, 2, 10} {
+				counts := make([]int32, n)
+				ctx.Run(n, func(i int) {
+					atomic.AddInt32(&counts[i], 1)
+				})
+				for i, c := range counts {
+					if c != 1 {
+						t.Errorf("index %d of %d called %d times", i, n, c)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
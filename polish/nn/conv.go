@@ -1,68 +1,256 @@
 package nn
 
 import (
-	"runtime"
+	"errors"
+	"fmt"
+	"image"
 	"sync"
+
+	"github.com/unixpickle/essentials"
 )
 
 // Conv is a 2D convolution operator.
 //
 // It contains weights of the shape:
 //
-//     [out_depth x in_depth x kernel_size x kernel_size]
+//     [out_depth x (in_depth/groups) x kernel_size x kernel_size]
+//
+// like a PyTorch Conv2d. With one group, this is a dense
+// convolution, while with one input and output channel
+// per group, it is equivalent to a SpatialConv.
 //
+// The weights are rearranged into a more efficient layout
+// on the first call to Apply, so they should not be
+// modified after the Conv has been used.
 type Conv struct {
 	OutDepth   int
 	InDepth    int
 	KernelSize int
 	Stride     int
 	Weights    []float32
+
+	// Groups, if greater than 1, splits the input and
+	// output channels into groups, where each group of
+	// output channels only depends on the corresponding
+	// group of input channels.
+	//
+	// It must divide both InDepth and OutDepth.
+	// Zero is treated like 1.
+	Groups int
+
+	// Dilation, if greater than 1, is the spacing between
+	// the input pixels that the kernel is applied to.
+	// Zero is treated like 1.
+	Dilation int
+
+	// Padding is implicit zero padding which is applied to
+	// the input before the convolution. Its Mode must be
+	// PadZero.
+	Padding Pad
+
+	// Bias, if non-nil, is added to every output channel.
+	Bias []float32
+
+	// ReLU, if true, applies the rectified linear unit to
+	// the output after adding the bias.
+	ReLU bool
+
+	matrixOnce sync.Once
+	matrix     []float32
+	transposed bool
+
+	winogradOnce sync.Once
+	winograd     [16][]float32
 }
 
 // Apply applies the convolution to a Tensor.
 //
 // The resulting Tensor's size is determined by
-// ConvOutputSize().
+// ConvOutputSize(), using the size of the input after
+// implicit padding and the dilated size of the kernel.
+//
+// The convolution is computed as a matrix product between
+// the image patches for each output row and the weights
+// of each group, or using the Winograd algorithm for
+// dense 3x3 kernels with a stride of 1 and enough output
+// channels.
 func (c *Conv) Apply(t *Tensor) *Tensor {
-	if t.Depth != c.InDepth {
-		panic("input Tensor does not have the correct number of channels")
+	if err := c.Check(t); err != nil {
+		panic(err)
 	}
-	outH, outW := ConvOutputSize(t.Height, t.Width, c.KernelSize, c.Stride)
+	outH, outW := c.outputSize(t)
 	out := NewTensor(outH, outW, c.OutDepth)
+	c.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the convolution and writes the result
+// to out.
+func (c *Conv) ApplyTo(t, out *Tensor) {
+	if err := c.Check(t); err != nil {
+		panic(err)
+	}
+	if c.useWinograd() {
+		c.applyWinograd(t, out)
+	} else {
+		c.applyDirect(t, out)
+	}
+}
+
+func (c *Conv) applyDirect(t, out *Tensor) {
+	outH, outW := out.Height, out.Width
+	for i := range out.Data {
+		out.Data[i] = 0
+	}
+
+	groups := c.groups()
+	groupIn, groupOut := c.InDepth/groups, c.OutDepth/groups
+	c.matrixOnce.Do(func() {
+		c.transposed = groupOut < gemmMinColumns
+		c.matrix = c.weightMatrix(c.transposed)
+	})
+	patchSize := c.KernelSize * c.KernelSize * groupIn
+	outRowSize := outW * c.OutDepth
+	multiply := gemm
+	if c.transposed {
+		multiply = gemmTransposed
+	}
 
-	features := c.transposedFeatures()
-	Patches(t, c.KernelSize, c.Stride, func(outIdx int, patch *Tensor) {
-		for i, feature := range features {
-			var dot float32
-			for i, x := range patch.Data {
-				dot += x * feature.Data[i]
+	if c.KernelSize == 1 && c.Stride == 1 && c.Padding == (Pad{}) && groups == 1 &&
+		t.packedPixels() {
+		// Each input row is already a patch matrix.
+		interleaveRows(outH, func(start, stride int) {
+			for y := start; y < outH; y += stride {
+				outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+				multiply(outW, c.OutDepth, patchSize, t.row(y), c.matrix, outRow)
+				convEpilogue(outRow, c.Bias, c.ReLU)
 			}
-			out.Data[outIdx*len(features)+i] = dot
+		})
+		return
+	}
+
+	inputs := []*Tensor{t}
+	if groups > 1 {
+		inputs = make([]*Tensor, groups)
+		for g := range inputs {
+			inputs[g] = t.Channels(g*groupIn, (g+1)*groupIn)
+		}
+	}
+	interleaveRows(outH, func(start, stride int) {
+		patches := make([]float32, outW*patchSize)
+		var products []float32
+		if groups > 1 {
+			products = make([]float32, outW*groupOut)
+		}
+		for y := start; y < outH; y += stride {
+			outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+			for g, in := range inputs {
+				im2colRow(in, patches, c.KernelSize, c.Stride, c.dilation(), &c.Padding, y, outW)
+				matrix := c.matrix[g*patchSize*groupOut : (g+1)*patchSize*groupOut]
+				if groups == 1 {
+					multiply(outW, c.OutDepth, patchSize, patches, matrix, outRow)
+					continue
+				}
+				for i := range products {
+					products[i] = 0
+				}
+				multiply(outW, groupOut, patchSize, patches, matrix, products)
+				for x := 0; x < outW; x++ {
+					outIdx := x*c.OutDepth + g*groupOut
+					copy(outRow[outIdx:outIdx+groupOut], products[x*groupOut:(x+1)*groupOut])
+				}
+			}
+			convEpilogue(outRow, c.Bias, c.ReLU)
 		}
 	})
+}
 
-	return out
+// Check verifies that the Tensor has the correct number
+// of channels and is at least as large as the kernel.
+func (c *Conv) Check(t *Tensor) error {
+	_, err := c.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape of the convolution's
+// output.
+func (c *Conv) OutputShape(in Shape) (Shape, error) {
+	if err := checkDepth(in, c.InDepth); err != nil {
+		return Shape{}, err
+	}
+	if c.Bias != nil && len(c.Bias) != c.OutDepth {
+		return Shape{}, fmt.Errorf("bias has %d values but expected %d", len(c.Bias),
+			c.OutDepth)
+	}
+	if c.Groups < 0 || c.InDepth%c.groups() != 0 || c.OutDepth%c.groups() != 0 {
+		return Shape{}, fmt.Errorf("number of groups (%d) must divide input and output "+
+			"channels (%d and %d)", c.Groups, c.InDepth, c.OutDepth)
+	}
+	if err := checkKernelStride(c.KernelSize, c.Stride); err != nil {
+		return Shape{}, err
+	}
+	if c.Dilation < 0 {
+		return Shape{}, errors.New("dilation must be non-negative")
+	}
+	return convOutputShape(in, &c.Padding, c.kernelExtent(), c.Stride, c.OutDepth)
+}
+
+// InputRegion computes the input pixels that the output
+// region depends on.
+func (c *Conv) InputRegion(out image.Rectangle) image.Rectangle {
+	return convInputRegion(out, c.kernelExtent(), c.Stride).Sub(
+		image.Pt(c.Padding.Left, c.Padding.Top))
 }
 
-func (c *Conv) transposedFeatures() []*Tensor {
-	featureStride := c.KernelSize * c.KernelSize * c.InDepth
-	var featureIdx int
-	var result []*Tensor
+func (c *Conv) outputSize(t *Tensor) (int, int) {
+	return ConvOutputSize(t.Height+c.Padding.Top+c.Padding.Bottom,
+		t.Width+c.Padding.Left+c.Padding.Right, c.kernelExtent(), c.Stride)
+}
+
+func (c *Conv) groups() int {
+	return essentials.MaxInt(c.Groups, 1)
+}
+
+func (c *Conv) dilation() int {
+	return essentials.MaxInt(c.Dilation, 1)
+}
+
+// kernelExtent gets the size of the kernel after
+// dilation.
+func (c *Conv) kernelExtent() int {
+	return c.dilation()*(c.KernelSize-1) + 1
+}
+
+// weightMatrix arranges the weights for each group as a
+// matrix of shape [patch_size x group_out_depth], where
+// the rows are ordered like the values of an image patch
+// (y, x, channel). The matrices are concatenated.
+//
+// If transposed is true, each matrix is stored in the
+// transposed shape [group_out_depth x patch_size].
+func (c *Conv) weightMatrix(transposed bool) []float32 {
+	groupOut := c.OutDepth / c.groups()
+	groupIn := c.InDepth / c.groups()
+	featureStride := c.KernelSize * c.KernelSize * groupIn
+	result := make([]float32, featureStride*c.OutDepth)
 	for i := 0; i < c.OutDepth; i++ {
-		feature := c.Weights[featureIdx : featureIdx+featureStride]
-		featureIdx += featureStride
-
-		tensor := NewTensor(c.KernelSize, c.KernelSize, c.InDepth)
-		var idx int
-		for y := 0; y < tensor.Height; y++ {
-			for x := 0; x < tensor.Width; x++ {
-				for z := 0; z < tensor.Depth; z++ {
-					tensor.Data[idx] = feature[(y+z*c.KernelSize)*c.KernelSize+x]
-					idx++
+		feature := c.Weights[i*featureStride : (i+1)*featureStride]
+		matrix := result[(i/groupOut)*featureStride*groupOut:]
+		col := i % groupOut
+		var row int
+		for y := 0; y < c.KernelSize; y++ {
+			for x := 0; x < c.KernelSize; x++ {
+				for z := 0; z < groupIn; z++ {
+					value := feature[(y+z*c.KernelSize)*c.KernelSize+x]
+					if transposed {
+						matrix[col*featureStride+row] = value
+					} else {
+						matrix[row*groupOut+col] = value
+					}
+					row++
 				}
 			}
 		}
-		result = append(result, tensor)
 	}
 	return result
 }
@@ -75,57 +263,193 @@ func (c *Conv) transposedFeatures() []*Tensor {
 //
 //     [depth x kernel_size x kernel_size]
 //
+// Like Conv, it supports dilation, implicit padding, and
+// a fused bias and ReLU.
 type SpatialConv struct {
 	Depth      int
 	KernelSize int
 	Stride     int
 	Weights    []float32
+
+	// Dilation, if greater than 1, is the spacing between
+	// the input pixels that the kernel is applied to.
+	// Zero is treated like 1.
+	Dilation int
+
+	Padding Pad
+	Bias    []float32
+	ReLU    bool
+
+	tapsOnce sync.Once
+	taps     []float32
+
+	winogradOnce sync.Once
+	winograd     []float32
 }
 
 // Apply applies the convolution to a Tensor.
 //
 // The resulting Tensor's size is determined by
-// ConvOutputSize().
+// ConvOutputSize(), using the size of the input after
+// implicit padding and the dilated size of the kernel.
 func (s *SpatialConv) Apply(t *Tensor) *Tensor {
-	if t.Depth != s.Depth {
-		panic("input Tensor does not have the correct number of channels")
+	if err := s.Check(t); err != nil {
+		panic(err)
 	}
-	outH, outW := ConvOutputSize(t.Height, t.Width, s.KernelSize, s.Stride)
+	outH, outW := s.outputSize(t)
 	out := NewTensor(outH, outW, s.Depth)
+	s.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the convolution and writes the result
+// to out.
+func (s *SpatialConv) ApplyTo(t, out *Tensor) {
+	if err := s.Check(t); err != nil {
+		panic(err)
+	}
+	if s.useWinograd() {
+		s.applyWinograd(t, out)
+		return
+	}
+	s.applyDirect(t, out)
+}
+
+func (s *SpatialConv) applyDirect(t, out *Tensor) {
+	outH, outW := out.Height, out.Width
+	for i := range out.Data {
+		out.Data[i] = 0
+	}
 
-	features := s.features()
-	Patches(t, s.KernelSize, s.Stride, func(outIdx int, patch *Tensor) {
-		for i, feature := range features {
-			patchIdx := i
-			var dot float32
-			for _, x := range feature.Data {
-				dot += x * patch.Data[patchIdx]
-				patchIdx += s.Depth
+	s.tapsOnce.Do(func() {
+		s.taps = s.weightTaps()
+	})
+	dilation := s.dilation()
+	outRowSize := outW * s.Depth
+	interleaveRows(outH, func(start, stride int) {
+		for y := start; y < outH; y += stride {
+			for x := 0; x < outW; x++ {
+				outIdx := (x + y*outW) * s.Depth
+				outPixel := out.Data[outIdx : outIdx+s.Depth]
+				for subY := 0; subY < s.KernelSize; subY++ {
+					inY := y*s.Stride + subY*dilation - s.Padding.Top
+					if inY < 0 || inY >= t.Height {
+						continue
+					}
+					for subX := 0; subX < s.KernelSize; subX++ {
+						inX := x*s.Stride + subX*dilation - s.Padding.Left
+						if inX < 0 || inX >= t.Width {
+							continue
+						}
+						tapIdx := (subX + subY*s.KernelSize) * s.Depth
+						mulAddVec(s.taps[tapIdx:tapIdx+s.Depth], t.Pixel(inY, inX), outPixel)
+					}
+				}
 			}
-			out.Data[outIdx*len(features)+i] = dot
+			convEpilogue(out.Data[y*outRowSize:(y+1)*outRowSize], s.Bias, s.ReLU)
 		}
 	})
+}
 
-	return out
+// Check verifies that the Tensor has the correct number
+// of channels and is at least as large as the kernel.
+func (s *SpatialConv) Check(t *Tensor) error {
+	_, err := s.OutputShape(t.Shape())
+	return err
 }
 
-func (s *SpatialConv) features() []*Tensor {
-	featureStride := s.KernelSize * s.KernelSize
-	var featureIdx int
-	var result []*Tensor
-	for i := 0; i < s.Depth; i++ {
-		feature := s.Weights[featureIdx : featureIdx+featureStride]
-		featureIdx += featureStride
-		result = append(result, &Tensor{
-			Height: s.KernelSize,
-			Width:  s.KernelSize,
-			Depth:  1,
-			Data:   feature,
-		})
+// OutputShape computes the shape of the convolution's
+// output.
+func (s *SpatialConv) OutputShape(in Shape) (Shape, error) {
+	if err := checkDepth(in, s.Depth); err != nil {
+		return Shape{}, err
+	}
+	if s.Bias != nil && len(s.Bias) != s.Depth {
+		return Shape{}, fmt.Errorf("bias has %d values but expected %d", len(s.Bias),
+			s.Depth)
+	}
+	if err := checkKernelStride(s.KernelSize, s.Stride); err != nil {
+		return Shape{}, err
+	}
+	if s.Dilation < 0 {
+		return Shape{}, errors.New("dilation must be non-negative")
+	}
+	return convOutputShape(in, &s.Padding, s.kernelExtent(), s.Stride, s.Depth)
+}
+
+// InputRegion computes the input pixels that the output
+// region depends on.
+func (s *SpatialConv) InputRegion(out image.Rectangle) image.Rectangle {
+	return convInputRegion(out, s.kernelExtent(), s.Stride).Sub(
+		image.Pt(s.Padding.Left, s.Padding.Top))
+}
+
+func (s *SpatialConv) outputSize(t *Tensor) (int, int) {
+	return ConvOutputSize(t.Height+s.Padding.Top+s.Padding.Bottom,
+		t.Width+s.Padding.Left+s.Padding.Right, s.kernelExtent(), s.Stride)
+}
+
+func (s *SpatialConv) dilation() int {
+	return essentials.MaxInt(s.Dilation, 1)
+}
+
+// kernelExtent gets the size of the kernel after
+// dilation.
+func (s *SpatialConv) kernelExtent() int {
+	return s.dilation()*(s.KernelSize-1) + 1
+}
+
+// weightTaps arranges the weights in the shape
+// [kernel_size x kernel_size x depth], so that the weights
+// for each kernel position are contiguous.
+func (s *SpatialConv) weightTaps() []float32 {
+	numTaps := s.KernelSize * s.KernelSize
+	result := make([]float32, numTaps*s.Depth)
+	for z := 0; z < s.Depth; z++ {
+		for i := 0; i < numTaps; i++ {
+			result[i*s.Depth+z] = s.Weights[z*numTaps+i]
+		}
 	}
 	return result
 }
 
+func convOutputShape(in Shape, padding *Pad, kernelSize, stride, outDepth int) (Shape, error) {
+	if padding.Top < 0 || padding.Right < 0 || padding.Bottom < 0 || padding.Left < 0 {
+		return Shape{}, errors.New("padding must be non-negative")
+	}
+	if padding.Mode != PadZero {
+		return Shape{}, errors.New("implicit padding must use PadZero")
+	}
+	padded := Shape{
+		Height: in.Height + padding.Top + padding.Bottom,
+		Width:  in.Width + padding.Left + padding.Right,
+		Depth:  in.Depth,
+	}
+	if err := checkKernel(padded, kernelSize); err != nil {
+		return Shape{}, err
+	}
+	h, w := ConvOutputSize(padded.Height, padded.Width, kernelSize, stride)
+	return Shape{Height: h, Width: w, Depth: outDepth}, nil
+}
+
+// convEpilogue adds a bias to every pixel of a block of
+// output data and optionally applies a ReLU.
+func convEpilogue(data, bias []float32, relu bool) {
+	if bias != nil {
+		for i := 0; i < len(data); i += len(bias) {
+			pixel := data[i : i+len(bias)]
+			addVec(pixel, bias, pixel)
+		}
+	}
+	if relu {
+		for i, x := range data {
+			if x < 0 {
+				data[i] = 0
+			}
+		}
+	}
+}
+
 // Patches extracts image patches for a convolution of the
 // given kernel size and stride, and calls f with each
 // patch.
@@ -137,39 +461,72 @@ func (s *SpatialConv) features() []*Tensor {
 // to right, top to bottom, so that patches are indexed
 // like the pixels of an output image.
 func Patches(t *Tensor, kernelSize, stride int, f func(int, *Tensor)) {
-	numGos := runtime.GOMAXPROCS(0)
-
-	_, outCols := ConvOutputSize(t.Height, t.Width, kernelSize, stride)
-
-	var wg sync.WaitGroup
-	for i := 0; i < numGos; i++ {
-		wg.Add(1)
-		go func(goIdx int) {
-			defer wg.Done()
-			patch := NewTensor(kernelSize, kernelSize, t.Depth)
-			idx := goIdx * outCols
-			for y := goIdx * stride; y+kernelSize <= t.Height; y += stride * numGos {
-				for x := 0; x+kernelSize <= t.Width; x += stride {
-					copyPatch(patch, t, x, y)
-					f(idx, patch)
-					idx++
-				}
-				idx += (numGos - 1) * outCols
+	outRows, outCols := ConvOutputSize(t.Height, t.Width, kernelSize, stride)
+	interleaveRows(outRows, func(start, rowStride int) {
+		patch := NewTensor(kernelSize, kernelSize, t.Depth)
+		for row := start; row < outRows; row += rowStride {
+			for col := 0; col < outCols; col++ {
+				x, y := col*stride, row*stride
+				patch.CopyFrom(t.View(image.Rect(x, y, x+kernelSize, y+kernelSize)))
+				f(row*outCols+col, patch)
 			}
-		}(i)
-	}
-	wg.Wait()
+		}
+	})
 }
 
-func copyPatch(dst, src *Tensor, x, y int) {
-	dstOffset := 0
-	dstStride := dst.Depth * dst.Width
-	srcOffset := (x + y*src.Width) * src.Depth
-	srcStride := src.Width * src.Depth
-	for subY := 0; subY < dst.Height; subY++ {
-		copy(dst.Data[dstOffset:dstOffset+dstStride], src.Data[srcOffset:])
-		dstOffset += dstStride
-		srcOffset += srcStride
+// interleaveRows calls f from the workers of the default
+// Context, each of which should handle the rows start,
+// start+stride, start+2*stride, etc.
+func interleaveRows(numRows int, f func(start, stride int)) {
+	ctx := DefaultContext()
+	numWorkers := essentials.MinInt(ctx.NumWorkers(), numRows)
+	ctx.Run(numWorkers, func(i int) {
+		f(i, numWorkers)
+	})
+}
+
+// im2colRow writes the patches for row y of a
+// convolution's output into a matrix of shape
+// [outW x (kernelSize*kernelSize*depth)].
+//
+// The kernel is spread out by the dilation, and patches
+// which overlap the implicit padding are filled in with
+// zeros.
+func im2colRow(t *Tensor, patches []float32, kernelSize, stride, dilation int, padding *Pad,
+	y, outW int) {
+	chunkSize := kernelSize * t.Depth
+	extent := dilation*(kernelSize-1) + 1
+	rowStride, pixelStride := t.rowStride(), t.pixelStride()
+	var dstIdx int
+	for x := 0; x < outW; x++ {
+		inX := x*stride - padding.Left
+		for subY := 0; subY < kernelSize; subY++ {
+			dst := patches[dstIdx : dstIdx+chunkSize]
+			dstIdx += chunkSize
+			inY := y*stride + subY*dilation - padding.Top
+			if inY < 0 || inY >= t.Height {
+				for i := range dst {
+					dst[i] = 0
+				}
+				continue
+			}
+			srcIdx := inY*rowStride + inX*pixelStride
+			if inX >= 0 && inX+extent <= t.Width && pixelStride == t.Depth && dilation == 1 {
+				copy(dst, t.Data[srcIdx:srcIdx+chunkSize])
+				continue
+			}
+			for subX := 0; subX < kernelSize; subX++ {
+				pixel := dst[subX*t.Depth : (subX+1)*t.Depth]
+				if px := inX + subX*dilation; px < 0 || px >= t.Width {
+					for i := range pixel {
+						pixel[i] = 0
+					}
+				} else {
+					idx := srcIdx + subX*dilation*pixelStride
+					copy(pixel, t.Data[idx:idx+t.Depth])
+				}
+			}
+		}
 	}
 }
 
@@ -1,7 +1,10 @@
 package nn
 
 import (
+	"fmt"
+	"image"
 	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -159,3 +162,129 @@ func TestSpatialConvLarge(t *testing.T) {
 		}
 	}
 }
+
+func TestConvReference(t *testing.T) {
+	for _, c := range []*Conv{
+		{InDepth: 3, OutDepth: 9, KernelSize: 5, Stride: 2},
+		{InDepth: 10, OutDepth: 17, KernelSize: 1, Stride: 1},
+		{InDepth: 6, OutDepth: 3, KernelSize: 3, Stride: 1},
+		{InDepth: 4, OutDepth: 5, KernelSize: 2, Stride: 3},
+		{InDepth: 6, OutDepth: 4, KernelSize: 3, Stride: 1, Groups: 2},
+		{InDepth: 8, OutDepth: 8, KernelSize: 3, Stride: 2, Groups: 8},
+		{InDepth: 4, OutDepth: 40, KernelSize: 1, Stride: 1, Groups: 4},
+		{InDepth: 5, OutDepth: 7, KernelSize: 3, Stride: 1, Dilation: 2},
+		{InDepth: 6, OutDepth: 6, KernelSize: 2, Stride: 2, Groups: 3, Dilation: 3},
+	} {
+		c.Weights = make([]float32, c.OutDepth*c.InDepth/c.groups()*c.KernelSize*c.KernelSize)
+		for i := range c.Weights {
+			c.Weights[i] = float32(rand.NormFloat64())
+		}
+		in := NewTensor(13, 11, c.InDepth)
+		for i := range in.Data {
+			// Include zeros, like the output of a ReLU.
+			in.Data[i] = float32(math.Max(0, rand.NormFloat64()))
+		}
+		expected := referenceConv(c, in)
+		actual := c.Apply(in)
+		if actual.Shape() != expected.Shape() {
+			t.Fatal("incorrect output shape")
+		}
+		for i, x := range expected.Data {
+			a := actual.Data[i]
+			if math.Abs(float64(x-a)) > 1e-4 {
+				t.Errorf("kernel %d depth %d->%d groups %d dilation %d: bad value at %d: "+
+					"expected %f but got %f", c.KernelSize, c.InDepth, c.OutDepth, c.groups(),
+					c.dilation(), i, x, a)
+				break
+			}
+		}
+	}
+}
+
+func TestSpatialConvReference(t *testing.T) {
+	for _, s := range []*SpatialConv{
+		{Depth: 4, KernelSize: 3, Stride: 1},
+		{Depth: 5, KernelSize: 3, Stride: 1, Dilation: 2, Padding: *NewPad(2, 2, 2, 2)},
+		{Depth: 3, KernelSize: 2, Stride: 2, Dilation: 3},
+		{Depth: 6, KernelSize: 5, Stride: 2, Dilation: 2, Padding: *NewPad(1, 3, 2, 0)},
+	} {
+		s.Weights = make([]float32, s.Depth*s.KernelSize*s.KernelSize)
+		for i := range s.Weights {
+			s.Weights[i] = float32(rand.NormFloat64())
+		}
+		in := NewTensor(13, 11, s.Depth)
+		for i := range in.Data {
+			in.Data[i] = float32(rand.NormFloat64())
+		}
+
+		// A SpatialConv is a Conv with one group per channel.
+		c := &Conv{InDepth: s.Depth, OutDepth: s.Depth, KernelSize: s.KernelSize,
+			Stride: s.Stride, Groups: s.Depth, Dilation: s.Dilation, Weights: s.Weights}
+		expected := referenceConv(c, s.Padding.Apply(in))
+		actual := s.Apply(in)
+		if actual.Shape() != expected.Shape() {
+			t.Fatalf("expected shape %v but got %v", expected.Shape(), actual.Shape())
+		}
+		checkTensorsClose(t, expected, actual, 1e-4)
+
+		c.Padding = s.Padding
+		if region, expected := s.InputRegion(image.Rect(1, 2, 3, 4)),
+			c.InputRegion(image.Rect(1, 2, 3, 4)); region != expected {
+			t.Errorf("expected input region %v but got %v", expected, region)
+		}
+		if optimized, ok := Optimize(c).(*SpatialConv); !ok || optimized.Dilation != s.Dilation {
+			t.Errorf("depthwise Conv was not converted to an equivalent SpatialConv")
+		}
+	}
+}
+
+func referenceConv(c *Conv, in *Tensor) *Tensor {
+	outH, outW := ConvOutputSize(in.Height, in.Width, c.kernelExtent(), c.Stride)
+	out := NewTensor(outH, outW, c.OutDepth)
+	groupIn := c.InDepth / c.groups()
+	groupOut := c.OutDepth / c.groups()
+	d := c.dilation()
+	for y := 0; y < outH; y++ {
+		for x := 0; x < outW; x++ {
+			for o := 0; o < c.OutDepth; o++ {
+				var sum float64
+				for z := 0; z < groupIn; z++ {
+					inZ := (o/groupOut)*groupIn + z
+					for ky := 0; ky < c.KernelSize; ky++ {
+						for kx := 0; kx < c.KernelSize; kx++ {
+							w := c.Weights[((o*groupIn+z)*c.KernelSize+ky)*c.KernelSize+kx]
+							v := *in.At(y*c.Stride+ky*d, x*c.Stride+kx*d, inZ)
+							sum += float64(w * v)
+						}
+					}
+				}
+				*out.At(y, x, o) = float32(sum)
+			}
+		}
+	}
+	return out
+}
+
+func BenchmarkConv(b *testing.B) {
+	sizes := []int{256, 64, 128}
+	for i, c := range []*Conv{
+		{InDepth: 3, OutDepth: 64, KernelSize: 5, Stride: 2},
+		{InDepth: 128, OutDepth: 256, KernelSize: 1, Stride: 1},
+		{InDepth: 32, OutDepth: 3, KernelSize: 3, Stride: 1},
+	} {
+		c.Weights = make([]float32, c.OutDepth*c.InDepth*c.KernelSize*c.KernelSize)
+		for i := range c.Weights {
+			c.Weights[i] = float32(rand.NormFloat64())
+		}
+		in := NewTensor(sizes[i], sizes[i], c.InDepth)
+		for i := range in.Data {
+			in.Data[i] = float32(rand.NormFloat64())
+		}
+		name := fmt.Sprintf("%dx%d_%d_%d", c.KernelSize, c.KernelSize, c.InDepth, c.OutDepth)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.Apply(in)
+			}
+		})
+	}
+}
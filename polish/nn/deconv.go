@@ -1,7 +1,7 @@
 package nn
 
 import (
-	"runtime"
+	"image"
 	"sync"
 )
 
@@ -11,12 +11,17 @@ import (
 //
 //     [in_depth x out_depth x kernel_size x kernel_size]
 //
+// Like Conv, the weights are rearranged on the first call
+// to Apply and should not be modified afterwards.
 type Deconv struct {
 	OutDepth   int
 	InDepth    int
 	KernelSize int
 	Stride     int
 	Weights    []float32
+
+	tapsOnce sync.Once
+	taps     [][]float32
 }
 
 // Apply applies the transposed convolution to a Tensor.
@@ -24,100 +29,115 @@ type Deconv struct {
 // The resulting Tensor's size is determined by
 // DeconvOutputSize().
 func (d *Deconv) Apply(t *Tensor) *Tensor {
-	if t.Depth != d.InDepth {
-		panic("input Tensor does not have the correct number of channels")
+	if err := d.Check(t); err != nil {
+		panic(err)
 	}
 	outH, outW := DeconvOutputSize(t.Height, t.Width, d.KernelSize, d.Stride)
-	features := d.transposedFeatures()
-
 	out := NewTensor(outH, outW, d.OutDepth)
-	lock := sync.Mutex{}
+	d.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the transposed convolution and writes
+// the result to out.
+//
+// Each output row is computed by a single worker, which
+// gathers the contributions of the input rows in a fixed
+// order. Thus, the result does not depend on the number
+// of workers.
+func (d *Deconv) ApplyTo(t, out *Tensor) {
+	if err := d.Check(t); err != nil {
+		panic(err)
+	}
+	d.tapsOnce.Do(func() {
+		d.taps = d.weightTaps()
+	})
 
-	d.iteratePatches(t, func(tmp *Tensor, x, y int, data []float32) {
-		for i, scale := range data {
-			feature := features[i]
-			if i == 0 {
-				for j, x := range feature.Data {
-					tmp.Data[j] = x * scale
+	if !t.packedPixels() {
+		t = copyTensor(t)
+	}
+	outRowSize := out.Width * out.Depth
+	tapRowSize := d.KernelSize * d.OutDepth
+	interleaveRows(out.Height, func(start, stride int) {
+		products := make([]float32, t.Width*tapRowSize)
+		for y := start; y < out.Height; y += stride {
+			outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+			for i := range outRow {
+				outRow[i] = 0
+			}
+			// Input row inY contributes to this row through
+			// kernel row y-inY*d.Stride.
+			for kernelY := y % d.Stride; kernelY < d.KernelSize; kernelY += d.Stride {
+				inY := (y - kernelY) / d.Stride
+				if inY < 0 {
+					break
+				} else if inY >= t.Height {
+					continue
+				}
+				for i := range products {
+					products[i] = 0
 				}
-			} else {
-				for j, x := range feature.Data {
-					tmp.Data[j] += x * scale
+				gemm(t.Width, tapRowSize, d.InDepth, t.row(inY), d.taps[kernelY], products)
+				for inX := 0; inX < t.Width; inX++ {
+					pixelProducts := products[inX*tapRowSize : (inX+1)*tapRowSize]
+					outIdx := inX * d.Stride * d.OutDepth
+					dst := outRow[outIdx : outIdx+tapRowSize]
+					addVec(dst, pixelProducts, dst)
 				}
 			}
 		}
-		outX := x * d.Stride
-		outY := y * d.Stride
-
-		// Adding to the global image must be synchronized,
-		// but it takes up so little of the computation time
-		// that it doesn't seem to matter.
-		lock.Lock()
-		addPatch(out, tmp, outX, outY)
-		lock.Unlock()
 	})
-
-	return out
 }
 
-func (d *Deconv) transposedFeatures() []*Tensor {
-	featureStride := d.KernelSize * d.KernelSize * d.OutDepth
-	var featureIdx int
-	var result []*Tensor
-	for i := 0; i < d.InDepth; i++ {
-		feature := d.Weights[featureIdx : featureIdx+featureStride]
-		featureIdx += featureStride
+// Check verifies that the Tensor has the correct number
+// of channels.
+func (d *Deconv) Check(t *Tensor) error {
+	_, err := d.OutputShape(t.Shape())
+	return err
+}
 
-		tensor := NewTensor(d.KernelSize, d.KernelSize, d.OutDepth)
-		var idx int
-		for y := 0; y < tensor.Height; y++ {
-			for x := 0; x < tensor.Width; x++ {
-				for z := 0; z < tensor.Depth; z++ {
-					tensor.Data[idx] = feature[(y+z*d.KernelSize)*d.KernelSize+x]
-					idx++
-				}
-			}
-		}
-		result = append(result, tensor)
+// OutputShape computes the shape of the transposed
+// convolution's output.
+func (d *Deconv) OutputShape(in Shape) (Shape, error) {
+	if err := checkDepth(in, d.InDepth); err != nil {
+		return Shape{}, err
 	}
-	return result
+	if err := checkKernelStride(d.KernelSize, d.Stride); err != nil {
+		return Shape{}, err
+	}
+	h, w := DeconvOutputSize(in.Height, in.Width, d.KernelSize, d.Stride)
+	return Shape{Height: h, Width: w, Depth: d.OutDepth}, nil
 }
 
-func (d *Deconv) iteratePatches(t *Tensor, f func(tmp *Tensor, x, y int, data []float32)) {
-	numGos := runtime.GOMAXPROCS(0)
-	var wg sync.WaitGroup
-	for i := 0; i < numGos; i++ {
-		wg.Add(1)
-		go func(goIdx int) {
-			defer wg.Done()
-			tmp := NewTensor(d.KernelSize, d.KernelSize, d.OutDepth)
-			idx := goIdx * t.Width * t.Depth
-			for y := goIdx; y < t.Height; y += numGos {
-				for x := 0; x < t.Width; x++ {
-					f(tmp, x, y, t.Data[idx:idx+t.Depth])
-					idx += t.Depth
-				}
-				idx += (numGos - 1) * t.Width * t.Depth
-			}
-		}(i)
-	}
-	wg.Wait()
+// InputRegion computes the input pixels that the output
+// region depends on.
+func (d *Deconv) InputRegion(out image.Rectangle) image.Rectangle {
+	return deconvInputRegion(out, d.KernelSize, d.Stride)
 }
 
-func addPatch(dst, src *Tensor, outX, outY int) {
-	var srcIdx int
-	dstIdx := (outX + outY*dst.Width) * dst.Depth
-	dstStride := dst.Width*dst.Depth - src.Width*src.Depth
-	for y := 0; y < src.Height; y++ {
-		for x := 0; x < src.Width; x++ {
-			for z := 0; z < src.Depth; z++ {
-				dst.Data[dstIdx] += src.Data[srcIdx]
-				dstIdx++
-				srcIdx++
+// weightTaps arranges the weights as one matrix for each
+// kernel row, where the matrix has shape
+//
+//     [in_depth x (kernel_size * out_depth)]
+//
+// so that multiplying a pixel by the matrix gives its
+// contribution to kernel_size consecutive output pixels.
+func (d *Deconv) weightTaps() [][]float32 {
+	k := d.KernelSize
+	result := make([][]float32, k)
+	for kernelY := range result {
+		matrix := make([]float32, 0, d.InDepth*k*d.OutDepth)
+		for i := 0; i < d.InDepth; i++ {
+			for kernelX := 0; kernelX < k; kernelX++ {
+				for o := 0; o < d.OutDepth; o++ {
+					idx := ((i*d.OutDepth+o)*k+kernelY)*k + kernelX
+					matrix = append(matrix, d.Weights[idx])
+				}
 			}
 		}
-		dstIdx += dstStride
+		result[kernelY] = matrix
 	}
+	return result
 }
 
 // DeconvOutputSize gets the output dimensions from a
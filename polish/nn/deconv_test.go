@@ -1,8 +1,8 @@
 package nn
 
 import (
+	"fmt"
 	"math"
-	"runtime"
 	"testing"
 )
 
@@ -39,12 +39,45 @@ func TestDeconvLarge(t *testing.T) {
 		}
 	}
 
-	p := runtime.GOMAXPROCS(0)
-	defer runtime.GOMAXPROCS(p)
+	defer SetDefaultContext(DefaultContext())
+	for _, numWorkers := range []int{1, 2} {
+		ctx := NewContext(numWorkers)
+		defer ctx.Close()
+		SetDefaultContext(ctx)
+		t.Run(fmt.Sprintf("Workers%d", numWorkers), runTest)
+	}
+}
 
-	runtime.GOMAXPROCS(1)
-	t.Run("Proc1", runTest)
+func TestDeconvDeterministic(t *testing.T) {
+	d := &Deconv{InDepth: 6, OutDepth: 5, KernelSize: 5, Stride: 2,
+		Weights: randomVector(6 * 5 * 25)}
+	in := NewTensor(17, 9, d.InDepth)
+	copy(in.Data, randomVector(len(in.Data)))
+
+	defer SetDefaultContext(DefaultContext())
+	var expected *Tensor
+	for _, numWorkers := range []int{1, 2, 3} {
+		ctx := NewContext(numWorkers)
+		defer ctx.Close()
+		SetDefaultContext(ctx)
+		for i := 0; i < 3; i++ {
+			actual := d.Apply(in)
+			if expected == nil {
+				expected = actual
+			} else {
+				checkTensorsClose(t, expected, actual, 0)
+			}
+		}
+	}
+}
 
-	runtime.GOMAXPROCS(2)
-	t.Run("Proc2", runTest)
+func BenchmarkDeconv(b *testing.B) {
+	d := &Deconv{InDepth: 128, OutDepth: 64, KernelSize: 4, Stride: 2,
+		Weights: randomVector(128 * 64 * 16)}
+	in := NewTensor(64, 64, d.InDepth)
+	copy(in.Data, randomVector(len(in.Data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Apply(in)
+	}
 }
@@ -0,0 +1,119 @@
+package nn
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Determinism controls whether Layers may trade
+// reproducibility across machines for speed.
+type Determinism int32
+
+const (
+	// DeterminismNone allows outputs to depend on the CPU,
+	// for example because the assembly kernels use fused
+	// multiply-adds when they are available.
+	//
+	// Outputs never depend on the number of workers.
+	DeterminismNone Determinism = iota
+
+	// DeterminismStrict makes every Layer produce
+	// bit-identical outputs for the same inputs on any
+	// machine, by using portable kernels which round every
+	// operation and sum values in a fixed order.
+	DeterminismStrict
+
+	// DeterminismFloat64 is like DeterminismStrict, but
+	// matrix products and normalization statistics are
+	// accumulated in float64 for extra precision.
+	DeterminismFloat64
+)
+
+var defaultDeterminism int32
+
+// DefaultDeterminism gets the Determinism used by all
+// Layers, which is DeterminismNone unless it was changed
+// with SetDefaultDeterminism.
+func DefaultDeterminism() Determinism {
+	return Determinism(atomic.LoadInt32(&defaultDeterminism))
+}
+
+// SetDefaultDeterminism changes the Determinism used by
+// all Layers.
+//
+// This should not be called while Layers are running.
+func SetDefaultDeterminism(d Determinism) {
+	atomic.StoreInt32(&defaultDeterminism, int32(d))
+}
+
+func deterministic() bool {
+	return DefaultDeterminism() != DeterminismNone
+}
+
+func accumulateFloat64() bool {
+	return DefaultDeterminism() == DeterminismFloat64
+}
+
+// exp computes e^x.
+//
+// In deterministic mode, this uses a portable version of
+// math.Exp, since the standard library uses FMA
+// instructions on some CPUs.
+func exp(x float64) float64 {
+	if !deterministic() {
+		return math.Exp(x)
+	}
+	return portableExp(x)
+}
+
+// portableExp is the pure-Go version of math.Exp, with
+// every product rounded explicitly so that it cannot be
+// fused with an addition.
+func portableExp(x float64) float64 {
+	const (
+		ln2Hi = 6.93147180369123816490e-01
+		ln2Lo = 1.90821492927058770002e-10
+		log2e = 1.44269504088896338700e+00
+
+		overflow  = 7.09782712893383973096e+02
+		underflow = -7.45133219101941108420e+02
+		nearZero  = 1.0 / (1 << 28)
+
+		p1 = 1.66666666666666657415e-01
+		p2 = -2.77777777770155933842e-03
+		p3 = 6.61375632143793436117e-05
+		p4 = -1.65339022054652515390e-06
+		p5 = 4.13813679705723846039e-08
+	)
+	switch {
+	case math.IsNaN(x) || math.IsInf(x, 1):
+		return x
+	case math.IsInf(x, -1):
+		return 0
+	case x > overflow:
+		return math.Inf(1)
+	case x < underflow:
+		return 0
+	case -nearZero < x && x < nearZero:
+		return 1 + x
+	}
+
+	var k int
+	if x < 0 {
+		k = int(float64(log2e*x) - 0.5)
+	} else {
+		k = int(float64(log2e*x) + 0.5)
+	}
+	hi := x - float64(float64(k)*ln2Hi)
+	lo := float64(float64(k) * ln2Lo)
+
+	r := hi - lo
+	t := float64(r * r)
+	poly := p4 + float64(t*p5)
+	poly = p3 + float64(t*poly)
+	poly = p2 + float64(t*poly)
+	poly = p1 + float64(t*poly)
+	c := r - float64(t*poly)
+	y := 1 - ((lo - float64(r*c)/(2-c)) - hi)
+	return math.Ldexp(y, k)
+}
@@ -0,0 +1,173 @@
+package nn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPortableExp(t *testing.T) {
+	for _, x := range []float64{0, 1e-10, -1e-10, 0.3, -0.7, 1, -2.5, 10, -30, 700, -740} {
+		expected := math.Exp(x)
+		actual := portableExp(x)
+		if math.Abs(actual-expected) > 1e-14*expected {
+			t.Errorf("exp(%f): expected %g but got %g", x, expected, actual)
+		}
+	}
+	if !math.IsInf(portableExp(1000), 1) || portableExp(-1000) != 0 {
+		t.Error("unexpected results for large inputs")
+	}
+}
+
+func TestDeterminism(t *testing.T) {
+	network := NN{
+		&Graph{Nodes: []GraphNode{
+			{Name: "logits", Inputs: []string{GraphInput}, Layer: &Conv{InDepth: 3, OutDepth: 9,
+				KernelSize: 1, Stride: 1, Weights: randomVector(3 * 9)}},
+			{Name: "out", Inputs: []string{GraphInput, "logits"}, Merge: &KernelPrediction{KernelSize: 3}},
+		}},
+		&Conv{InDepth: 3, OutDepth: 16, KernelSize: 3, Stride: 1, Weights: randomVector(3 * 16 * 9),
+			Padding: *NewPad(1, 1, 1, 1)},
+		&GroupNorm{NumGroups: 4},
+		ReLU{},
+		&SpatialConv{Depth: 16, KernelSize: 3, Stride: 1, Weights: randomVector(16 * 9),
+			Padding: *NewPad(1, 1, 1, 1)},
+		&Conv{InDepth: 16, OutDepth: 4, KernelSize: 1, Stride: 1, Weights: randomVector(16 * 4)},
+		&Bilateral{KernelSize: 5, SigmaBlur: 2, SigmaDiff: 1},
+		&Bilateral{SigmaBlur: 3, SigmaDiff: 1, Method: BilateralGrid},
+		&NonLocalMeans{SearchSize: 5, PatchSize: 3, Strength: 2},
+		&ATrous{Depth: 3, Iterations: 2, SigmaColor: 1, SigmaGuide: []float64{0.5}},
+		&Deconv{InDepth: 3, OutDepth: 3, KernelSize: 4, Stride: 2, Weights: randomVector(3 * 3 * 16)},
+	}
+	in := NewTensor(15, 18, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+	expected := network.Apply(in)
+
+	defer SetDefaultDeterminism(DefaultDeterminism())
+	defer SetDefaultContext(DefaultContext())
+	for _, d := range []Determinism{DeterminismStrict, DeterminismFloat64} {
+		SetDefaultDeterminism(d)
+		var first *Tensor
+		for _, numWorkers := range []int{1, 2, 3} {
+			ctx := NewContext(numWorkers)
+			defer ctx.Close()
+			SetDefaultContext(ctx)
+			actual := network.Apply(in)
+			if first == nil {
+				first = actual
+				t.Run(fmt.Sprintf("Mode%d", d), func(t *testing.T) {
+					checkTensorsClose(t, expected, actual, 1e-3)
+				})
+			} else {
+				checkTensorsClose(t, first, actual, 0)
+			}
+		}
+	}
+}
+
+func TestDeterminismHash(t *testing.T) {
+	// These hashes should be the same on every machine; if
+	// they differ on some CPU, an expression is likely
+	// being fused into an FMA instruction.
+	gen := rand.New(rand.NewSource(1337))
+	weights := func(n int) []float32 {
+		res := make([]float32, n)
+		for i := range res {
+			res[i] = float32(gen.NormFloat64())
+		}
+		return res
+	}
+	unet := &Graph{}
+	unet.AddLayer("enc", &Conv{InDepth: 3, OutDepth: 4, KernelSize: 3, Stride: 1,
+		Weights: weights(3 * 4 * 9), Padding: *NewPad(1, 1, 1, 1)}, GraphInput)
+	unet.AddLayer("pool", &MaxPool{Size: 2}, "enc")
+	unet.AddLayer("up", &Upsample{Scale: 2, Mode: UpsampleBilinear}, "pool")
+	unet.AddMerge("concat", Concat{}, "up", "enc")
+	unet.AddLayer("out", &Conv{InDepth: 8, OutDepth: 3, KernelSize: 1, Stride: 1,
+		Weights: weights(8 * 3)}, "concat")
+
+	in := NewTensor(16, 18, 3)
+	for i := range in.Data {
+		in.Data[i] = float32(gen.Float64())
+	}
+
+	defer SetDefaultDeterminism(DefaultDeterminism())
+	SetDefaultDeterminism(DeterminismStrict)
+	for _, test := range []struct {
+		name  string
+		layer Layer
+		hash  string
+	}{
+		{"Upsample", &Upsample{Scale: 3, Mode: UpsampleBilinear}, "9e687e4afe1069cc"},
+		{"UNet", unet, "62c850e8812c0671"},
+	} {
+		if hash := tensorHash(test.layer.Apply(in)); hash != test.hash {
+			t.Errorf("%s: expected hash %s but got %s", test.name, test.hash, hash)
+		}
+	}
+}
+
+func tensorHash(t *Tensor) string {
+	h := fnv.New64a()
+	for _, x := range t.Data {
+		binary.Write(h, binary.LittleEndian, math.Float32bits(x))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func TestNoFusedMultiplyAdd(t *testing.T) {
+	// The compiler may fuse a product and a sum into one
+	// FMA instruction on some architectures, which changes
+	// the rounding of the result. This checks that every
+	// such expression in this module rounds its products
+	// explicitly (e.g. float32(a*b) + c), so that outputs
+	// are the same on every machine.
+	if testing.Short() {
+		t.Skip("compiles the packages for several architectures")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fma := regexp.MustCompile(`\bV?FN?M(ADD|SUB)[A-Z0-9]*\b`)
+	source := regexp.MustCompile(`\((.*\.go):(\d+)\)`)
+	for _, env := range [][]string{
+		{"GOARCH=amd64", "GOAMD64=v3"},
+		{"GOARCH=amd64", "GOAMD64=v3", "GOFLAGS=-tags=purego"},
+		{"GOARCH=arm64"},
+		{"GOARCH=ppc64le"},
+		{"GOARCH=riscv64"},
+		{"GOARCH=s390x"},
+	} {
+		cmd := exec.Command(goTool, "build", "-gcflags=-S", ".", "..")
+		cmd.Env = append(os.Environ(), append([]string{"CGO_ENABLED=0"}, env...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %v\n%s", env, err, output)
+		}
+		reported := map[string]bool{}
+		for _, line := range strings.Split(string(output), "\n") {
+			match := source.FindStringSubmatch(line)
+			if match == nil || !fma.MatchString(line) || !strings.HasPrefix(match[1], root) {
+				continue
+			}
+			location := match[1][len(root)+1:] + ":" + match[2]
+			if !reported[location] {
+				reported[location] = true
+				t.Errorf("%v: fused multiply-add at %s", env, location)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package nn
+
+// gemmBlockSize is the number of inner-dimension entries
+// processed at once by gemm, chosen so that the block of
+// the right-hand matrix tends to stay in cache.
+const gemmBlockSize = 128
+
+// gemmMinColumns is the smallest number of output columns
+// for which gemm is preferred over gemmTransposed.
+const gemmMinColumns = 8
+
+// gemm computes c += a*b, where a is an m-by-k matrix, b
+// is a k-by-n matrix, and c is an m-by-n matrix, all
+// stored in row-major order.
+//
+// Rows of c are accumulated four at a time, so that each
+// row of b is loaded once for every four rows of a.
+func gemm(m, n, k int, a, b, c []float32) {
+	if accumulateFloat64() {
+		gemm64(m, n, k, a, b, c)
+		return
+	}
+	for kStart := 0; kStart < k; kStart += gemmBlockSize {
+		kEnd := kStart + gemmBlockSize
+		if kEnd > k {
+			kEnd = k
+		}
+		i := 0
+		for ; i+4 <= m; i += 4 {
+			gemmRows4(n, k, kStart, kEnd, a[i*k:], b, c[i*n:(i+4)*n])
+		}
+		for ; i < m; i++ {
+			gemmRow(n, kStart, kEnd, a[i*k:(i+1)*k], b, c[i*n:(i+1)*n])
+		}
+	}
+}
+
+func gemmRow(n, kStart, kEnd int, a, b, c []float32) {
+	for j := kStart; j < kEnd; j++ {
+		scale := a[j]
+		if scale == 0 {
+			// Inputs are often sparse after a ReLU.
+			continue
+		}
+		axpy(scale, b[j*n:(j+1)*n], c)
+	}
+}
+
+func gemmRows4(n, k, kStart, kEnd int, a, b, c []float32) {
+	var scales [4]float32
+	for j := kStart; j < kEnd; j++ {
+		scales[0] = a[j]
+		scales[1] = a[j+k]
+		scales[2] = a[j+2*k]
+		scales[3] = a[j+3*k]
+		if scales == [4]float32{} {
+			continue
+		}
+		axpy4(&scales, b[j*n:(j+1)*n], c)
+	}
+}
+
+// gemmTransposed is like gemm, but b is stored in
+// transposed form as an n-by-k matrix.
+//
+// This is faster than gemm when n is very small, since
+// every entry of c can be computed as a dot product.
+func gemmTransposed(m, n, k int, a, bt, c []float32) {
+	if accumulateFloat64() {
+		for i := 0; i < m; i++ {
+			row := a[i*k : (i+1)*k]
+			for j := 0; j < n; j++ {
+				c[i*n+j] = float32(float64(c[i*n+j]) + dot64(row, bt[j*k:(j+1)*k]))
+			}
+		}
+		return
+	}
+	for i := 0; i < m; i++ {
+		row := a[i*k : (i+1)*k]
+		for j := 0; j < n; j++ {
+			c[i*n+j] += dot(row, bt[j*k:(j+1)*k])
+		}
+	}
+}
+
+// gemm64 is like gemm, but it accumulates each row of c
+// in float64 before rounding it.
+func gemm64(m, n, k int, a, b, c []float32) {
+	acc := make([]float64, n)
+	for i := 0; i < m; i++ {
+		cRow := c[i*n : (i+1)*n]
+		for l, x := range cRow {
+			acc[l] = float64(x)
+		}
+		for j, scale := range a[i*k : (i+1)*k] {
+			if scale == 0 {
+				continue
+			}
+			s := float64(scale)
+			for l, x := range b[j*n : (j+1)*n] {
+				acc[l] += float64(s * float64(x))
+			}
+		}
+		for l, x := range acc {
+			cRow[l] = float32(x)
+		}
+	}
+}
+
+// dot64 computes the dot product of x and y in float64.
+func dot64(x, y []float32) float64 {
+	var res float64
+	y = y[:len(x)]
+	for i, v := range x {
+		res += float64(float64(v) * float64(y[i]))
+	}
+	return res
+}
@@ -0,0 +1,403 @@
+package nn
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// GraphInput is the name that the nodes of a Graph use to
+// refer to the input of the Graph.
+const GraphInput = "input"
+
+// A Graph is a special Layer which evaluates a directed
+// acyclic graph of named nodes, such as a U-Net whose
+// decoder concatenates the features of its encoder.
+//
+// Nodes may only use the outputs of earlier nodes, so the
+// order of Nodes is the order of evaluation.
+type Graph struct {
+	Nodes []GraphNode
+
+	// Output is the name of the node whose output is the
+	// output of the Graph.
+	// If empty, the last node is used.
+	Output string
+}
+
+// A GraphNode is a named operation in a Graph.
+//
+// Exactly one of Layer and Merge should be set.
+type GraphNode struct {
+	// Name identifies the node. It must be unique, and it
+	// must not be GraphInput.
+	Name string
+
+	// Inputs are the names of the nodes whose outputs are
+	// the inputs of this node.
+	Inputs []string
+
+	// Layer is applied to the only input of the node.
+	Layer Layer
+
+	// Merge combines one or more inputs.
+	Merge MergeLayer
+}
+
+// A MergeLayer combines the outputs of several nodes of a
+// Graph into a single Tensor.
+//
+// Unless the MergeLayer implements MergeRegionMapper,
+// every output pixel may only depend on the input pixels
+// at the same location.
+type MergeLayer interface {
+	// MergeShape computes the output shape for inputs of
+	// the given shapes, or returns an error if the inputs
+	// cannot be combined.
+	MergeShape(in []Shape) (Shape, error)
+
+	// MergeTo combines the inputs and writes the result
+	// to out, which must have the shape returned by
+	// MergeShape and must not overlap with the inputs.
+	MergeTo(in []*Tensor, out *Tensor)
+}
+
+// A MergeRegionMapper is a MergeLayer whose output pixels
+// may depend on input pixels at other locations.
+type MergeRegionMapper interface {
+	MergeLayer
+
+	// MergeInputRegion computes the region of the input
+	// at index idx that the given region of the output
+	// depends on.
+	MergeInputRegion(idx int, out image.Rectangle) image.Rectangle
+}
+
+// AddLayer adds a node which applies a Layer to the output
+// of another node.
+func (g *Graph) AddLayer(name string, l Layer, input string) {
+	g.Nodes = append(g.Nodes, GraphNode{Name: name, Inputs: []string{input}, Layer: l})
+}
+
+// AddMerge adds a node which combines the outputs of other
+// nodes.
+func (g *Graph) AddMerge(name string, m MergeLayer, inputs ...string) {
+	g.Nodes = append(g.Nodes, GraphNode{Name: name, Inputs: inputs, Merge: m})
+}
+
+// mapLayers creates a copy of g where f is applied to the
+// Layer of every node.
+func (g *Graph) mapLayers(f func(l Layer) Layer) *Graph {
+	res := &Graph{Nodes: append([]GraphNode{}, g.Nodes...), Output: g.Output}
+	for i, node := range res.Nodes {
+		if node.Layer != nil {
+			res.Nodes[i].Layer = f(node.Layer)
+		}
+	}
+	return res
+}
+
+// Apply evaluates every node and returns the output node's
+// result.
+func (g *Graph) Apply(t *Tensor) *Tensor {
+	res, err := g.evaluate(t, nil, func(l Layer, t *Tensor, path []int) (*Tensor, error) {
+		return l.Apply(t), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// OutputShape computes the shape of the output node.
+func (g *Graph) OutputShape(in Shape) (Shape, error) {
+	return OutputShape(g, in)
+}
+
+// graphEdges stores the inputs of every node of a Graph as
+// node indices, where -1 is the input of the Graph.
+type graphEdges struct {
+	inputs [][]int
+
+	// output is the index of the output node.
+	output int
+
+	// lastUse is the index of the last node that uses
+	// each node's output, or len(Nodes) for the output
+	// node.
+	lastUse []int
+}
+
+// edges resolves the names of the nodes, returning a
+// *LayerError if the Graph is invalid.
+func (g *Graph) edges(path []int) (*graphEdges, error) {
+	nodeError := func(i int, err error) error {
+		if i == -1 {
+			return &LayerError{Path: path, Layer: g, Err: err}
+		}
+		return &LayerError{Path: appendPath(path, i), Layer: g, Err: err}
+	}
+
+	indices := map[string]int{GraphInput: -1}
+	res := &graphEdges{
+		inputs:  make([][]int, len(g.Nodes)),
+		lastUse: make([]int, len(g.Nodes)),
+	}
+	for i, node := range g.Nodes {
+		if _, ok := indices[node.Name]; ok || node.Name == "" {
+			return nil, nodeError(-1, fmt.Errorf("invalid or duplicate node name: %q",
+				node.Name))
+		}
+		if (node.Layer == nil) == (node.Merge == nil) {
+			return nil, nodeError(i, fmt.Errorf("node %q must have a Layer or a Merge",
+				node.Name))
+		}
+		if node.Layer != nil && len(node.Inputs) != 1 {
+			return nil, nodeError(i, fmt.Errorf("node %q has %d inputs but its Layer "+
+				"expects one", node.Name, len(node.Inputs)))
+		} else if len(node.Inputs) == 0 {
+			return nil, nodeError(i, fmt.Errorf("node %q has no inputs", node.Name))
+		}
+		for _, name := range node.Inputs {
+			idx, ok := indices[name]
+			if !ok {
+				return nil, nodeError(i, fmt.Errorf("node %q uses unknown or later node %q",
+					node.Name, name))
+			}
+			res.inputs[i] = append(res.inputs[i], idx)
+			if idx != -1 {
+				res.lastUse[idx] = i
+			}
+		}
+		indices[node.Name] = i
+	}
+
+	if g.Output == "" {
+		res.output = len(g.Nodes) - 1
+	} else if idx, ok := indices[g.Output]; ok {
+		res.output = idx
+	} else {
+		return nil, nodeError(-1, fmt.Errorf("unknown output node %q", g.Output))
+	}
+	if res.output != -1 {
+		res.lastUse[res.output] = len(g.Nodes)
+	}
+	return res, nil
+}
+
+// evaluate applies the nodes in order, using apply to
+// compute the outputs of Layer nodes.
+func (g *Graph) evaluate(t *Tensor, path []int,
+	apply func(l Layer, t *Tensor, path []int) (*Tensor, error)) (*Tensor, error) {
+	edges, err := g.edges(path)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make([]*Tensor, len(g.Nodes))
+	value := func(idx int) *Tensor {
+		if idx == -1 {
+			return t
+		}
+		return outputs[idx]
+	}
+	for i, node := range g.Nodes {
+		nodePath := appendPath(path, i)
+		if node.Layer != nil {
+			outputs[i], err = apply(node.Layer, value(edges.inputs[i][0]), nodePath)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			inputs := make([]*Tensor, len(edges.inputs[i]))
+			shapes := make([]Shape, len(inputs))
+			for j, idx := range edges.inputs[i] {
+				inputs[j] = value(idx)
+				shapes[j] = inputs[j].Shape()
+			}
+			shape, err := node.Merge.MergeShape(shapes)
+			if err != nil {
+				return nil, mergeError(node, nodePath, g, err)
+			}
+			outputs[i] = NewTensor(shape.Height, shape.Width, shape.Depth)
+			node.Merge.MergeTo(inputs, outputs[i])
+		}
+		// Release the outputs that are no longer needed.
+		for _, idx := range edges.inputs[i] {
+			if idx != -1 && edges.lastUse[idx] == i {
+				outputs[idx] = nil
+			}
+		}
+	}
+	return value(edges.output), nil
+}
+
+func (g *Graph) outputShape(in Shape, path []int) (Shape, error) {
+	edges, err := g.edges(path)
+	if err != nil {
+		return Shape{}, err
+	}
+	shapes := make([]Shape, len(g.Nodes))
+	shape := func(idx int) Shape {
+		if idx == -1 {
+			return in
+		}
+		return shapes[idx]
+	}
+	for i, node := range g.Nodes {
+		nodePath := appendPath(path, i)
+		if node.Layer != nil {
+			shapes[i], err = outputShape(node.Layer, shape(edges.inputs[i][0]), nodePath)
+			if err != nil {
+				return Shape{}, err
+			}
+			continue
+		}
+		inShapes := make([]Shape, len(edges.inputs[i]))
+		for j, idx := range edges.inputs[i] {
+			inShapes[j] = shape(idx)
+		}
+		shapes[i], err = node.Merge.MergeShape(inShapes)
+		if err != nil {
+			return Shape{}, mergeError(node, nodePath, g, err)
+		}
+	}
+	return shape(edges.output), nil
+}
+
+func (g *Graph) inputRegion(out image.Rectangle, path []int) (image.Rectangle, error) {
+	edges, err := g.edges(path)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	if edges.output == -1 {
+		return out, nil
+	}
+
+	// Propagate regions backwards from the output node,
+	// taking the union of the regions needed by every
+	// node which uses a node's output.
+	regions := make([]image.Rectangle, len(g.Nodes))
+	needed := make([]bool, len(g.Nodes))
+	var inRegion image.Rectangle
+	var inNeeded bool
+	regions[edges.output] = out
+	needed[edges.output] = true
+	for i := len(g.Nodes) - 1; i >= 0; i-- {
+		if !needed[i] {
+			continue
+		}
+		node := g.Nodes[i]
+		region := regions[i]
+		if node.Layer != nil {
+			region, err = inputRegion(node.Layer, region, appendPath(path, i))
+			if err != nil {
+				return image.Rectangle{}, err
+			}
+		}
+		mapper, _ := node.Merge.(MergeRegionMapper)
+		for j, idx := range edges.inputs[i] {
+			if mapper != nil {
+				region = mapper.MergeInputRegion(j, regions[i])
+			}
+			if idx == -1 {
+				if inNeeded {
+					inRegion = unionRegions(inRegion, region)
+				} else {
+					inRegion, inNeeded = region, true
+				}
+			} else if needed[idx] {
+				regions[idx] = unionRegions(regions[idx], region)
+			} else {
+				regions[idx], needed[idx] = region, true
+			}
+		}
+	}
+	return inRegion, nil
+}
+
+// mergeError creates a *LayerError for a node with a
+// MergeLayer, which is reported as an error in the Graph.
+func mergeError(node GraphNode, path []int, g *Graph, err error) error {
+	return &LayerError{
+		Path:  path,
+		Layer: g,
+		Err:   fmt.Errorf("node %q (%T): %s", node.Name, node.Merge, err.Error()),
+	}
+}
+
+// Concat is a MergeLayer which concatenates the channels
+// of its inputs, in order.
+type Concat struct{}
+
+// MergeShape checks that the inputs have the same width
+// and height, and computes the total number of channels.
+func (c Concat) MergeShape(in []Shape) (Shape, error) {
+	if len(in) == 0 {
+		return Shape{}, errors.New("no inputs to concatenate")
+	}
+	res := in[0]
+	for _, s := range in[1:] {
+		if s.Height != res.Height || s.Width != res.Width {
+			return Shape{}, fmt.Errorf("cannot concatenate inputs of sizes %dx%d and %dx%d",
+				res.Height, res.Width, s.Height, s.Width)
+		}
+		res.Depth += s.Depth
+	}
+	return res, nil
+}
+
+// MergeTo concatenates the inputs into out.
+func (c Concat) MergeTo(in []*Tensor, out *Tensor) {
+	var depth int
+	for _, t := range in {
+		out.Channels(depth, depth+t.Depth).CopyFrom(t)
+		depth += t.Depth
+	}
+}
+
+// Sum is a MergeLayer which adds its inputs element-wise.
+type Sum struct{}
+
+// MergeShape checks that the inputs have the same shape.
+func (s Sum) MergeShape(in []Shape) (Shape, error) {
+	return sameMergeShape(in)
+}
+
+// MergeTo adds the inputs and writes the sum to out.
+func (s Sum) MergeTo(in []*Tensor, out *Tensor) {
+	out.CopyFrom(in[0])
+	for _, t := range in[1:] {
+		addVec(out.Data, t.Contiguous().Data, out.Data)
+	}
+}
+
+// Product is a MergeLayer which multiplies its inputs
+// element-wise, for example to apply an attention mask.
+type Product struct{}
+
+// MergeShape checks that the inputs have the same shape.
+func (p Product) MergeShape(in []Shape) (Shape, error) {
+	return sameMergeShape(in)
+}
+
+// MergeTo multiplies the inputs and writes the product to
+// out.
+func (p Product) MergeTo(in []*Tensor, out *Tensor) {
+	out.CopyFrom(in[0])
+	for _, t := range in[1:] {
+		mulVec(out.Data, t.Contiguous().Data, out.Data)
+	}
+}
+
+func sameMergeShape(in []Shape) (Shape, error) {
+	if len(in) == 0 {
+		return Shape{}, errors.New("no inputs to combine")
+	}
+	for _, s := range in[1:] {
+		if s != in[0] {
+			return Shape{}, fmt.Errorf("input shape %v does not match input shape %v", s,
+				in[0])
+		}
+	}
+	return in[0], nil
+}
@@ -0,0 +1,167 @@
+package nn
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	conv := func(inDepth, outDepth, kernel int) *Conv {
+		return &Conv{InDepth: inDepth, OutDepth: outDepth, KernelSize: kernel, Stride: 1,
+			Weights: randomVector(inDepth * outDepth * kernel * kernel)}
+	}
+	enc1 := NN{NewPad(1, 1, 1, 1), conv(3, 8, 3), ReLU{}}
+	enc2 := NN{NewPad(1, 1, 1, 1), conv(8, 8, 3), &Bias{Data: randomVector(8)}}
+	mask := conv(16, 16, 1)
+	dec := NN{NewPad(1, 1, 1, 1), conv(16, 3, 3)}
+
+	g := &Graph{}
+	g.AddLayer("enc1", enc1, GraphInput)
+	g.AddLayer("down", &MaxPool{Size: 2}, "enc1")
+	g.AddLayer("enc2", enc2, "down")
+	g.AddLayer("up", &Upsample{Scale: 2, Mode: UpsampleBilinear}, "enc2")
+	g.AddMerge("cat", Concat{}, "up", "enc1")
+	g.AddLayer("mask", mask, "cat")
+	g.AddMerge("gated", Product{}, "cat", "mask")
+	g.AddLayer("dec", dec, "gated")
+	g.AddMerge("out", Sum{}, "dec", GraphInput)
+
+	in := NewTensor(10, 12, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+	inCopy := copyTensor(in)
+
+	e1 := enc1.Apply(in)
+	down := (&MaxPool{Size: 2}).Apply(e1)
+	up := (&Upsample{Scale: 2, Mode: UpsampleBilinear}).Apply(enc2.Apply(down))
+	cat := NewTensor(10, 12, 16)
+	for y := 0; y < cat.Height; y++ {
+		for x := 0; x < cat.Width; x++ {
+			copy(cat.Pixel(y, x), up.Pixel(y, x))
+			copy(cat.Pixel(y, x)[8:], e1.Pixel(y, x))
+		}
+	}
+	gated := mask.Apply(cat)
+	for i, x := range cat.Data {
+		gated.Data[i] *= x
+	}
+	expected := addTensors(dec.Apply(gated), in)
+
+	checkTensorsClose(t, expected, g.Apply(in), 1e-5)
+	if actual, err := ApplyChecked(g, in); err != nil {
+		t.Fatal(err)
+	} else {
+		checkTensorsClose(t, expected, actual, 1e-5)
+	}
+	if _, ok := Optimize(g).(*Graph); !ok {
+		t.Error("expected optimized network to be a Graph")
+	}
+	checkTensorsClose(t, expected, Optimize(g).Apply(in), 1e-4)
+
+	quantized, err := Quantize(g, QuantInt8, []*Tensor{in})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errSum, sum float64
+	for i, x := range quantized.Apply(in).Data {
+		errSum += math.Pow(float64(x-expected.Data[i]), 2)
+		sum += math.Pow(float64(expected.Data[i]), 2)
+	}
+	if relErr := math.Sqrt(errSum / sum); relErr > 0.05 {
+		t.Errorf("quantized relative error %f is too large", relErr)
+	}
+
+	plan, err := NewPlan(g, in.Shape())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTensorsClose(t, expected, plan.Apply(in), 1e-5)
+	checkTensorsClose(t, inCopy, in, 0)
+
+	// The output of an earlier node.
+	g.Output = "cat"
+	plan, err = NewPlan(g, in.Shape())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTensorsClose(t, cat, plan.Apply(in), 1e-5)
+
+	if lcd, err := DimensionDivisor(g, 3); err != nil || lcd != 2 {
+		t.Errorf("expected divisor 2 but got %d (%v)", lcd, err)
+	}
+}
+
+func TestGraphInputRegion(t *testing.T) {
+	ones := func(n int) []float32 {
+		res := make([]float32, n)
+		for i := range res {
+			res[i] = 1
+		}
+		return res
+	}
+	g := &Graph{}
+	g.AddLayer("skip", NN{NewPad(0, 1, 0, 0), NewUnpad(0, 0, 0, 1)}, GraphInput)
+	g.AddLayer("down", &AvgPool{Size: 2}, GraphInput)
+	g.AddLayer("conv", NN{
+		NewPad(1, 1, 1, 1),
+		&Conv{InDepth: 1, OutDepth: 1, KernelSize: 3, Stride: 1, Weights: ones(9)},
+		&Upsample{Scale: 2},
+	}, "down")
+	g.AddMerge("out", Concat{}, "conv", "skip")
+
+	in := NewTensor(16, 16, 1)
+	bounds := in.Bounds()
+	expected := map[image.Point]image.Rectangle{}
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			*in.At(y, x, 0) = 1
+			out := g.Apply(in)
+			*in.At(y, x, 0) = 0
+			for outY := 0; outY < out.Height; outY++ {
+				for outX := 0; outX < out.Width; outX++ {
+					if *out.At(outY, outX, 0) != 0 || *out.At(outY, outX, 1) != 0 {
+						p := image.Pt(outX, outY)
+						expected[p] = expected[p].Union(image.Rect(x, y, x+1, y+1))
+					}
+				}
+			}
+		}
+	}
+	for p, expectedRegion := range expected {
+		region, err := InputRegion(g, image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := region.Intersect(bounds); actual != expectedRegion {
+			t.Errorf("output %v: expected region %v but got %v", p, expectedRegion, actual)
+		}
+	}
+}
+
+func TestGraphErrors(t *testing.T) {
+	relu := func(name string, inputs ...string) GraphNode {
+		return GraphNode{Name: name, Inputs: inputs, Layer: ReLU{}}
+	}
+	for i, g := range []*Graph{
+		{Nodes: []GraphNode{relu("a", GraphInput), relu("a", "a")}},
+		{Nodes: []GraphNode{relu(GraphInput, GraphInput)}},
+		{Nodes: []GraphNode{relu("a", "b"), relu("b", GraphInput)}},
+		{Nodes: []GraphNode{relu("a", GraphInput, GraphInput)}},
+		{Nodes: []GraphNode{{Name: "a", Inputs: []string{GraphInput}}}},
+		{Nodes: []GraphNode{{Name: "a", Merge: Sum{}}}},
+		{Nodes: []GraphNode{relu("a", GraphInput)}, Output: "b"},
+		{Nodes: []GraphNode{
+			{Name: "a", Inputs: []string{GraphInput}, Layer: &MaxPool{Size: 2}},
+			{Name: "b", Inputs: []string{"a", GraphInput}, Merge: Concat{}},
+		}},
+		{Nodes: []GraphNode{
+			{Name: "a", Inputs: []string{GraphInput}, Layer: &Bias{Data: []float32{1, 2}}},
+		}},
+	} {
+		if _, err := OutputShape(g, Shape{Height: 4, Width: 4, Depth: 3}); err == nil {
+			t.Errorf("case %d: expected error", i)
+		} else if _, ok := err.(*LayerError); !ok {
+			t.Errorf("case %d: unexpected error type %T", i, err)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package nn
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
 
 // GroupNorm implements the normalization step of group
 // normalization.
@@ -10,37 +13,84 @@ type GroupNorm struct {
 
 // Apply applies the normalization step.
 func (g *GroupNorm) Apply(t *Tensor) *Tensor {
-	if t.Depth%g.NumGroups != 0 {
-		panic("number of groups must divide number of input channels")
+	res := copyTensor(t)
+	g.ApplyInPlace(res)
+	return res
+}
+
+// ApplyInPlace applies the normalization step to the
+// Tensor in place.
+func (g *GroupNorm) ApplyInPlace(t *Tensor) {
+	if err := g.Check(t); err != nil {
+		panic(err)
 	}
-	sums := make([]float32, g.NumGroups)
-	sqSums := make([]float32, g.NumGroups)
+	if !t.IsContiguous() {
+		applyToView(t, g.ApplyInPlace)
+		return
+	}
+	biases, scales := g.statistics(t)
 	Groups(t, g.NumGroups, func(group, idx int) {
-		v := t.Data[idx]
-		sums[group] += v
-		sqSums[group] += v * v
+		t.Data[idx] = (t.Data[idx] + biases[group]) * scales[group]
 	})
-	normalize := 1.0 / float32(t.Width*t.Height*t.Depth/g.NumGroups)
+}
 
-	biases := sums
-	scales := sqSums
-	for i, x := range biases {
-		biases[i] = -x * normalize
+// statistics computes the bias and scale that normalize
+// each group.
+//
+// The values are summed in order, in float64 if float64
+// accumulation is enabled.
+func (g *GroupNorm) statistics(t *Tensor) (biases, scales []float32) {
+	sums := make([]float64, g.NumGroups)
+	sqSums := make([]float64, g.NumGroups)
+	if accumulateFloat64() {
+		Groups(t, g.NumGroups, func(group, idx int) {
+			v := float64(t.Data[idx])
+			sums[group] += v
+			sqSums[group] += float64(v * v)
+		})
+	} else {
+		sums32 := make([]float32, g.NumGroups)
+		sqSums32 := make([]float32, g.NumGroups)
+		Groups(t, g.NumGroups, func(group, idx int) {
+			v := t.Data[idx]
+			sums32[group] += v
+			sqSums32[group] += float32(v * v)
+		})
+		for i := range sums {
+			sums[i] = float64(sums32[i])
+			sqSums[i] = float64(sqSums32[i])
+		}
 	}
-	for i, sqSum := range scales {
-		b := biases[i]
-		x := sqSum*normalize - b*b
-		if x < 0 {
-			x = 0
+	normalize := 1.0 / float64(t.Width*t.Height*t.Depth/g.NumGroups)
+
+	biases = make([]float32, g.NumGroups)
+	scales = make([]float32, g.NumGroups)
+	for i, sum := range sums {
+		mean := sum * normalize
+		variance := float64(sqSums[i]*normalize) - float64(mean*mean)
+		if variance < 0 {
+			variance = 0
 		}
-		scales[i] = float32(1 / math.Sqrt(float64(x)+1e-5))
+		biases[i] = float32(-mean)
+		scales[i] = float32(1 / math.Sqrt(variance+1e-5))
 	}
+	return
+}
 
-	res := NewTensor(t.Height, t.Width, t.Depth)
-	Groups(t, g.NumGroups, func(group, idx int) {
-		res.Data[idx] = (t.Data[idx] + biases[group]) * scales[group]
-	})
-	return res
+// Check verifies that the number of groups divides the
+// number of channels in the Tensor.
+func (g *GroupNorm) Check(t *Tensor) error {
+	_, err := g.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape returns the input shape if it is valid.
+func (g *GroupNorm) OutputShape(in Shape) (Shape, error) {
+	if g.NumGroups <= 0 || in.Depth%g.NumGroups != 0 {
+		return in, fmt.Errorf("number of groups (%d) must divide number of input channels (%d)",
+			g.NumGroups, in.Depth)
+	}
+	return in, nil
 }
 
 // Groups iterates over the entries of t in order, but
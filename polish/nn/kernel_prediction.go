@@ -0,0 +1,114 @@
+package nn
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// KernelPrediction is a MergeLayer which filters an image
+// with a separate kernel for every pixel, as predicted by
+// a kernel-predicting network (KPCN).
+//
+// The first input is the image to filter. The second
+// input contains the logits of each pixel's kernel, with
+// KernelSize*KernelSize channels for the kernel offsets
+// in row-major order.
+//
+// The logits are normalized with a softmax over the
+// offsets which lie inside the image, so every output
+// pixel is a weighted average of nearby input pixels.
+// Thus, the output never leaves the range of colors in
+// the input.
+type KernelPrediction struct {
+	KernelSize int
+}
+
+// MergeShape checks that the logits have one channel per
+// kernel offset, and returns the shape of the image.
+func (k *KernelPrediction) MergeShape(in []Shape) (Shape, error) {
+	if k.KernelSize < 1 || k.KernelSize%2 == 0 {
+		return Shape{}, errors.New("kernel size must be odd and positive")
+	}
+	if len(in) != 2 {
+		return Shape{}, fmt.Errorf("expected an image and kernel logits but got %d inputs",
+			len(in))
+	}
+	image, logits := in[0], in[1]
+	if image.Height != logits.Height || image.Width != logits.Width {
+		return Shape{}, fmt.Errorf("image size %dx%d does not match kernel size %dx%d",
+			image.Height, image.Width, logits.Height, logits.Width)
+	}
+	if err := checkDepth(logits, k.KernelSize*k.KernelSize); err != nil {
+		return Shape{}, err
+	}
+	return image, nil
+}
+
+// MergeTo filters the image in in[0] with the kernels in
+// in[1].
+func (k *KernelPrediction) MergeTo(in []*Tensor, out *Tensor) {
+	img, logits := in[0], in[1]
+	radius := k.KernelSize / 2
+	interleaveRows(out.Height, func(start, stride int) {
+		weights := make([]float32, k.KernelSize*k.KernelSize)
+		for y := start; y < out.Height; y += stride {
+			for x := 0; x < out.Width; x++ {
+				k.kernelWeights(logits.Pixel(y, x), x, y, img.Width, img.Height, weights)
+				dst := out.Pixel(y, x)
+				for i := range dst {
+					dst[i] = 0
+				}
+				for i, w := range weights {
+					if w == 0 {
+						continue
+					}
+					srcY := y + i/k.KernelSize - radius
+					srcX := x + i%k.KernelSize - radius
+					axpy(w, img.Pixel(srcY, srcX), dst)
+				}
+			}
+		}
+	})
+}
+
+// kernelWeights computes the softmax of the logits for a
+// pixel, where offsets outside of the image get weight 0.
+func (k *KernelPrediction) kernelWeights(logits []float32, x, y, width, height int,
+	weights []float32) {
+	radius := k.KernelSize / 2
+	inside := func(i int) bool {
+		srcY := y + i/k.KernelSize - radius
+		srcX := x + i%k.KernelSize - radius
+		return srcY >= 0 && srcY < height && srcX >= 0 && srcX < width
+	}
+	maxLogit := float32(math.Inf(-1))
+	for i, l := range logits {
+		if inside(i) && l > maxLogit {
+			maxLogit = l
+		}
+	}
+	var sum float32
+	for i, l := range logits {
+		if inside(i) {
+			weights[i] = float32(exp(float64(l - maxLogit)))
+			sum += weights[i]
+		} else {
+			weights[i] = 0
+		}
+	}
+	scale := 1 / sum
+	for i := range weights {
+		weights[i] *= scale
+	}
+}
+
+// MergeInputRegion computes the region of the image or of
+// the logits that the output region depends on.
+func (k *KernelPrediction) MergeInputRegion(idx int, out image.Rectangle) image.Rectangle {
+	if idx == 0 {
+		return out.Inset(-(k.KernelSize / 2))
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+package nn
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestKernelPrediction(t *testing.T) {
+	const kernelSize = 5
+	g := &Graph{}
+	g.AddLayer("logits", &Conv{InDepth: 3, OutDepth: kernelSize * kernelSize, KernelSize: 1,
+		Stride: 1, Weights: randomVector(3 * kernelSize * kernelSize)}, GraphInput)
+	g.AddMerge("output", &KernelPrediction{KernelSize: kernelSize}, GraphInput, "logits")
+
+	in := NewTensor(7, 9, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+	logits := g.Nodes[0].Layer.Apply(in)
+
+	expected := NewTensor(in.Height, in.Width, in.Depth)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			var weightSum float64
+			sums := make([]float64, in.Depth)
+			for i, l := range logits.Pixel(y, x) {
+				srcY, srcX := y+i/kernelSize-kernelSize/2, x+i%kernelSize-kernelSize/2
+				if srcY < 0 || srcX < 0 || srcY >= in.Height || srcX >= in.Width {
+					continue
+				}
+				w := math.Exp(float64(l))
+				weightSum += w
+				for z, v := range in.Pixel(srcY, srcX) {
+					sums[z] += w * float64(v)
+				}
+			}
+			for z, s := range sums {
+				*expected.At(y, x, z) = float32(s / weightSum)
+			}
+		}
+	}
+	actual := g.Apply(in)
+	checkTensorsClose(t, expected, actual, 1e-5)
+
+	// The output is a convex combination of the inputs.
+	for z := 0; z < in.Depth; z++ {
+		min, max := float32(math.Inf(1)), float32(math.Inf(-1))
+		for i := z; i < len(in.Data); i += in.Depth {
+			min = float32(math.Min(float64(min), float64(in.Data[i])))
+			max = float32(math.Max(float64(max), float64(in.Data[i])))
+		}
+		for i := z; i < len(actual.Data); i += in.Depth {
+			if x := actual.Data[i]; x < min-1e-5 || x > max+1e-5 {
+				t.Errorf("channel %d: output %f is outside of range [%f, %f]", z, x, min, max)
+			}
+		}
+	}
+
+	plan, err := NewPlan(g, in.Shape())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTensorsClose(t, expected, plan.Apply(in), 1e-5)
+
+	if rf, err := ReceptiveField(g); err != nil || rf != kernelSize/2 {
+		t.Errorf("expected receptive field %d but got %d (%v)", kernelSize/2, rf, err)
+	}
+	region, err := InputRegion(g, image.Rect(3, 4, 5, 5))
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := image.Rect(1, 2, 7, 7); region != expected {
+		t.Errorf("expected region %v but got %v", expected, region)
+	}
+}
@@ -0,0 +1,179 @@
+package nn
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// NonLocalMeans is a non-local means filtering layer.
+//
+// Every output pixel is a weighted average of the pixels
+// in a SearchSize x SearchSize window around it, where
+// each pixel is weighted by the similarity between the
+// PatchSize x PatchSize patches around it and around the
+// output pixel. Thus, repetitive textures are averaged
+// with other instances of the same texture rather than
+// being blurred.
+//
+// The weight of a pixel is exp(-D/Strength^2), where D is
+// the mean squared difference between the two patches,
+// averaged over every channel and every pixel in which
+// both patches lie inside the input. As usual, the output
+// pixel itself gets the largest weight of any other pixel
+// in the window, since its patch is trivially identical.
+type NonLocalMeans struct {
+	SearchSize int
+	PatchSize  int
+	Strength   float64
+}
+
+// Apply applies the filter and returns a Tensor of the
+// same shape as t.
+func (n *NonLocalMeans) Apply(t *Tensor) *Tensor {
+	if err := n.Check(t); err != nil {
+		panic(err)
+	}
+	out := NewTensor(t.Height, t.Width, t.Depth)
+	n.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the filter and writes the result to
+// out.
+func (n *NonLocalMeans) ApplyTo(t, out *Tensor) {
+	if err := n.Check(t); err != nil {
+		panic(err)
+	}
+	searchRadius := n.SearchSize / 2
+	invStrength := 1 / (n.Strength * n.Strength)
+
+	interleaveRows(out.Height, func(start, stride int) {
+		dists := make([]float64, out.Width)
+		sums := make([]float64, out.Width*out.Depth)
+		weightSums := make([]float64, out.Width)
+		maxWeights := make([]float64, out.Width)
+		rowSums := make([]float64, out.Width)
+		rowCounts := make([]int, out.Width)
+		for y := start; y < out.Height; y += stride {
+			for i := range sums {
+				sums[i] = 0
+			}
+			for x := range weightSums {
+				weightSums[x] = 0
+				maxWeights[x] = 0
+			}
+			for dy := -searchRadius; dy <= searchRadius; dy++ {
+				if y+dy < 0 || y+dy >= t.Height {
+					continue
+				}
+				for dx := -searchRadius; dx <= searchRadius; dx++ {
+					if dx == 0 && dy == 0 {
+						continue
+					}
+					n.patchDistances(t, y, dy, dx, rowSums, rowCounts, dists)
+					for x, dist := range dists {
+						srcX := x + dx
+						if srcX < 0 || srcX >= t.Width {
+							continue
+						}
+						weight := exp(-math.Max(0, dist) * invStrength)
+						weightSums[x] += weight
+						maxWeights[x] = math.Max(maxWeights[x], weight)
+						dst := sums[x*out.Depth : (x+1)*out.Depth]
+						for i, v := range t.Pixel(y+dy, srcX) {
+							dst[i] += float64(weight * float64(v))
+						}
+					}
+				}
+			}
+			for x := 0; x < out.Width; x++ {
+				weight := maxWeights[x]
+				if weightSums[x] == 0 {
+					weight = 1
+				}
+				weightSum := weightSums[x] + weight
+				src := t.Pixel(y, x)
+				dst := out.Pixel(y, x)
+				for i, s := range sums[x*out.Depth : (x+1)*out.Depth] {
+					dst[i] = float32((s + float64(weight*float64(src[i]))) / weightSum)
+				}
+			}
+		}
+	})
+}
+
+// patchDistances computes the mean squared difference
+// between the patches around every pixel in row y and the
+// patches offset from them by (dx, dy).
+//
+// The rowSums and rowCounts buffers are used to store the
+// squared differences summed over the rows of the patches.
+func (n *NonLocalMeans) patchDistances(t *Tensor, y, dy, dx int, rowSums []float64,
+	rowCounts []int, dists []float64) {
+	patchRadius := n.PatchSize / 2
+	for x := range rowSums {
+		rowSums[x] = 0
+		rowCounts[x] = 0
+	}
+	for py := y - patchRadius; py <= y+patchRadius; py++ {
+		if py < 0 || py >= t.Height || py+dy < 0 || py+dy >= t.Height {
+			continue
+		}
+		for x := 0; x < t.Width; x++ {
+			if x+dx < 0 || x+dx >= t.Width {
+				continue
+			}
+			p1, p2 := t.Pixel(py, x), t.Pixel(py+dy, x+dx)
+			var sum float64
+			for i, v := range p1 {
+				diff := float64(v - p2[i])
+				sum += float64(diff * diff)
+			}
+			rowSums[x] += sum
+			rowCounts[x]++
+		}
+	}
+
+	// Sum the columns of each patch directly, rather than
+	// with a sliding window, so that large values do not
+	// affect the precision of other patches.
+	for x := range dists {
+		var sum float64
+		var count int
+		for px := x - patchRadius; px <= x+patchRadius; px++ {
+			if px >= 0 && px < t.Width {
+				sum += rowSums[px]
+				count += rowCounts[px]
+			}
+		}
+		if count > 0 {
+			dists[x] = sum / float64(count*t.Depth)
+		} else {
+			dists[x] = math.Inf(1)
+		}
+	}
+}
+
+// Check verifies that the window sizes are valid.
+func (n *NonLocalMeans) Check(t *Tensor) error {
+	_, err := n.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape returns the input shape.
+func (n *NonLocalMeans) OutputShape(in Shape) (Shape, error) {
+	if n.SearchSize < 1 || n.SearchSize%2 == 0 || n.PatchSize < 1 || n.PatchSize%2 == 0 {
+		return Shape{}, errors.New("search and patch sizes must be odd and positive")
+	}
+	if n.Strength <= 0 {
+		return Shape{}, errors.New("strength must be positive")
+	}
+	return in, nil
+}
+
+// InputRegion expands the output region by the radius of
+// the search window and the patches.
+func (n *NonLocalMeans) InputRegion(out image.Rectangle) image.Rectangle {
+	return out.Inset(-(n.SearchSize/2 + n.PatchSize/2))
+}
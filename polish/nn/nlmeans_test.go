@@ -0,0 +1,92 @@
+package nn
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestNonLocalMeans(t *testing.T) {
+	layer := &NonLocalMeans{SearchSize: 7, PatchSize: 3, Strength: 1.5}
+	in := NewTensor(9, 12, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+
+	inside := func(y, x int) bool {
+		return y >= 0 && x >= 0 && y < in.Height && x < in.Width
+	}
+	expected := NewTensor(in.Height, in.Width, in.Depth)
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			var weightSum, maxWeight float64
+			sums := make([]float64, in.Depth)
+			for dy := -3; dy <= 3; dy++ {
+				for dx := -3; dx <= 3; dx++ {
+					if (dx == 0 && dy == 0) || !inside(y+dy, x+dx) {
+						continue
+					}
+					var dist float64
+					var count int
+					for py := -1; py <= 1; py++ {
+						for px := -1; px <= 1; px++ {
+							if !inside(y+py, x+px) || !inside(y+dy+py, x+dx+px) {
+								continue
+							}
+							for z := 0; z < in.Depth; z++ {
+								diff := float64(*in.At(y+py, x+px, z) - *in.At(y+dy+py, x+dx+px, z))
+								dist += diff * diff
+								count++
+							}
+						}
+					}
+					w := math.Exp(-dist / float64(count) / (1.5 * 1.5))
+					weightSum += w
+					maxWeight = math.Max(maxWeight, w)
+					for z := range sums {
+						sums[z] += w * float64(*in.At(y+dy, x+dx, z))
+					}
+				}
+			}
+			for z, s := range sums {
+				c := float64(*in.At(y, x, z))
+				*expected.At(y, x, z) = float32((s + maxWeight*c) / (weightSum + maxWeight))
+			}
+		}
+	}
+	checkTensorsClose(t, expected, layer.Apply(in), 1e-5)
+
+	if rf, err := ReceptiveField(layer); err != nil || rf != 4 {
+		t.Errorf("expected receptive field 4 but got %d (%v)", rf, err)
+	}
+	region, err := InputRegion(layer, image.Rect(3, 4, 5, 5))
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := image.Rect(-1, 0, 9, 9); region != expected {
+		t.Errorf("expected region %v but got %v", expected, region)
+	}
+
+	// Extreme values only affect the outputs that depend
+	// on them.
+	wide := NewTensor(5, 30, 3)
+	copy(wide.Data, randomVector(len(wide.Data)))
+	expected = layer.Apply(wide)
+	*wide.At(2, 1, 0) = float32(math.Inf(1))
+	actual := layer.Apply(wide)
+	affected := image.Rect(1, 2, 2, 3).Inset(-4)
+	for y := 0; y < wide.Height; y++ {
+		for x := 0; x < wide.Width; x++ {
+			if image.Pt(x, y).In(affected) {
+				continue
+			}
+			for z := 0; z < wide.Depth; z++ {
+				if a, e := *actual.At(y, x, z), *expected.At(y, x, z); a != e {
+					t.Errorf("output (%d, %d, %d) changed from %f to %f", x, y, z, e, a)
+				}
+			}
+		}
+	}
+
+	// A single pixel is returned unchanged.
+	single := NewTensor(1, 1, 3)
+	copy(single.Data, in.Data)
+	checkTensorsClose(t, single, layer.Apply(single), 0)
+}
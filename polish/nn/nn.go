@@ -22,6 +22,12 @@ func (n NN) Apply(t *Tensor) *Tensor {
 	return res
 }
 
+// OutputShape computes the output shape of the final
+// layer.
+func (n NN) OutputShape(in Shape) (Shape, error) {
+	return OutputShape(n, in)
+}
+
 // Residual is a special Layer that composes multiple
 // other Layers and adds the output to the input.
 type Residual []Layer
@@ -30,12 +36,23 @@ type Residual []Layer
 // to the original input.
 func (r Residual) Apply(t *Tensor) *Tensor {
 	t1 := NN(r).Apply(t)
-	if t1.Width != t.Width || t1.Height != t.Height || t1.Depth != t.Depth {
-		panic("dimensions must match for residual connection")
+	if err := checkSameShape(t, t1); err != nil {
+		panic("residual connection: " + err.Error())
 	}
-	res := NewTensor(t.Height, t.Width, t.Depth)
-	for i, x := range t.Data {
-		res.Data[i] = x + t1.Data[i]
+	return addTensors(t, t1)
+}
+
+// OutputShape checks that the layers produce an output of
+// the same shape as the input, and returns that shape.
+func (r Residual) OutputShape(in Shape) (Shape, error) {
+	return OutputShape(r, in)
+}
+
+func addTensors(t1, t2 *Tensor) *Tensor {
+	t1, t2 = t1.Contiguous(), t2.Contiguous()
+	res := NewTensor(t1.Height, t1.Width, t1.Depth)
+	for i, x := range t1.Data {
+		res.Data[i] = x + t2.Data[i]
 	}
 	return res
 }
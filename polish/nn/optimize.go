@@ -0,0 +1,405 @@
+package nn
+
+// Optimize creates a network which computes the same
+// function as l, but which is cheaper to evaluate.
+//
+// Nested NN layers are flattened, and then the following
+// transformations are applied:
+//
+//   - Pad layers with PadZero become implicit padding in
+//     the Conv or SpatialConv that follows them.
+//   - Bias, Mul, and ReLU layers after a convolution are
+//     folded into its weights, bias, and activation.
+//   - Other chains of Bias, Mul, and ReLU layers are
+//     combined into Affine layers.
+//   - Affine transformations without a ReLU are folded
+//     into the weights and bias of an unpadded
+//     convolution that follows them.
+//
+// Depthwise Conv layers are replaced by SpatialConv
+// layers, and Residual layers and the nodes of Graphs are
+// optimized recursively.
+//
+// The original network is not modified, although the
+// optimized network may share weights with it. Due to
+// rounding, the outputs of the two networks may differ
+// very slightly.
+func Optimize(l Layer) Layer {
+	switch l := l.(type) {
+	case NN:
+		return NN(optimizeLayers(l))
+	case Residual:
+		return Residual(optimizeLayers(l))
+	case *Graph:
+		return l.mapLayers(Optimize)
+	case *Conv:
+		if s := l.asSpatialConv(); s != nil {
+			return s
+		}
+		return l
+	default:
+		return l
+	}
+}
+
+func optimizeLayers(layers []Layer) []Layer {
+	var result []Layer
+	var add func(l Layer)
+	add = func(l Layer) {
+		if subNet, ok := l.(NN); ok {
+			for _, subLayer := range subNet {
+				add(subLayer)
+			}
+			return
+		}
+		l = Optimize(l)
+		for len(result) > 0 {
+			fused := fuseLayers(result[len(result)-1], l)
+			if fused == nil {
+				break
+			}
+			result = result[:len(result)-1]
+			l = fused
+		}
+		result = append(result, l)
+	}
+	for _, l := range layers {
+		add(l)
+	}
+	return result
+}
+
+// fuseLayers creates a single Layer equivalent to prev
+// followed by next, or returns nil if this is not
+// possible.
+func fuseLayers(prev, next Layer) Layer {
+	switch next := next.(type) {
+	case *Conv:
+		if pad, ok := prev.(*Pad); ok {
+			return next.withPadding(pad)
+		} else if a := asAffine(prev); a != nil {
+			return next.withInputAffine(a)
+		}
+	case *SpatialConv:
+		if pad, ok := prev.(*Pad); ok {
+			return next.withPadding(pad)
+		} else if a := asAffine(prev); a != nil {
+			return next.withInputAffine(a)
+		}
+	case *Bias, *Mul, *Affine:
+		a := asAffine(next)
+		switch prev := prev.(type) {
+		case *Conv:
+			return prev.withOutputAffine(a)
+		case *SpatialConv:
+			return prev.withOutputAffine(a)
+		default:
+			if prevAffine := asAffine(prev); prevAffine != nil {
+				if combined := combineAffine(prevAffine, a); combined != nil {
+					return combined
+				}
+			}
+		}
+	case ReLU:
+		switch prev := prev.(type) {
+		case ReLU:
+			return prev
+		case *Conv:
+			if prev.ReLU {
+				return prev
+			}
+			return prev.withOutputAffine(&Affine{ReLU: true})
+		case *SpatialConv:
+			if prev.ReLU {
+				return prev
+			}
+			return prev.withOutputAffine(&Affine{ReLU: true})
+		default:
+			if a := asAffine(prev); a != nil {
+				a.ReLU = true
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// asAffine converts a Bias, Mul, or Affine layer into a
+// new Affine layer, or returns nil for any other Layer.
+func asAffine(l Layer) *Affine {
+	switch l := l.(type) {
+	case *Bias:
+		return &Affine{Bias: l.Data}
+	case *Mul:
+		return &Affine{Scale: l.Data}
+	case *Affine:
+		res := *l
+		return &res
+	}
+	return nil
+}
+
+// combineAffine creates an Affine layer equivalent to a1
+// followed by a2, or returns nil if the layers cannot be
+// combined.
+func combineAffine(a1, a2 *Affine) *Affine {
+	if a1.ReLU {
+		return nil
+	}
+	depth := -1
+	for _, vec := range [][]float32{a1.Scale, a1.Bias, a2.Scale, a2.Bias} {
+		if vec != nil {
+			depth = len(vec)
+		}
+	}
+	if !a1.fits(depth) || !a2.fits(depth) {
+		return nil
+	}
+	return &Affine{
+		Scale: mulScales(a1.Scale, a2.Scale),
+		Bias:  addVecs(scaleVec(a1.Bias, a2.Scale), a2.Bias),
+		ReLU:  a2.ReLU,
+	}
+}
+
+// fits checks if the layer is compatible with inputs with
+// depth channels.
+func (a *Affine) fits(depth int) bool {
+	return (a.Scale == nil || len(a.Scale) == depth) && (a.Bias == nil || len(a.Bias) == depth)
+}
+
+func (c *Conv) clone() *Conv {
+	return &Conv{
+		OutDepth:   c.OutDepth,
+		InDepth:    c.InDepth,
+		KernelSize: c.KernelSize,
+		Stride:     c.Stride,
+		Groups:     c.Groups,
+		Dilation:   c.Dilation,
+		Weights:    c.Weights,
+		Padding:    c.Padding,
+		Bias:       c.Bias,
+		ReLU:       c.ReLU,
+	}
+}
+
+// asSpatialConv converts a depthwise Conv into an
+// equivalent SpatialConv, or returns nil if the Conv is
+// not depthwise.
+func (c *Conv) asSpatialConv() *SpatialConv {
+	if c.groups() != c.InDepth || c.InDepth != c.OutDepth {
+		return nil
+	}
+	// The weights have the shape [depth x 1 x k x k].
+	return &SpatialConv{
+		Depth:      c.InDepth,
+		KernelSize: c.KernelSize,
+		Stride:     c.Stride,
+		Dilation:   c.Dilation,
+		Weights:    c.Weights,
+		Padding:    c.Padding,
+		Bias:       c.Bias,
+		ReLU:       c.ReLU,
+	}
+}
+
+func (c *Conv) withPadding(p *Pad) Layer {
+	if !validPadding(p) {
+		return nil
+	}
+	res := c.clone()
+	res.Padding = addPadding(p, &c.Padding)
+	return res
+}
+
+func (c *Conv) withInputAffine(a *Affine) Layer {
+	if a.ReLU || c.Padding != (Pad{}) || c.groups() != 1 || !a.fits(c.InDepth) ||
+		len(c.Weights) == 0 || len(c.Weights) != c.OutDepth*c.InDepth*c.KernelSize*c.KernelSize {
+		return nil
+	}
+	// Every input channel is multiplied by a group of
+	// KernelSize^2 consecutive weights.
+	res := c.clone()
+	res.Weights, res.Bias = foldInputAffine(a, c.Weights, c.Bias, c.OutDepth,
+		c.KernelSize*c.KernelSize)
+	return res
+}
+
+func (c *Conv) withOutputAffine(a *Affine) Layer {
+	if c.ReLU || !a.fits(c.OutDepth) || c.OutDepth == 0 || len(c.Weights)%c.OutDepth != 0 {
+		return nil
+	}
+	res := c.clone()
+	res.Weights, res.Bias = foldOutputAffine(a, c.Weights, c.Bias)
+	res.ReLU = a.ReLU
+	return res
+}
+
+func (s *SpatialConv) clone() *SpatialConv {
+	return &SpatialConv{
+		Depth:      s.Depth,
+		KernelSize: s.KernelSize,
+		Stride:     s.Stride,
+		Dilation:   s.Dilation,
+		Weights:    s.Weights,
+		Padding:    s.Padding,
+		Bias:       s.Bias,
+		ReLU:       s.ReLU,
+	}
+}
+
+func (s *SpatialConv) withPadding(p *Pad) Layer {
+	if !validPadding(p) {
+		return nil
+	}
+	res := s.clone()
+	res.Padding = addPadding(p, &s.Padding)
+	return res
+}
+
+func (s *SpatialConv) withInputAffine(a *Affine) Layer {
+	if a.ReLU || s.Padding != (Pad{}) || !a.fits(s.Depth) ||
+		len(s.Weights) != s.Depth*s.KernelSize*s.KernelSize {
+		return nil
+	}
+	// Each output channel only depends on one input
+	// channel, so the bias is computed with a diagonal
+	// weight matrix.
+	numTaps := s.KernelSize * s.KernelSize
+	res := s.clone()
+	res.Weights = scaleGroups(s.Weights, a.Scale, numTaps)
+	if a.Bias != nil {
+		res.Bias = make([]float32, s.Depth)
+		copy(res.Bias, s.Bias)
+		for z, b := range a.Bias {
+			var sum float32
+			for _, w := range s.Weights[z*numTaps : (z+1)*numTaps] {
+				sum += w
+			}
+			res.Bias[z] += float32(b * sum)
+		}
+	}
+	return res
+}
+
+func (s *SpatialConv) withOutputAffine(a *Affine) Layer {
+	if s.ReLU || !a.fits(s.Depth) || s.Depth == 0 || len(s.Weights)%s.Depth != 0 {
+		return nil
+	}
+	res := s.clone()
+	res.Weights, res.Bias = foldOutputAffine(a, s.Weights, s.Bias)
+	res.ReLU = a.ReLU
+	return res
+}
+
+// foldOutputAffine applies an affine transformation to
+// the output of a convolution by modifying its weights
+// and bias, where the weights are grouped by output
+// channel.
+func foldOutputAffine(a *Affine, weights, bias []float32) ([]float32, []float32) {
+	if a.Scale != nil {
+		weights = scaleGroups(weights, a.Scale, len(weights)/len(a.Scale))
+	}
+	return weights, addVecs(scaleVec(bias, a.Scale), a.Bias)
+}
+
+// foldInputAffine applies an affine transformation to the
+// input of a Conv by modifying its weights and bias.
+//
+// The weights are grouped by output channel, then by
+// input channel, and each group for an input channel has
+// groupSize weights.
+func foldInputAffine(a *Affine, weights, bias []float32, outDepth,
+	groupSize int) ([]float32, []float32) {
+	inDepth := len(weights) / (outDepth * groupSize)
+	var newBias []float32
+	if a.Bias != nil {
+		newBias = make([]float32, outDepth)
+		copy(newBias, bias)
+		for o := range newBias {
+			for i, b := range a.Bias {
+				offset := (o*inDepth + i) * groupSize
+				var sum float32
+				for _, w := range weights[offset : offset+groupSize] {
+					sum += w
+				}
+				newBias[o] += float32(b * sum)
+			}
+		}
+	} else {
+		newBias = bias
+	}
+	if a.Scale == nil {
+		return weights, newBias
+	}
+	newWeights := make([]float32, len(weights))
+	for o := 0; o < outDepth; o++ {
+		offset := o * inDepth * groupSize
+		copy(newWeights[offset:], scaleGroups(weights[offset:offset+inDepth*groupSize],
+			a.Scale, groupSize))
+	}
+	return newWeights, newBias
+}
+
+// scaleGroups multiplies consecutive groups of groupSize
+// values in vec by the corresponding entry of scales.
+//
+// If scales is nil, vec is returned as-is.
+func scaleGroups(vec, scales []float32, groupSize int) []float32 {
+	if scales == nil {
+		return vec
+	}
+	res := make([]float32, len(vec))
+	for i, x := range vec {
+		res[i] = x * scales[i/groupSize]
+	}
+	return res
+}
+
+// scaleVec multiplies vec by scales element-wise.
+//
+// A nil vec represents a zero bias, so it stays nil, and
+// nil scales leave vec unchanged.
+func scaleVec(vec, scales []float32) []float32 {
+	if vec == nil || scales == nil {
+		return vec
+	}
+	res := make([]float32, len(vec))
+	mulVec(vec, scales, res)
+	return res
+}
+
+// mulScales multiplies two scales element-wise, where nil
+// scales are treated as all ones.
+func mulScales(s1, s2 []float32) []float32 {
+	if s1 == nil {
+		return s2
+	}
+	return scaleVec(s1, s2)
+}
+
+// addVecs adds two vectors, where nil vectors are treated
+// as all zeros.
+func addVecs(v1, v2 []float32) []float32 {
+	if v1 == nil {
+		return v2
+	} else if v2 == nil {
+		return v1
+	}
+	res := make([]float32, len(v1))
+	addVec(v1, v2, res)
+	return res
+}
+
+func validPadding(p *Pad) bool {
+	return p.Top >= 0 && p.Right >= 0 && p.Bottom >= 0 && p.Left >= 0 && p.Mode == PadZero
+}
+
+func addPadding(p1, p2 *Pad) Pad {
+	return Pad{
+		Top:    p1.Top + p2.Top,
+		Right:  p1.Right + p2.Right,
+		Bottom: p1.Bottom + p2.Bottom,
+		Left:   p1.Left + p2.Left,
+	}
+}
@@ -0,0 +1,159 @@
+package nn
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	// Weights are scaled to keep activations near 1.
+	randWeights := func(fanIn, count int) []float32 {
+		res := randomVector(count)
+		for i := range res {
+			res[i] /= float32(math.Sqrt(float64(fanIn)))
+		}
+		return res
+	}
+	randConv := func(inDepth, outDepth, kernel, stride int) *Conv {
+		return &Conv{
+			InDepth:    inDepth,
+			OutDepth:   outDepth,
+			KernelSize: kernel,
+			Stride:     stride,
+			Weights:    randWeights(inDepth*kernel*kernel, inDepth*outDepth*kernel*kernel),
+		}
+	}
+	randSpatial := func(depth, kernel, stride int) *SpatialConv {
+		return &SpatialConv{
+			Depth:      depth,
+			KernelSize: kernel,
+			Stride:     stride,
+			Weights:    randWeights(kernel*kernel, depth*kernel*kernel),
+		}
+	}
+	network := NN{
+		NN{
+			NewPad(2, 2, 2, 2),
+			randConv(3, 8, 5, 2),
+			&Bias{Data: randomVector(8)},
+		},
+		ReLU{},
+		&Mul{Data: randomVector(8)},
+		&Bias{Data: randomVector(8)},
+		randConv(8, 16, 1, 1),
+		Residual{
+			&Bias{Data: randomVector(16)},
+			&Mul{Data: randomVector(16)},
+			&Bias{Data: randomVector(16)},
+			ReLU{},
+			NewPad(1, 1, 1, 1),
+			randSpatial(16, 3, 1),
+			&Bias{Data: randomVector(16)},
+			ReLU{},
+			ReLU{},
+			NewPad(1, 1, 1, 1),
+			randConv(16, 16, 3, 1),
+			&Mul{Data: randomVector(16)},
+		},
+		NewPad(2, 1, 2, 1),
+		randSpatial(16, 5, 2),
+		&Bias{Data: randomVector(16)},
+		&Deconv{
+			InDepth:    16,
+			OutDepth:   4,
+			KernelSize: 4,
+			Stride:     2,
+			Weights:    randWeights(16, 16*4*4*4),
+		},
+		&Bias{Data: randomVector(4)},
+		ReLU{},
+	}
+	optimized := Optimize(network).(NN)
+
+	var countLayers func(l Layer) int
+	countLayers = func(l Layer) int {
+		switch l := l.(type) {
+		case NN:
+			var res int
+			for _, x := range l {
+				res += countLayers(x)
+			}
+			return res
+		case Residual:
+			return countLayers(NN(l))
+		case *Pad, *Bias, *Mul:
+			t.Errorf("unexpected layer in optimized network: %T", l)
+		}
+		return 1
+	}
+	// Conv, Conv, Residual(Affine, SpatialConv, Conv),
+	// SpatialConv, Deconv, Affine.
+	if n := countLayers(optimized); n != 8 {
+		t.Errorf("expected 8 layers but got %d", n)
+	}
+
+	for _, size := range [][2]int{{16, 16}, {13, 22}} {
+		in := NewTensor(size[0], size[1], 3)
+		copy(in.Data, randomVector(len(in.Data)))
+		checkTensorsClose(t, network.Apply(in), optimized.Apply(in), 1e-3)
+	}
+}
+
+func TestOptimizeInputAffine(t *testing.T) {
+	for _, conv := range []Layer{
+		&Conv{InDepth: 5, OutDepth: 3, KernelSize: 3, Stride: 1,
+			Weights: randomVector(5 * 3 * 3 * 3)},
+		&SpatialConv{Depth: 5, KernelSize: 3, Stride: 2, Weights: randomVector(5 * 3 * 3)},
+	} {
+		network := NN{
+			&Mul{Data: randomVector(5)},
+			&Bias{Data: randomVector(5)},
+			conv,
+		}
+		optimized := Optimize(network).(NN)
+		if len(optimized) != 1 {
+			t.Errorf("%T: expected 1 layer but got %d", conv, len(optimized))
+		}
+		in := NewTensor(7, 8, 5)
+		copy(in.Data, randomVector(len(in.Data)))
+		checkTensorsClose(t, network.Apply(in), optimized.Apply(in), 1e-4)
+	}
+}
+
+func TestOptimizePadMode(t *testing.T) {
+	network := NN{
+		&Pad{Top: 1, Right: 1, Bottom: 1, Left: 1, Mode: PadReflect},
+		&Conv{InDepth: 3, OutDepth: 4, KernelSize: 3, Stride: 1,
+			Weights: randomVector(3 * 4 * 3 * 3)},
+	}
+	optimized := Optimize(network).(NN)
+	if len(optimized) != 2 {
+		t.Fatalf("expected 2 layers but got %d", len(optimized))
+	}
+	in := NewTensor(6, 7, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+	checkTensorsClose(t, network.Apply(in), optimized.Apply(in), 1e-4)
+}
+
+func TestOptimizeDepthwise(t *testing.T) {
+	network := NN{
+		&Conv{InDepth: 6, OutDepth: 6, KernelSize: 3, Stride: 2, Groups: 6,
+			Weights: randomVector(6 * 3 * 3)},
+		&Bias{Data: randomVector(6)},
+		&Conv{InDepth: 6, OutDepth: 6, KernelSize: 3, Stride: 1, Groups: 6, Dilation: 2,
+			Weights: randomVector(6 * 3 * 3)},
+	}
+	optimized := Optimize(network).(NN)
+	if len(optimized) != 2 {
+		t.Fatalf("expected 2 layers but got %d", len(optimized))
+	}
+	if _, ok := optimized[0].(*SpatialConv); !ok {
+		t.Errorf("expected SpatialConv but got %T", optimized[0])
+	}
+	if s, ok := optimized[1].(*SpatialConv); !ok || s.Dilation != 2 {
+		t.Errorf("expected dilated SpatialConv but got %T", optimized[1])
+	}
+	in := NewTensor(13, 12, 6)
+	copy(in.Data, randomVector(len(in.Data)))
+	checkTensorsClose(t, network.Apply(in), optimized.Apply(in), 1e-4)
+}
@@ -0,0 +1,408 @@
+package nn
+
+import (
+	"fmt"
+	"sync"
+)
+
+// An InPlaceLayer is a Layer which can overwrite its input
+// with its output, avoiding an allocation.
+type InPlaceLayer interface {
+	Shaper
+
+	// ApplyInPlace applies the Layer to t, replacing the
+	// contents of t with the output.
+	//
+	// The output must have the same shape as the input.
+	ApplyInPlace(t *Tensor)
+}
+
+// A TargetLayer is a Layer which can write its output into
+// an existing Tensor, avoiding an allocation.
+type TargetLayer interface {
+	Shaper
+
+	// ApplyTo applies the Layer to in and writes the
+	// result to out, which must have the shape returned by
+	// OutputShape.
+	//
+	// The initial contents of out are ignored, and out
+	// must not overlap with in.
+	ApplyTo(in, out *Tensor)
+}
+
+// A Plan evaluates a network on inputs of a fixed shape,
+// reusing memory for intermediate Tensors.
+//
+// The lifetime of every intermediate Tensor is computed
+// when the Plan is created. InPlaceLayers overwrite their
+// inputs whenever the input is not needed afterwards, and
+// the outputs of TargetLayers and MergeLayers are drawn
+// from an arena of buffers which are shared between
+// Tensors whose lifetimes do not overlap. Other Layers allocate their
+// outputs as usual.
+//
+// A Plan is safe to use from multiple Goroutines
+// concurrently, in which case each Goroutine uses its own
+// arena.
+type Plan struct {
+	inShape  Shape
+	outShape Shape
+
+	steps       []planStep
+	values      []planValue
+	output      int
+	bufferSizes []int
+	peakMemory  int
+
+	arenas sync.Pool
+}
+
+type stepKind int
+
+const (
+	stepInPlace stepKind = iota
+	stepTarget
+	stepAllocate
+	stepAdd
+	stepMerge
+)
+
+type planStep struct {
+	kind  stepKind
+	layer Layer
+
+	// in and out are indices of values. For stepAdd, skip
+	// is the value that is added to in.
+	in   int
+	skip int
+	out  int
+
+	// For stepMerge, merge combines the values in inputs.
+	merge  MergeLayer
+	inputs []int
+
+	// inPlace is set for in-place and add steps which
+	// may overwrite their input with their output.
+	inPlace bool
+}
+
+type planValue struct {
+	shape Shape
+
+	// buffer is the index of the arena buffer storing the
+	// value, or -1 if the value is not stored in the
+	// arena.
+	buffer int
+}
+
+// NewPlan creates a Plan for applying l to inputs of the
+// given shape.
+//
+// If the network cannot be applied to such inputs, or if
+// shape inference is not supported for a Layer, a
+// *LayerError is returned.
+func NewPlan(l Layer, in Shape) (*Plan, error) {
+	out, err := OutputShape(l, in)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		inShape:  in,
+		outShape: out,
+		values:   []planValue{{shape: in, buffer: -1}},
+	}
+	p.output = p.addSteps(l, 0)
+	p.assignBuffers()
+	p.arenas.New = func() interface{} {
+		arena := make([][]float32, len(p.bufferSizes))
+		for i, size := range p.bufferSizes {
+			arena[i] = make([]float32, size)
+		}
+		return arena
+	}
+	return p, nil
+}
+
+// InputShape gets the input shape that the Plan was
+// created for.
+func (p *Plan) InputShape() Shape {
+	return p.inShape
+}
+
+// PeakMemory gets the maximum number of bytes used by the
+// intermediate and output Tensors during one application
+// of the Plan, including the entire arena.
+//
+// This does not include the input Tensor, or temporary
+// buffers used internally by individual Layers.
+func (p *Plan) PeakMemory() int {
+	return p.peakMemory
+}
+
+// Apply applies the network to a Tensor.
+//
+// The Tensor must have the Plan's input shape.
+func (p *Plan) Apply(t *Tensor) *Tensor {
+	if err := p.Check(t); err != nil {
+		panic(err)
+	}
+	arena := p.arenas.Get().([][]float32)
+	defer p.arenas.Put(arena)
+
+	tensors := make([]*Tensor, len(p.values))
+	tensors[0] = t
+	for _, step := range p.steps {
+		in := tensors[step.in]
+		out := in
+		if !step.inPlace && step.kind != stepAllocate {
+			out = p.valueTensor(arena, step.out)
+		}
+		switch step.kind {
+		case stepInPlace:
+			if !step.inPlace {
+				out.CopyFrom(in)
+			}
+			step.layer.(InPlaceLayer).ApplyInPlace(out)
+		case stepTarget:
+			step.layer.(TargetLayer).ApplyTo(in, out)
+		case stepAllocate:
+			out = step.layer.Apply(in)
+		case stepAdd:
+			addVec(in.Contiguous().Data, tensors[step.skip].Contiguous().Data, out.Data)
+		case stepMerge:
+			inputs := make([]*Tensor, len(step.inputs))
+			for i, idx := range step.inputs {
+				inputs[i] = tensors[idx]
+			}
+			step.merge.MergeTo(inputs, out)
+		}
+		tensors[step.out] = out
+	}
+
+	res := tensors[p.output]
+	if p.values[p.output].buffer != -1 {
+		// The arena will be reused by later calls.
+		res = copyTensor(res)
+	}
+	return res
+}
+
+// Check verifies that the Tensor has the input shape of
+// the Plan.
+func (p *Plan) Check(t *Tensor) error {
+	if t.Shape() != p.inShape {
+		return fmt.Errorf("plan expects input shape %v but got %v", p.inShape, t.Shape())
+	}
+	return nil
+}
+
+// OutputShape returns the output shape of the network if
+// in is the Plan's input shape.
+func (p *Plan) OutputShape(in Shape) (Shape, error) {
+	if in != p.inShape {
+		return Shape{}, fmt.Errorf("plan expects input shape %v but got %v", p.inShape, in)
+	}
+	return p.outShape, nil
+}
+
+func (p *Plan) valueTensor(arena [][]float32, idx int) *Tensor {
+	v := p.values[idx]
+	return &Tensor{
+		Height: v.shape.Height,
+		Width:  v.shape.Width,
+		Depth:  v.shape.Depth,
+		Data:   arena[v.buffer][:v.shape.Size()],
+	}
+}
+
+// addSteps adds the steps for applying l to the given
+// value, and returns the index of the output value.
+func (p *Plan) addSteps(l Layer, in int) int {
+	switch l := l.(type) {
+	case NN:
+		for _, subLayer := range l {
+			in = p.addSteps(subLayer, in)
+		}
+		return in
+	case Residual:
+		bodyOut := p.addSteps(NN(l), in)
+		out := p.addValue(p.values[in].shape)
+		p.steps = append(p.steps, planStep{kind: stepAdd, in: bodyOut, skip: in, out: out})
+		return out
+	case *Graph:
+		return p.addGraphSteps(l, in)
+	}
+
+	// Errors were already caught by NewPlan.
+	shape, _ := l.(Shaper).OutputShape(p.values[in].shape)
+	out := p.addValue(shape)
+	step := planStep{kind: stepAllocate, layer: l, in: in, out: out}
+	if _, ok := l.(InPlaceLayer); ok && shape == p.values[in].shape {
+		step.kind = stepInPlace
+	} else if _, ok := l.(TargetLayer); ok {
+		step.kind = stepTarget
+	}
+	p.steps = append(p.steps, step)
+	return out
+}
+
+// addGraphSteps adds the steps for every node of a Graph
+// and returns the index of the output node's value.
+func (p *Plan) addGraphSteps(g *Graph, in int) int {
+	// Errors were already caught by NewPlan.
+	edges, _ := g.edges(nil)
+	nodeValues := make([]int, len(g.Nodes))
+	value := func(idx int) int {
+		if idx == -1 {
+			return in
+		}
+		return nodeValues[idx]
+	}
+	for i, node := range g.Nodes {
+		if node.Layer != nil {
+			nodeValues[i] = p.addSteps(node.Layer, value(edges.inputs[i][0]))
+			continue
+		}
+		step := planStep{kind: stepMerge, merge: node.Merge}
+		shapes := make([]Shape, len(edges.inputs[i]))
+		for j, idx := range edges.inputs[i] {
+			step.inputs = append(step.inputs, value(idx))
+			shapes[j] = p.values[value(idx)].shape
+		}
+		shape, _ := node.Merge.MergeShape(shapes)
+		step.in = step.inputs[0]
+		step.out = p.addValue(shape)
+		p.steps = append(p.steps, step)
+		nodeValues[i] = step.out
+	}
+	return value(edges.output)
+}
+
+func (p *Plan) addValue(shape Shape) int {
+	p.values = append(p.values, planValue{shape: shape, buffer: -1})
+	return len(p.values) - 1
+}
+
+// assignBuffers decides where every value is stored and
+// computes the peak memory usage.
+func (p *Plan) assignBuffers() {
+	lastUse := make([]int, len(p.values))
+	for i, step := range p.steps {
+		lastUse[step.in] = i
+		if step.kind == stepAdd {
+			lastUse[step.skip] = i
+		}
+		for _, idx := range step.inputs {
+			lastUse[idx] = i
+		}
+	}
+	// The output must outlive every step.
+	lastUse[p.output] = len(p.steps)
+
+	var free []int
+	var arenaSize, allocated int
+	allocate := func(value int) {
+		size := p.values[value].shape.Size()
+		buffer := bestBuffer(free, p.bufferSizes, size)
+		if buffer == -1 {
+			buffer = len(p.bufferSizes)
+			p.bufferSizes = append(p.bufferSizes, size)
+			arenaSize += size
+		} else {
+			for i, b := range free {
+				if b == buffer {
+					free = append(free[:i], free[i+1:]...)
+					break
+				}
+			}
+			if p.bufferSizes[buffer] < size {
+				arenaSize += size - p.bufferSizes[buffer]
+				p.bufferSizes[buffer] = size
+			}
+		}
+		p.values[value].buffer = buffer
+	}
+	release := func(value, stepIdx int) {
+		if lastUse[value] != stepIdx || value == 0 {
+			return
+		}
+		v := p.values[value]
+		if v.buffer != -1 {
+			free = append(free, v.buffer)
+		} else {
+			allocated -= v.shape.Size()
+		}
+	}
+
+	for i := range p.steps {
+		step := &p.steps[i]
+		if step.kind == stepInPlace || step.kind == stepAdd {
+			// The caller's input is never overwritten, and
+			// the two inputs of an empty Residual are the
+			// same value.
+			step.inPlace = step.in != 0 && lastUse[step.in] == i &&
+				(step.kind != stepAdd || step.skip != step.in)
+		}
+		if step.inPlace {
+			// The output takes ownership of the input's
+			// memory.
+			p.values[step.out].buffer = p.values[step.in].buffer
+		} else if step.kind == stepAllocate {
+			allocated += p.values[step.out].shape.Size()
+		} else {
+			allocate(step.out)
+		}
+		if memory := (arenaSize + allocated) * 4; memory > p.peakMemory {
+			p.peakMemory = memory
+		}
+		if !step.inPlace {
+			release(step.in, i)
+		}
+		if step.kind == stepAdd && step.skip != step.in {
+			release(step.skip, i)
+		}
+		for j, idx := range step.inputs {
+			if j > 0 && !containsInt(step.inputs[:j], idx) {
+				release(idx, i)
+			}
+		}
+	}
+}
+
+// bestBuffer finds the smallest free buffer that can hold
+// size values. If no buffer is large enough, the largest
+// free buffer is returned so that it can be grown. If
+// there are no free buffers, -1 is returned.
+func bestBuffer(free, sizes []int, size int) int {
+	best := -1
+	for _, b := range free {
+		if best == -1 {
+			best = b
+			continue
+		}
+		bestFits := sizes[best] >= size
+		fits := sizes[b] >= size
+		if fits && (!bestFits || sizes[b] < sizes[best]) {
+			best = b
+		} else if !fits && !bestFits && sizes[b] > sizes[best] {
+			best = b
+		}
+	}
+	return best
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+func copyTensor(t *Tensor) *Tensor {
+	res := NewTensor(t.Height, t.Width, t.Depth)
+	res.CopyFrom(t)
+	return res
+}
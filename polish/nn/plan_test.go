@@ -0,0 +1,78 @@
+package nn
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	network := NN{
+		NewPad(1, 1, 1, 1),
+		&Conv{InDepth: 3, OutDepth: 8, KernelSize: 3, Stride: 2, Weights: randomVector(3 * 8 * 9)},
+		&Bias{Data: randomVector(8)},
+		ReLU{},
+		Residual{
+			&Mul{Data: randomVector(8)},
+			ReLU{},
+			&SpatialConv{Depth: 8, KernelSize: 3, Stride: 1, Weights: randomVector(8 * 9),
+				Padding: *NewPad(1, 1, 1, 1)},
+			Residual{},
+			&GroupNorm{NumGroups: 2},
+		},
+		&Bilateral{KernelSize: 3, SigmaBlur: 1, SigmaDiff: 1},
+		Residual{
+			&Affine{Scale: randomVector(8), ReLU: true},
+		},
+		&Deconv{InDepth: 8, OutDepth: 4, KernelSize: 4, Stride: 2, Weights: randomVector(8 * 4 * 16)},
+		NewUnpad(1, 1, 1, 1),
+		&Affine{Bias: randomVector(4)},
+	}
+	in := NewTensor(10, 12, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+	inCopy := copyTensor(in)
+
+	plan, err := NewPlan(network, in.Shape())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Count the memory of every intermediate Tensor.
+	var naiveMemory int
+	shape := in.Shape()
+	for _, l := range network {
+		shape, _ = OutputShape(l, shape)
+		naiveMemory += shape.Size() * 4
+	}
+	if plan.PeakMemory() <= 0 || plan.PeakMemory() >= naiveMemory {
+		t.Errorf("unexpected peak memory %d (naive is %d)", plan.PeakMemory(), naiveMemory)
+	}
+
+	expected := network.Apply(in)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2; j++ {
+				checkTensorsClose(t, expected, plan.Apply(in), 1e-5)
+			}
+		}()
+	}
+	wg.Wait()
+	checkTensorsClose(t, inCopy, in, 0)
+
+	if _, err := NewPlan(network, Shape{Height: 10, Width: 12, Depth: 4}); err == nil {
+		t.Error("expected error for invalid input shape")
+	}
+}
+
+func TestPlanEmpty(t *testing.T) {
+	in := NewTensor(2, 3, 4)
+	for _, network := range []Layer{NN{}, Residual{}, &Graph{}, &Graph{Output: GraphInput}} {
+		plan, err := NewPlan(network, in.Shape())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTensorsClose(t, network.Apply(in), plan.Apply(in), 0)
+	}
+}
@@ -0,0 +1,295 @@
+package nn
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// A MaxPool layer downsamples a Tensor by taking the
+// maximum of each channel in non-overlapping Size x Size
+// windows, like a PyTorch MaxPool2d with a stride equal
+// to its kernel size.
+//
+// Rows and columns past the last whole window are
+// dropped.
+type MaxPool struct {
+	Size int
+}
+
+// Apply applies the pooling operation.
+func (m *MaxPool) Apply(t *Tensor) *Tensor {
+	if err := m.Check(t); err != nil {
+		panic(err)
+	}
+	shape, _ := m.OutputShape(t.Shape())
+	out := NewTensor(shape.Height, shape.Width, shape.Depth)
+	m.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the pooling operation and writes the
+// result to out.
+func (m *MaxPool) ApplyTo(t, out *Tensor) {
+	if err := m.Check(t); err != nil {
+		panic(err)
+	}
+	poolWindows(t, out, m.Size, func(window *Tensor, dst []float32) {
+		for i := range dst {
+			dst[i] = float32(math.Inf(-1))
+		}
+		for y := 0; y < window.Height; y++ {
+			for x := 0; x < window.Width; x++ {
+				for z, v := range window.Pixel(y, x) {
+					if v > dst[z] {
+						dst[z] = v
+					}
+				}
+			}
+		}
+	})
+}
+
+// Check verifies that the Tensor contains at least one
+// window.
+func (m *MaxPool) Check(t *Tensor) error {
+	_, err := m.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the downsampled shape.
+func (m *MaxPool) OutputShape(in Shape) (Shape, error) {
+	return poolOutputShape(in, m.Size)
+}
+
+// InputRegion computes the windows that the output region
+// depends on.
+func (m *MaxPool) InputRegion(out image.Rectangle) image.Rectangle {
+	return convInputRegion(out, m.Size, m.Size)
+}
+
+// An AvgPool layer downsamples a Tensor by averaging each
+// channel in non-overlapping Size x Size windows, like a
+// PyTorch AvgPool2d with a stride equal to its kernel
+// size.
+//
+// Rows and columns past the last whole window are
+// dropped.
+type AvgPool struct {
+	Size int
+}
+
+// Apply applies the pooling operation.
+func (a *AvgPool) Apply(t *Tensor) *Tensor {
+	if err := a.Check(t); err != nil {
+		panic(err)
+	}
+	shape, _ := a.OutputShape(t.Shape())
+	out := NewTensor(shape.Height, shape.Width, shape.Depth)
+	a.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo applies the pooling operation and writes the
+// result to out.
+func (a *AvgPool) ApplyTo(t, out *Tensor) {
+	if err := a.Check(t); err != nil {
+		panic(err)
+	}
+	scale := 1 / float32(a.Size*a.Size)
+	poolWindows(t, out, a.Size, func(window *Tensor, dst []float32) {
+		for i := range dst {
+			dst[i] = 0
+		}
+		for y := 0; y < window.Height; y++ {
+			for x := 0; x < window.Width; x++ {
+				addVec(dst, window.Pixel(y, x), dst)
+			}
+		}
+		for i := range dst {
+			dst[i] *= scale
+		}
+	})
+}
+
+// Check verifies that the Tensor contains at least one
+// window.
+func (a *AvgPool) Check(t *Tensor) error {
+	_, err := a.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the downsampled shape.
+func (a *AvgPool) OutputShape(in Shape) (Shape, error) {
+	return poolOutputShape(in, a.Size)
+}
+
+// InputRegion computes the windows that the output region
+// depends on.
+func (a *AvgPool) InputRegion(out image.Rectangle) image.Rectangle {
+	return convInputRegion(out, a.Size, a.Size)
+}
+
+func poolOutputShape(in Shape, size int) (Shape, error) {
+	if size < 1 {
+		return Shape{}, errors.New("pooling size must be positive")
+	}
+	if err := checkKernel(in, size); err != nil {
+		return Shape{}, err
+	}
+	return Shape{Height: in.Height / size, Width: in.Width / size, Depth: in.Depth}, nil
+}
+
+// poolWindows calls f with every window of t and the
+// pixel of out that it is pooled into.
+func poolWindows(t, out *Tensor, size int, f func(window *Tensor, dst []float32)) {
+	interleaveRows(out.Height, func(start, stride int) {
+		for y := start; y < out.Height; y += stride {
+			for x := 0; x < out.Width; x++ {
+				window := t.View(image.Rect(x*size, y*size, (x+1)*size, (y+1)*size))
+				f(window, out.Pixel(y, x))
+			}
+		}
+	})
+}
+
+// UpsampleMode determines how an Upsample layer computes
+// the pixels between the input pixels.
+type UpsampleMode int
+
+const (
+	// UpsampleNearest repeats each input pixel.
+	UpsampleNearest UpsampleMode = iota
+
+	// UpsampleBilinear interpolates between the nearest
+	// four input pixels, like a PyTorch Upsample with
+	// align_corners=False.
+	UpsampleBilinear
+)
+
+// An Upsample layer scales up the width and height of a
+// Tensor by an integer factor.
+type Upsample struct {
+	Scale int
+	Mode  UpsampleMode
+}
+
+// Apply upsamples the Tensor.
+func (u *Upsample) Apply(t *Tensor) *Tensor {
+	if err := u.Check(t); err != nil {
+		panic(err)
+	}
+	out := NewTensor(t.Height*u.Scale, t.Width*u.Scale, t.Depth)
+	u.ApplyTo(t, out)
+	return out
+}
+
+// ApplyTo upsamples the Tensor into out.
+func (u *Upsample) ApplyTo(t, out *Tensor) {
+	if err := u.Check(t); err != nil {
+		panic(err)
+	}
+	if u.Mode == UpsampleNearest {
+		interleaveRows(out.Height, func(start, stride int) {
+			for y := start; y < out.Height; y += stride {
+				for x := 0; x < out.Width; x++ {
+					copy(out.Pixel(y, x), t.Pixel(y/u.Scale, x/u.Scale))
+				}
+			}
+		})
+		return
+	}
+
+	xs0, xs1, xFracs := u.bilinearSources(t.Width)
+	ys0, ys1, yFracs := u.bilinearSources(t.Height)
+	interleaveRows(out.Height, func(start, stride int) {
+		row := make([]float32, t.Depth)
+		for y := start; y < out.Height; y += stride {
+			yFrac := yFracs[y]
+			for x := 0; x < out.Width; x++ {
+				xFrac := xFracs[x]
+				dst := out.Pixel(y, x)
+				lerpPixels(t.Pixel(ys0[y], xs0[x]), t.Pixel(ys0[y], xs1[x]), xFrac, dst)
+				lerpPixels(t.Pixel(ys1[y], xs0[x]), t.Pixel(ys1[y], xs1[x]), xFrac, row)
+				lerpPixels(dst, row, yFrac, dst)
+			}
+		}
+	})
+}
+
+// bilinearSources computes the two input coordinates that
+// each output coordinate interpolates between, and the
+// weight of the second one.
+func (u *Upsample) bilinearSources(size int) (src0, src1 []int, fracs []float32) {
+	src0 = make([]int, size*u.Scale)
+	src1 = make([]int, size*u.Scale)
+	fracs = make([]float32, size*u.Scale)
+	for i := range src0 {
+		src := (float32(i)+0.5)/float32(u.Scale) - 0.5
+		if src < 0 {
+			src = 0
+		}
+		src0[i] = int(src)
+		if src0[i] < size-1 {
+			src1[i] = src0[i] + 1
+		} else {
+			src1[i] = src0[i]
+		}
+		fracs[i] = src - float32(src0[i])
+	}
+	return
+}
+
+// Check verifies that the Layer's settings are valid.
+func (u *Upsample) Check(t *Tensor) error {
+	_, err := u.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the upsampled shape.
+func (u *Upsample) OutputShape(in Shape) (Shape, error) {
+	if u.Scale < 1 {
+		return Shape{}, errors.New("upsampling scale must be positive")
+	}
+	if u.Mode != UpsampleNearest && u.Mode != UpsampleBilinear {
+		return Shape{}, fmt.Errorf("unknown upsampling mode: %d", u.Mode)
+	}
+	return Shape{Height: in.Height * u.Scale, Width: in.Width * u.Scale, Depth: in.Depth}, nil
+}
+
+// InputRegion computes the input pixels that the output
+// region is computed from.
+func (u *Upsample) InputRegion(out image.Rectangle) image.Rectangle {
+	if out.Empty() {
+		return image.Rectangle{}
+	}
+	if u.Mode == UpsampleNearest {
+		return image.Rectangle{
+			Min: image.Pt(floorDiv(out.Min.X, u.Scale), floorDiv(out.Min.Y, u.Scale)),
+			Max: image.Pt(floorDiv(out.Max.X-1, u.Scale)+1, floorDiv(out.Max.Y-1, u.Scale)+1),
+		}
+	}
+	// Output coordinate i interpolates between the input
+	// coordinate floor((2*i+1-scale)/(2*scale)) and the
+	// next one.
+	src := func(i int) int {
+		return floorDiv(2*i+1-u.Scale, 2*u.Scale)
+	}
+	return image.Rectangle{
+		Min: image.Pt(src(out.Min.X), src(out.Min.Y)),
+		Max: image.Pt(src(out.Max.X-1)+2, src(out.Max.Y-1)+2),
+	}
+}
+
+// lerpPixels computes dst = x + frac*(y-x), where dst may
+// be x.
+//
+// The product is rounded explicitly so that it cannot be
+// fused with the addition, which would make the result
+// depend on the CPU.
+func lerpPixels(x, y []float32, frac float32, dst []float32) {
+	for i, a := range x {
+		dst[i] = a + float32(frac*(y[i]-a))
+	}
+}
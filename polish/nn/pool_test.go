@@ -0,0 +1,64 @@
+package nn
+
+import (
+	"image"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	in := NewTensor(3, 5, 2)
+	for i := range in.Data {
+		in.Data[i] = float32(i%7) - float32(i%3)
+	}
+	for _, layer := range []Layer{&MaxPool{Size: 2}, &AvgPool{Size: 2}} {
+		actual := layer.Apply(in)
+		if actual.Shape() != (Shape{Height: 1, Width: 2, Depth: 2}) {
+			t.Fatalf("%T: unexpected shape %v", layer, actual.Shape())
+		}
+		for x := 0; x < 2; x++ {
+			for z := 0; z < 2; z++ {
+				var max, sum float32
+				for i, p := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+					v := *in.At(p.Y, 2*x+p.X, z)
+					if i == 0 || v > max {
+						max = v
+					}
+					sum += v
+				}
+				expected := max
+				if _, ok := layer.(*AvgPool); ok {
+					expected = sum / 4
+				}
+				if a := *actual.At(0, x, z); a != expected {
+					t.Errorf("%T: expected %f but got %f at (%d, %d)", layer, expected, a, x, z)
+				}
+			}
+		}
+	}
+}
+
+func TestUpsample(t *testing.T) {
+	in := NewTensor(2, 2, 1)
+	copy(in.Data, []float32{1, 2, 3, 4})
+
+	nearest := (&Upsample{Scale: 2}).Apply(in)
+	expected := NewTensor(4, 4, 1)
+	copy(expected.Data, []float32{
+		1, 1, 2, 2,
+		1, 1, 2, 2,
+		3, 3, 4, 4,
+		3, 3, 4, 4,
+	})
+	checkTensorsClose(t, expected, nearest, 0)
+
+	// Output of PyTorch's bilinear Upsample with
+	// align_corners=False.
+	bilinear := (&Upsample{Scale: 2, Mode: UpsampleBilinear}).Apply(in)
+	copy(expected.Data, []float32{
+		1, 1.25, 1.75, 2,
+		1.5, 1.75, 2.25, 2.5,
+		2.5, 2.75, 3.25, 3.5,
+		3, 3.25, 3.75, 4,
+	})
+	checkTensorsClose(t, expected, bilinear, 1e-6)
+}
@@ -0,0 +1,514 @@
+package nn
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// QuantFormat is a number format for the weights of a
+// quantized layer.
+type QuantFormat int
+
+const (
+	// QuantInt8 stores weights as 8-bit integers with a
+	// scale per output channel.
+	//
+	// Inputs are also converted to 8-bit integers, using
+	// a scale per input channel which is calibrated on
+	// sample inputs, and products are accumulated exactly
+	// in 32-bit integers.
+	QuantInt8 QuantFormat = iota
+
+	// QuantFloat16 stores weights as IEEE half-precision
+	// floats.
+	//
+	// Inputs are rounded to half precision as well, and
+	// every product and sum is rounded to half precision,
+	// like a half-precision multiply-accumulate. Since Go
+	// has no half-precision arithmetic, this is emulated
+	// with float32 operations, so it is slower than the
+	// floating-point layers.
+	QuantFloat16
+)
+
+// QuantizedWeights stores the weights of a quantized layer
+// in the same order as the weights of the corresponding
+// floating-point layer.
+type QuantizedWeights struct {
+	Format QuantFormat
+
+	// Int8 stores the weights for QuantInt8.
+	Int8 []int8
+
+	// Scales stores the scale of each output channel for
+	// QuantInt8.
+	//
+	// Each weight, multiplied by the scale of its input
+	// channel, is approximately the quantized value times
+	// the scale of its output channel.
+	Scales []float32
+
+	// Float16 stores the bits of the weights for
+	// QuantFloat16.
+	Float16 []uint16
+}
+
+// Len gets the number of weights.
+func (q *QuantizedWeights) Len() int {
+	if q.Format == QuantFloat16 {
+		return len(q.Float16)
+	}
+	return len(q.Int8)
+}
+
+// Float32 decodes the weights for QuantFloat16.
+func (q *QuantizedWeights) Float32() []float32 {
+	res := make([]float32, len(q.Float16))
+	for i, x := range q.Float16 {
+		res[i] = halfToFloat32(x)
+	}
+	return res
+}
+
+// check verifies that the weights are well-formed for a
+// layer with the given number of weights and output
+// channels.
+func (q *QuantizedWeights) check(numWeights, outDepth, inDepth int,
+	inputScales []float32) error {
+	if q.Len() != numWeights {
+		return errors.Errorf("expected %d weights but got %d", numWeights, q.Len())
+	}
+	switch q.Format {
+	case QuantInt8:
+		if len(q.Scales) != outDepth {
+			return errors.Errorf("expected %d weight scales but got %d", outDepth,
+				len(q.Scales))
+		}
+		if len(inputScales) != inDepth {
+			return errors.Errorf("expected %d input scales but got %d", inDepth,
+				len(inputScales))
+		}
+	case QuantFloat16:
+	default:
+		return errors.Errorf("unknown quantization format: %d", q.Format)
+	}
+	return nil
+}
+
+// Quantize creates a network like l, but with every Conv,
+// SpatialConv, and Deconv replaced by a quantized layer.
+//
+// For QuantInt8, the network is applied to the samples to
+// find the range of the inputs to every layer, which
+// determines the input scales. Inputs outside of this
+// range are clipped. The samples are not needed for
+// QuantFloat16.
+//
+// The biases and activations of the layers are kept in
+// float32, as are all the other layers.
+func Quantize(l Layer, format QuantFormat, samples []*Tensor) (Layer, error) {
+	if format != QuantInt8 && format != QuantFloat16 {
+		return nil, errors.Errorf("unknown quantization format: %d", format)
+	}
+	ranges := map[Layer][]float32{}
+	if format == QuantInt8 {
+		if len(samples) == 0 {
+			return nil, errors.New("quantize: int8 requires calibration samples")
+		}
+		for _, sample := range samples {
+			if _, err := OutputShape(l, sample.Shape()); err != nil {
+				return nil, errors.Wrap(err, "quantize")
+			}
+			calibrate(l, sample, ranges)
+		}
+	}
+	return quantizeLayer(l, format, ranges), nil
+}
+
+// calibrate applies l to t while recording the largest
+// absolute value of every input channel of the layers
+// which will be quantized.
+func calibrate(l Layer, t *Tensor, ranges map[Layer][]float32) *Tensor {
+	switch l := l.(type) {
+	case NN:
+		for _, subLayer := range l {
+			t = calibrate(subLayer, t, ranges)
+		}
+		return t
+	case Residual:
+		return addTensors(t, calibrate(NN(l), t, ranges))
+	case *Graph:
+		res, _ := l.evaluate(t, nil, func(l Layer, t *Tensor, path []int) (*Tensor, error) {
+			return calibrate(l, t, ranges), nil
+		})
+		return res
+	case *Conv, *SpatialConv, *Deconv:
+		maxAbs, ok := ranges[l]
+		if !ok {
+			maxAbs = make([]float32, t.Depth)
+			ranges[l] = maxAbs
+		}
+		for i, x := range t.Contiguous().Data {
+			z := i % t.Depth
+			if x > maxAbs[z] {
+				maxAbs[z] = x
+			} else if -x > maxAbs[z] {
+				maxAbs[z] = -x
+			}
+		}
+	}
+	return l.Apply(t)
+}
+
+func quantizeLayer(l Layer, format QuantFormat, ranges map[Layer][]float32) Layer {
+	switch l := l.(type) {
+	case NN:
+		res := make(NN, len(l))
+		for i, subLayer := range l {
+			res[i] = quantizeLayer(subLayer, format, ranges)
+		}
+		return res
+	case Residual:
+		res := make(Residual, len(l))
+		for i, subLayer := range l {
+			res[i] = quantizeLayer(subLayer, format, ranges)
+		}
+		return res
+	case *Graph:
+		return l.mapLayers(func(l Layer) Layer {
+			return quantizeLayer(l, format, ranges)
+		})
+	case *Conv:
+		inScales := inputScales(ranges[l])
+		taps := l.KernelSize * l.KernelSize
+		groupIn, groupOut := l.InDepth/l.groups(), l.OutDepth/l.groups()
+		outChannel := func(idx int) int {
+			return idx / (taps * groupIn)
+		}
+		inChannel := func(idx int) int {
+			return (outChannel(idx)/groupOut)*groupIn + (idx/taps)%groupIn
+		}
+		return &QuantizedConv{
+			OutDepth:    l.OutDepth,
+			InDepth:     l.InDepth,
+			KernelSize:  l.KernelSize,
+			Stride:      l.Stride,
+			Groups:      l.Groups,
+			Dilation:    l.Dilation,
+			Weights:     quantizeWeights(format, l.Weights, inScales, l.OutDepth, inChannel, outChannel),
+			InputScales: inScales,
+			Padding:     l.Padding,
+			Bias:        l.Bias,
+			ReLU:        l.ReLU,
+		}
+	case *SpatialConv:
+		inScales := inputScales(ranges[l])
+		taps := l.KernelSize * l.KernelSize
+		channel := func(idx int) int {
+			return idx / taps
+		}
+		return &QuantizedSpatialConv{
+			Depth:       l.Depth,
+			KernelSize:  l.KernelSize,
+			Stride:      l.Stride,
+			Dilation:    l.Dilation,
+			Weights:     quantizeWeights(format, l.Weights, inScales, l.Depth, channel, channel),
+			InputScales: inScales,
+			Padding:     l.Padding,
+			Bias:        l.Bias,
+			ReLU:        l.ReLU,
+		}
+	case *Deconv:
+		inScales := inputScales(ranges[l])
+		taps := l.KernelSize * l.KernelSize
+		inChannel := func(idx int) int {
+			return idx / (taps * l.OutDepth)
+		}
+		outChannel := func(idx int) int {
+			return (idx / taps) % l.OutDepth
+		}
+		return &QuantizedDeconv{
+			OutDepth:    l.OutDepth,
+			InDepth:     l.InDepth,
+			KernelSize:  l.KernelSize,
+			Stride:      l.Stride,
+			Weights:     quantizeWeights(format, l.Weights, inScales, l.OutDepth, inChannel, outChannel),
+			InputScales: inScales,
+		}
+	default:
+		return l
+	}
+}
+
+// inputScales computes the scale of each input channel
+// from the largest absolute value of the channel, or
+// returns nil if there are no calibration results.
+func inputScales(maxAbs []float32) []float32 {
+	if maxAbs == nil {
+		return nil
+	}
+	res := make([]float32, len(maxAbs))
+	for i, x := range maxAbs {
+		res[i] = x / math.MaxInt8
+	}
+	return res
+}
+
+// quantizeWeights quantizes the weights of a layer,
+// where inChannel and outChannel find the input and output
+// channel of each weight.
+func quantizeWeights(format QuantFormat, weights, inScales []float32, outDepth int,
+	inChannel, outChannel func(idx int) int) QuantizedWeights {
+	if format == QuantFloat16 {
+		res := make([]uint16, len(weights))
+		for i, w := range weights {
+			res[i] = float32ToHalf(w)
+		}
+		return QuantizedWeights{Format: format, Float16: res}
+	}
+
+	// Fold the input scales into the weights, since the
+	// inputs are divided by them.
+	folded := make([]float32, len(weights))
+	scales := make([]float32, outDepth)
+	for i, w := range weights {
+		folded[i] = w * inScales[inChannel(i)]
+		o := outChannel(i)
+		scales[o] = float32(math.Max(float64(scales[o]), math.Abs(float64(folded[i]))))
+	}
+	for i := range scales {
+		scales[i] /= math.MaxInt8
+	}
+	res := make([]int8, len(weights))
+	for i, w := range folded {
+		res[i] = quantizeInt8(w, invScale(scales[outChannel(i)]))
+	}
+	return QuantizedWeights{Format: format, Int8: res, Scales: scales}
+}
+
+func invScale(scale float32) float32 {
+	if scale == 0 {
+		return 0
+	}
+	return 1 / scale
+}
+
+// quantizeInt8 rounds x*invScale to the nearest integer,
+// with ties rounded away from zero, and clips it to the
+// range of an int8.
+func quantizeInt8(x, invScale float32) int8 {
+	q := float32(x * invScale)
+	if q >= math.MaxInt8 {
+		return math.MaxInt8
+	} else if q <= -math.MaxInt8 {
+		return -math.MaxInt8
+	} else if q < 0 {
+		return int8(q - 0.5)
+	}
+	return int8(q + 0.5)
+}
+
+// quantizeChannels quantizes data whose channels are
+// interleaved with the given inverse scales.
+func quantizeChannels(data, invScales []float32, dst []int8) {
+	depth := len(invScales)
+	for i := 0; i < len(data); i += depth {
+		pixel := data[i : i+depth]
+		dstPixel := dst[i : i+depth]
+		for z, x := range pixel {
+			dstPixel[z] = quantizeInt8(x, invScales[z])
+		}
+	}
+}
+
+func invScales(scales []float32) []float32 {
+	res := make([]float32, len(scales))
+	for i, s := range scales {
+		res[i] = invScale(s)
+	}
+	return res
+}
+
+// gemmInt8 computes c += a*b like gemm, using exact
+// integer arithmetic.
+func gemmInt8(m, n, k int, a, b []int8, c []int32) {
+	for i := 0; i < m; i++ {
+		cRow := c[i*n : (i+1)*n]
+		for j, x := range a[i*k : (i+1)*k] {
+			if x == 0 {
+				continue
+			}
+			axpyInt8(int32(x), b[j*n:(j+1)*n], cRow)
+		}
+	}
+}
+
+// gemmHalf computes c += a*b like gemm, where b stores the
+// bits of half-precision floats.
+//
+// Every product and sum is rounded to half precision, and
+// the products are added to each element of c in order,
+// so the result does not depend on the CPU.
+func gemmHalf(m, n, k int, a []float32, b []uint16, c []float32) {
+	bRow := make([]float32, n)
+	for j := 0; j < k; j++ {
+		decodeHalf(b[j*n:(j+1)*n], bRow)
+		for i := 0; i < m; i++ {
+			x := a[i*k+j]
+			if x == 0 {
+				continue
+			}
+			cRow := c[i*n : (i+1)*n]
+			for l, w := range bRow {
+				cRow[l] = roundToHalf(cRow[l] + roundToHalf(x*w))
+			}
+		}
+	}
+}
+
+// halfEpilogue is like convEpilogue, but it adds the
+// biases with half-precision rounding.
+func halfEpilogue(data, bias []float32, relu bool) {
+	if bias != nil {
+		for i := 0; i < len(data); i += len(bias) {
+			pixel := data[i : i+len(bias)]
+			for z, b := range bias {
+				pixel[z] = roundToHalf(pixel[z] + roundToHalf(b))
+			}
+		}
+	}
+	convEpilogue(data, nil, relu)
+}
+
+// roundHalf creates a copy of t with every value rounded
+// to half precision.
+func roundHalf(t *Tensor) *Tensor {
+	res := copyTensor(t)
+	roundHalfSlice(res.Data)
+	return res
+}
+
+// roundHalfSlice rounds every value of a slice to half
+// precision in place.
+func roundHalfSlice(data []float32) {
+	for i, x := range data {
+		data[i] = roundToHalf(x)
+	}
+}
+
+// roundToHalf rounds a float32 to the nearest
+// half-precision float, like float32ToHalf followed by
+// halfToFloat32, but without converting between formats.
+//
+// The float32 sum or product of two half-precision floats
+// has enough precision that rounding it to half precision
+// gives the correctly rounded half-precision result.
+func roundToHalf(x float32) float32 {
+	// Most values are in the normal range of
+	// half-precision floats.
+	bits := math.Float32bits(x)
+	if (bits&^0x80000000)-0x38800000 <= 0x477fe000-0x38800000 {
+		// Round the mantissa to 10 bits, with ties to even.
+		bits += 0xfff + (bits>>13)&1
+		return math.Float32frombits(bits &^ 0x1fff)
+	}
+	return roundToHalfSpecial(x)
+}
+
+// roundToHalfSpecial is like roundToHalf for values that
+// are too large or too small for normal half-precision
+// floats.
+func roundToHalfSpecial(x float32) float32 {
+	bits := math.Float32bits(x)
+	sign := bits & 0x80000000
+	abs := bits &^ 0x80000000
+	if abs >= 0x7f800000 {
+		// Infinity or NaN.
+		return x
+	} else if abs > 0x477fe000 {
+		// Values at least halfway from the largest
+		// half-precision float to 65536 round to infinity.
+		if abs >= 0x477ff000 {
+			return math.Float32frombits(sign | 0x7f800000)
+		}
+		return math.Float32frombits(sign | 0x477fe000)
+	}
+	// The value is subnormal in half precision, so it is
+	// rounded to a multiple of 2^-24, which is the spacing
+	// of float32 values just above 0.5.
+	rounded := (math.Float32frombits(abs) + 0.5) - 0.5
+	return math.Float32frombits(sign | math.Float32bits(rounded))
+}
+
+// decodeHalf converts the bits of half-precision floats
+// to float32 values in dst.
+func decodeHalf(src []uint16, dst []float32) {
+	for i, x := range src {
+		dst[i] = halfToFloat32(x)
+	}
+}
+
+// float32ToHalf converts a float32 to the bits of the
+// nearest IEEE half-precision float, rounding to even.
+func float32ToHalf(x float32) uint16 {
+	bits := math.Float32bits(x)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits >> 23) & 0xff)
+	mantissa := bits & 0x7fffff
+
+	if exp == 0xff {
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+	exp = exp - 127 + 15
+	if exp >= 0x1f {
+		return sign | 0x7c00
+	}
+	if exp <= 0 {
+		if exp < -10 {
+			return sign
+		}
+		// Subnormal: shift the mantissa, including the
+		// implicit leading one.
+		mantissa |= 0x800000
+		shift := uint(14 - exp)
+		half := uint32(1) << (shift - 1)
+		rounded := mantissa >> shift
+		rest := mantissa & ((1 << shift) - 1)
+		if rest > half || (rest == half && rounded&1 == 1) {
+			rounded++
+		}
+		return sign | uint16(rounded)
+	}
+	rounded := uint32(exp)<<10 | mantissa>>13
+	rest := mantissa & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && rounded&1 == 1) {
+		// This may carry into the exponent, and even round
+		// up to infinity, which is correct.
+		rounded++
+	}
+	return sign | uint16(rounded)
+}
+
+// halfToFloat32 converts the bits of an IEEE
+// half-precision float to a float32.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mantissa := uint32(h & 0x3ff)
+	switch exp {
+	case 0:
+		// Zero or subnormal.
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			value = -value
+		}
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mantissa<<13)
+}
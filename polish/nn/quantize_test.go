@@ -0,0 +1,134 @@
+package nn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHalfConversion(t *testing.T) {
+	for _, x := range []float32{0, 1, -1, 0.5, 65504, -2.5, 6.1035156e-05, 5.9604645e-08,
+		float32(math.Inf(1))} {
+		if actual := halfToFloat32(float32ToHalf(x)); actual != x {
+			t.Errorf("expected %g but got %g", x, actual)
+		}
+	}
+	for x, expected := range map[float32]float32{
+		1 + 1.0/4096:  1,
+		1 + 1.0/2048:  1,
+		1 + 3.0/4096:  1 + 1.0/1024,
+		70000:         float32(math.Inf(1)),
+		1e-9:          0,
+		0.1:           0.099975586,
+		-3.0000001e-8: -5.9604645e-08,
+	} {
+		if actual := halfToFloat32(float32ToHalf(x)); actual != expected {
+			t.Errorf("%g: expected %g but got %g", x, expected, actual)
+		}
+	}
+	if !math.IsNaN(float64(halfToFloat32(float32ToHalf(float32(math.NaN()))))) {
+		t.Error("expected NaN")
+	}
+
+	// roundToHalf matches the conversions.
+	values := []float32{65504, 65519, 65520, 6.1035156e-05, 6.1e-05, 2.9802322e-08,
+		8.940697e-08, float32(math.Inf(-1)), float32(math.NaN())}
+	for i := 0; i < 100000; i++ {
+		values = append(values, math.Float32frombits(rand.Uint32()))
+	}
+	for _, x := range values {
+		expected := halfToFloat32(float32ToHalf(x))
+		actual := roundToHalf(x)
+		if math.Float32bits(actual) != math.Float32bits(expected) &&
+			!(math.IsNaN(float64(actual)) && math.IsNaN(float64(expected))) {
+			t.Errorf("roundToHalf(%g): expected %g but got %g", x, expected, actual)
+		}
+	}
+}
+
+func TestQuantizeFloat16Accumulation(t *testing.T) {
+	// In half precision, 2048+1 rounds to 2048, so the
+	// small values are lost.
+	in := NewTensor(1, 3, 1)
+	copy(in.Data, []float32{2048, 1, 1})
+	for _, layer := range []Layer{
+		&Conv{InDepth: 1, OutDepth: 1, KernelSize: 3, Stride: 1, Weights: []float32{
+			0, 0, 0, 1, 1, 1, 0, 0, 0}, Padding: *NewPad(1, 0, 1, 0)},
+		&SpatialConv{Depth: 1, KernelSize: 3, Stride: 1, Weights: []float32{
+			0, 0, 0, 1, 1, 1, 0, 0, 0}, Padding: *NewPad(1, 0, 1, 0)},
+	} {
+		if actual := layer.Apply(in).Data[0]; actual != 2050 {
+			t.Fatalf("expected float32 result 2050 but got %f", actual)
+		}
+		quantized, err := Quantize(layer, QuantFloat16, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := quantized.Apply(in).Data[0]; actual != 2048 {
+			t.Errorf("%T: expected 2048 but got %f", layer, actual)
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	network := NN{
+		&Conv{InDepth: 3, OutDepth: 16, KernelSize: 3, Stride: 2, Weights: randomVector(3 * 16 * 9),
+			Padding: *NewPad(1, 1, 1, 1), Bias: randomVector(16), ReLU: true},
+		Residual{
+			&SpatialConv{Depth: 16, KernelSize: 3, Stride: 1, Dilation: 2,
+				Weights: randomVector(16 * 9), Padding: *NewPad(2, 2, 2, 2), ReLU: true},
+			&Conv{InDepth: 16, OutDepth: 16, KernelSize: 3, Stride: 1, Groups: 4, Dilation: 2,
+				Weights: randomVector(16 * 4 * 9), Padding: *NewPad(2, 2, 2, 2), ReLU: true},
+			&Conv{InDepth: 16, OutDepth: 16, KernelSize: 1, Stride: 1,
+				Weights: randomVector(16 * 16)},
+		},
+		&Deconv{InDepth: 16, OutDepth: 3, KernelSize: 4, Stride: 2,
+			Weights: randomVector(16 * 3 * 16)},
+	}
+	var samples []*Tensor
+	for i := 0; i < 4; i++ {
+		sample := NewTensor(16, 16, 3)
+		copy(sample.Data, randomVector(len(sample.Data)))
+		samples = append(samples, sample)
+	}
+	in := NewTensor(10, 8, 3)
+	copy(in.Data, randomVector(len(in.Data)))
+	expected := network.Apply(in)
+
+	// Include the input in the calibration set, so that its
+	// values are not clipped.
+	samples = append(samples, in)
+
+	for _, format := range []QuantFormat{QuantInt8, QuantFloat16} {
+		quantized, err := Quantize(network, format, samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := quantized.Apply(in)
+		if actual.Shape() != expected.Shape() {
+			t.Fatalf("expected shape %v but got %v", expected.Shape(), actual.Shape())
+		}
+		var errSum, sum float64
+		for i, x := range expected.Data {
+			errSum += math.Pow(float64(x-actual.Data[i]), 2)
+			sum += math.Pow(float64(x), 2)
+		}
+		if relErr := math.Sqrt(errSum / sum); relErr > 0.05 {
+			t.Errorf("format %d: relative error %f is too large", format, relErr)
+		}
+
+		plan, err := NewPlan(quantized, in.Shape())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTensorsClose(t, actual, plan.Apply(in), 0)
+		rf, err := ReceptiveField(quantized)
+		if expectedRF, _ := ReceptiveField(network); err != nil || rf != expectedRF {
+			t.Errorf("expected receptive field %d but got %d (%v)", expectedRF, rf, err)
+		}
+	}
+
+	if _, err := Quantize(network, QuantInt8, nil); err == nil {
+		t.Error("expected error without calibration samples")
+	}
+}
@@ -0,0 +1,593 @@
+package nn
+
+import (
+	"image"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// QuantizedConv is a Conv with quantized weights, as
+// created by Quantize.
+type QuantizedConv struct {
+	OutDepth   int
+	InDepth    int
+	KernelSize int
+	Stride     int
+	Groups     int
+	Dilation   int
+	Weights    QuantizedWeights
+
+	// InputScales is the scale of every input channel for
+	// QuantInt8.
+	InputScales []float32
+
+	Padding Pad
+	Bias    []float32
+	ReLU    bool
+
+	prepareOnce sync.Once
+	matrix      []int8
+	halfMatrix  []uint16
+	invScales   []float32
+}
+
+// Apply applies the convolution to a Tensor.
+func (q *QuantizedConv) Apply(t *Tensor) *Tensor {
+	out, err := q.OutputShape(t.Shape())
+	if err != nil {
+		panic(err)
+	}
+	res := NewTensor(out.Height, out.Width, out.Depth)
+	q.ApplyTo(t, res)
+	return res
+}
+
+// ApplyTo applies the convolution and writes the result
+// to out.
+func (q *QuantizedConv) ApplyTo(t, out *Tensor) {
+	if err := q.Check(t); err != nil {
+		panic(err)
+	}
+	q.prepareOnce.Do(q.prepare)
+	if q.Weights.Format == QuantFloat16 {
+		q.applyHalf(t, out)
+		return
+	}
+
+	outH, outW := out.Height, out.Width
+	groups := essentials.MaxInt(q.Groups, 1)
+	dilation := essentials.MaxInt(q.Dilation, 1)
+	groupIn, groupOut := q.InDepth/groups, q.OutDepth/groups
+	patchSize := q.KernelSize * q.KernelSize * groupIn
+	outRowSize := outW * q.OutDepth
+	interleaveRows(outH, func(start, stride int) {
+		patches := make([]float32, outW*patchSize)
+		quantized := make([]int8, outW*patchSize)
+		sums := make([]int32, outRowSize)
+		products := sums
+		if groups > 1 {
+			products = make([]int32, outW*groupOut)
+		}
+		for y := start; y < outH; y += stride {
+			for g := 0; g < groups; g++ {
+				in := t
+				if groups > 1 {
+					in = t.Channels(g*groupIn, (g+1)*groupIn)
+				}
+				im2colRow(in, patches, q.KernelSize, q.Stride, dilation, &q.Padding, y, outW)
+				quantizeChannels(patches, q.invScales[g*groupIn:(g+1)*groupIn], quantized)
+				for i := range products {
+					products[i] = 0
+				}
+				matrix := q.matrix[g*patchSize*groupOut : (g+1)*patchSize*groupOut]
+				gemmInt8(outW, groupOut, patchSize, quantized, matrix, products)
+				if groups > 1 {
+					for x := 0; x < outW; x++ {
+						outIdx := x*q.OutDepth + g*groupOut
+						copy(sums[outIdx:outIdx+groupOut], products[x*groupOut:(x+1)*groupOut])
+					}
+				}
+			}
+			outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+			dequantizeRow(sums, q.Weights.Scales, outRow)
+			convEpilogue(outRow, q.Bias, q.ReLU)
+		}
+	})
+}
+
+// applyHalf is like ApplyTo for QuantFloat16, using the
+// same patches as the int8 path.
+func (q *QuantizedConv) applyHalf(t, out *Tensor) {
+	outH, outW := out.Height, out.Width
+	groups := essentials.MaxInt(q.Groups, 1)
+	dilation := essentials.MaxInt(q.Dilation, 1)
+	groupIn, groupOut := q.InDepth/groups, q.OutDepth/groups
+	patchSize := q.KernelSize * q.KernelSize * groupIn
+	outRowSize := outW * q.OutDepth
+	interleaveRows(outH, func(start, stride int) {
+		patches := make([]float32, outW*patchSize)
+		products := make([]float32, outW*groupOut)
+		for y := start; y < outH; y += stride {
+			outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+			for g := 0; g < groups; g++ {
+				in := t
+				if groups > 1 {
+					in = t.Channels(g*groupIn, (g+1)*groupIn)
+				}
+				im2colRow(in, patches, q.KernelSize, q.Stride, dilation, &q.Padding, y, outW)
+				roundHalfSlice(patches)
+				for i := range products {
+					products[i] = 0
+				}
+				matrix := q.halfMatrix[g*patchSize*groupOut : (g+1)*patchSize*groupOut]
+				gemmHalf(outW, groupOut, patchSize, patches, matrix, products)
+				for x := 0; x < outW; x++ {
+					outIdx := x*q.OutDepth + g*groupOut
+					copy(outRow[outIdx:outIdx+groupOut], products[x*groupOut:(x+1)*groupOut])
+				}
+			}
+			halfEpilogue(outRow, q.Bias, q.ReLU)
+		}
+	})
+}
+
+// Check verifies that the Tensor has the correct number
+// of channels and is at least as large as the kernel.
+func (q *QuantizedConv) Check(t *Tensor) error {
+	_, err := q.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape of the convolution's
+// output.
+func (q *QuantizedConv) OutputShape(in Shape) (Shape, error) {
+	floatLayer := q.floatLayer(nil)
+	if _, err := floatLayer.OutputShape(in); err != nil {
+		return Shape{}, err
+	}
+	numWeights := q.OutDepth * q.InDepth / floatLayer.groups() * q.KernelSize * q.KernelSize
+	if err := q.Weights.check(numWeights, q.OutDepth, q.InDepth, q.InputScales); err != nil {
+		return Shape{}, err
+	}
+	return floatLayer.OutputShape(in)
+}
+
+// InputRegion computes the input pixels that the output
+// region depends on.
+func (q *QuantizedConv) InputRegion(out image.Rectangle) image.Rectangle {
+	return q.floatLayer(nil).InputRegion(out)
+}
+
+func (q *QuantizedConv) floatLayer(weights []float32) *Conv {
+	return &Conv{
+		OutDepth:   q.OutDepth,
+		InDepth:    q.InDepth,
+		KernelSize: q.KernelSize,
+		Stride:     q.Stride,
+		Groups:     q.Groups,
+		Dilation:   q.Dilation,
+		Weights:    weights,
+		Padding:    q.Padding,
+		Bias:       q.Bias,
+		ReLU:       q.ReLU,
+	}
+}
+
+func (q *QuantizedConv) prepare() {
+	// Rearrange the weights like Conv.weightMatrix.
+	groups := essentials.MaxInt(q.Groups, 1)
+	groupIn, groupOut := q.InDepth/groups, q.OutDepth/groups
+	featureStride := q.KernelSize * q.KernelSize * groupIn
+	half := q.Weights.Format == QuantFloat16
+	if half {
+		q.halfMatrix = make([]uint16, featureStride*q.OutDepth)
+	} else {
+		q.invScales = invScales(q.InputScales)
+		q.matrix = make([]int8, featureStride*q.OutDepth)
+	}
+	for i := 0; i < q.OutDepth; i++ {
+		featureStart := i * featureStride
+		matrixStart := (i / groupOut) * featureStride * groupOut
+		var row int
+		for y := 0; y < q.KernelSize; y++ {
+			for x := 0; x < q.KernelSize; x++ {
+				for z := 0; z < groupIn; z++ {
+					src := featureStart + (y+z*q.KernelSize)*q.KernelSize + x
+					dst := matrixStart + row*groupOut + i%groupOut
+					if half {
+						q.halfMatrix[dst] = q.Weights.Float16[src]
+					} else {
+						q.matrix[dst] = q.Weights.Int8[src]
+					}
+					row++
+				}
+			}
+		}
+	}
+}
+
+// QuantizedSpatialConv is a SpatialConv with quantized
+// weights, as created by Quantize.
+type QuantizedSpatialConv struct {
+	Depth      int
+	KernelSize int
+	Stride     int
+	Dilation   int
+	Weights    QuantizedWeights
+
+	// InputScales is the scale of every input channel for
+	// QuantInt8.
+	InputScales []float32
+
+	Padding Pad
+	Bias    []float32
+	ReLU    bool
+
+	prepareOnce sync.Once
+	taps        []int8
+	halfTaps    []uint16
+	invScales   []float32
+}
+
+// Apply applies the convolution to a Tensor.
+func (q *QuantizedSpatialConv) Apply(t *Tensor) *Tensor {
+	out, err := q.OutputShape(t.Shape())
+	if err != nil {
+		panic(err)
+	}
+	res := NewTensor(out.Height, out.Width, out.Depth)
+	q.ApplyTo(t, res)
+	return res
+}
+
+// ApplyTo applies the convolution and writes the result
+// to out.
+func (q *QuantizedSpatialConv) ApplyTo(t, out *Tensor) {
+	if err := q.Check(t); err != nil {
+		panic(err)
+	}
+	q.prepareOnce.Do(q.prepare)
+	if q.Weights.Format == QuantFloat16 {
+		q.applyHalf(t, out)
+		return
+	}
+
+	t = t.Contiguous()
+	in := make([]int8, len(t.Data))
+	quantizeChannels(t.Data, q.invScales, in)
+
+	dilation := essentials.MaxInt(q.Dilation, 1)
+	outH, outW := out.Height, out.Width
+	outRowSize := outW * q.Depth
+	interleaveRows(outH, func(start, stride int) {
+		products := make([]int32, outRowSize)
+		for y := start; y < outH; y += stride {
+			for i := range products {
+				products[i] = 0
+			}
+			for x := 0; x < outW; x++ {
+				pixel := products[x*q.Depth : (x+1)*q.Depth]
+				for subY := 0; subY < q.KernelSize; subY++ {
+					inY := y*q.Stride + subY*dilation - q.Padding.Top
+					if inY < 0 || inY >= t.Height {
+						continue
+					}
+					for subX := 0; subX < q.KernelSize; subX++ {
+						inX := x*q.Stride + subX*dilation - q.Padding.Left
+						if inX < 0 || inX >= t.Width {
+							continue
+						}
+						inIdx := (inY*t.Width + inX) * q.Depth
+						inPixel := in[inIdx : inIdx+q.Depth]
+						tapIdx := (subY*q.KernelSize + subX) * q.Depth
+						tap := q.taps[tapIdx : tapIdx+q.Depth]
+						for z, w := range tap {
+							pixel[z] += int32(w) * int32(inPixel[z])
+						}
+					}
+				}
+			}
+			outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+			dequantizeRow(products, q.Weights.Scales, outRow)
+			convEpilogue(outRow, q.Bias, q.ReLU)
+		}
+	})
+}
+
+// applyHalf is like ApplyTo for QuantFloat16.
+func (q *QuantizedSpatialConv) applyHalf(t, out *Tensor) {
+	in := roundHalf(t)
+	dilation := essentials.MaxInt(q.Dilation, 1)
+	outH, outW := out.Height, out.Width
+	outRowSize := outW * q.Depth
+	interleaveRows(outH, func(start, stride int) {
+		tap := make([]float32, q.Depth)
+		for y := start; y < outH; y += stride {
+			outRow := out.Data[y*outRowSize : (y+1)*outRowSize]
+			for i := range outRow {
+				outRow[i] = 0
+			}
+			for x := 0; x < outW; x++ {
+				pixel := outRow[x*q.Depth : (x+1)*q.Depth]
+				for subY := 0; subY < q.KernelSize; subY++ {
+					inY := y*q.Stride + subY*dilation - q.Padding.Top
+					if inY < 0 || inY >= in.Height {
+						continue
+					}
+					for subX := 0; subX < q.KernelSize; subX++ {
+						inX := x*q.Stride + subX*dilation - q.Padding.Left
+						if inX < 0 || inX >= in.Width {
+							continue
+						}
+						inIdx := (inY*in.Width + inX) * q.Depth
+						inPixel := in.Data[inIdx : inIdx+q.Depth]
+						tapIdx := (subY*q.KernelSize + subX) * q.Depth
+						decodeHalf(q.halfTaps[tapIdx:tapIdx+q.Depth], tap)
+						for z, w := range tap {
+							pixel[z] = roundToHalf(pixel[z] + roundToHalf(w*inPixel[z]))
+						}
+					}
+				}
+			}
+			halfEpilogue(outRow, q.Bias, q.ReLU)
+		}
+	})
+}
+
+// Check verifies that the Tensor has the correct number
+// of channels and is at least as large as the kernel.
+func (q *QuantizedSpatialConv) Check(t *Tensor) error {
+	_, err := q.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape of the convolution's
+// output.
+func (q *QuantizedSpatialConv) OutputShape(in Shape) (Shape, error) {
+	numWeights := q.Depth * q.KernelSize * q.KernelSize
+	if err := q.Weights.check(numWeights, q.Depth, q.Depth, q.InputScales); err != nil {
+		return Shape{}, err
+	}
+	return q.floatLayer(nil).OutputShape(in)
+}
+
+// InputRegion computes the input pixels that the output
+// region depends on.
+func (q *QuantizedSpatialConv) InputRegion(out image.Rectangle) image.Rectangle {
+	return q.floatLayer(nil).InputRegion(out)
+}
+
+func (q *QuantizedSpatialConv) floatLayer(weights []float32) *SpatialConv {
+	return &SpatialConv{
+		Depth:      q.Depth,
+		KernelSize: q.KernelSize,
+		Stride:     q.Stride,
+		Dilation:   q.Dilation,
+		Weights:    weights,
+		Padding:    q.Padding,
+		Bias:       q.Bias,
+		ReLU:       q.ReLU,
+	}
+}
+
+func (q *QuantizedSpatialConv) prepare() {
+	// Rearrange the weights like SpatialConv.weightTaps.
+	numTaps := q.KernelSize * q.KernelSize
+	if q.Weights.Format == QuantFloat16 {
+		q.halfTaps = make([]uint16, numTaps*q.Depth)
+		for z := 0; z < q.Depth; z++ {
+			for tap := 0; tap < numTaps; tap++ {
+				q.halfTaps[tap*q.Depth+z] = q.Weights.Float16[z*numTaps+tap]
+			}
+		}
+		return
+	}
+	q.taps = make([]int8, numTaps*q.Depth)
+	q.invScales = invScales(q.InputScales)
+	for z := 0; z < q.Depth; z++ {
+		for tap := 0; tap < numTaps; tap++ {
+			q.taps[tap*q.Depth+z] = q.Weights.Int8[z*numTaps+tap]
+		}
+	}
+}
+
+// QuantizedDeconv is a Deconv with quantized weights, as
+// created by Quantize.
+type QuantizedDeconv struct {
+	OutDepth   int
+	InDepth    int
+	KernelSize int
+	Stride     int
+	Weights    QuantizedWeights
+
+	// InputScales is the scale of every input channel for
+	// QuantInt8.
+	InputScales []float32
+
+	prepareOnce sync.Once
+	taps        [][]int8
+	halfTaps    [][]uint16
+	invScales   []float32
+}
+
+// Apply applies the transposed convolution to a Tensor.
+func (q *QuantizedDeconv) Apply(t *Tensor) *Tensor {
+	out, err := q.OutputShape(t.Shape())
+	if err != nil {
+		panic(err)
+	}
+	res := NewTensor(out.Height, out.Width, out.Depth)
+	q.ApplyTo(t, res)
+	return res
+}
+
+// ApplyTo applies the transposed convolution and writes
+// the result to out.
+func (q *QuantizedDeconv) ApplyTo(t, out *Tensor) {
+	if err := q.Check(t); err != nil {
+		panic(err)
+	}
+	q.prepareOnce.Do(q.prepare)
+	if q.Weights.Format == QuantFloat16 {
+		q.applyHalf(t, out)
+		return
+	}
+
+	t = t.Contiguous()
+	in := make([]int8, len(t.Data))
+	quantizeChannels(t.Data, q.invScales, in)
+
+	inRowSize := t.Width * t.Depth
+	outRowSize := out.Width * out.Depth
+	tapRowSize := q.KernelSize * q.OutDepth
+	interleaveRows(out.Height, func(start, stride int) {
+		products := make([]int32, t.Width*tapRowSize)
+		sums := make([]int32, outRowSize)
+		for y := start; y < out.Height; y += stride {
+			for i := range sums {
+				sums[i] = 0
+			}
+			// See Deconv.ApplyTo.
+			for kernelY := y % q.Stride; kernelY < q.KernelSize; kernelY += q.Stride {
+				inY := (y - kernelY) / q.Stride
+				if inY < 0 {
+					break
+				} else if inY >= t.Height {
+					continue
+				}
+				for i := range products {
+					products[i] = 0
+				}
+				gemmInt8(t.Width, tapRowSize, q.InDepth, in[inY*inRowSize:(inY+1)*inRowSize],
+					q.taps[kernelY], products)
+				for inX := 0; inX < t.Width; inX++ {
+					outIdx := inX * q.Stride * q.OutDepth
+					dst := sums[outIdx : outIdx+tapRowSize]
+					for i, x := range products[inX*tapRowSize : (inX+1)*tapRowSize] {
+						dst[i] += x
+					}
+				}
+			}
+			dequantizeRow(sums, q.Weights.Scales, out.Data[y*outRowSize:(y+1)*outRowSize])
+		}
+	})
+}
+
+// applyHalf is like ApplyTo for QuantFloat16.
+func (q *QuantizedDeconv) applyHalf(t, out *Tensor) {
+	in := roundHalf(t)
+	inRowSize := in.Width * in.Depth
+	outRowSize := out.Width * out.Depth
+	tapRowSize := q.KernelSize * q.OutDepth
+	interleaveRows(out.Height, func(start, stride int) {
+		products := make([]float32, in.Width*tapRowSize)
+		for y := start; y < out.Height; y += stride {
+			sums := out.Data[y*outRowSize : (y+1)*outRowSize]
+			for i := range sums {
+				sums[i] = 0
+			}
+			// See Deconv.ApplyTo.
+			for kernelY := y % q.Stride; kernelY < q.KernelSize; kernelY += q.Stride {
+				inY := (y - kernelY) / q.Stride
+				if inY < 0 {
+					break
+				} else if inY >= in.Height {
+					continue
+				}
+				for i := range products {
+					products[i] = 0
+				}
+				gemmHalf(in.Width, tapRowSize, q.InDepth, in.Data[inY*inRowSize:(inY+1)*inRowSize],
+					q.halfTaps[kernelY], products)
+				for inX := 0; inX < in.Width; inX++ {
+					outIdx := inX * q.Stride * q.OutDepth
+					dst := sums[outIdx : outIdx+tapRowSize]
+					for i, x := range products[inX*tapRowSize : (inX+1)*tapRowSize] {
+						dst[i] = roundToHalf(dst[i] + x)
+					}
+				}
+			}
+		}
+	})
+}
+
+// Check verifies that the Tensor has the correct number
+// of channels.
+func (q *QuantizedDeconv) Check(t *Tensor) error {
+	_, err := q.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape of the transposed
+// convolution's output.
+func (q *QuantizedDeconv) OutputShape(in Shape) (Shape, error) {
+	numWeights := q.InDepth * q.OutDepth * q.KernelSize * q.KernelSize
+	if err := q.Weights.check(numWeights, q.OutDepth, q.InDepth, q.InputScales); err != nil {
+		return Shape{}, err
+	}
+	return q.floatLayer(nil).OutputShape(in)
+}
+
+// InputRegion computes the input pixels that the output
+// region depends on.
+func (q *QuantizedDeconv) InputRegion(out image.Rectangle) image.Rectangle {
+	return q.floatLayer(nil).InputRegion(out)
+}
+
+func (q *QuantizedDeconv) floatLayer(weights []float32) *Deconv {
+	return &Deconv{
+		OutDepth:   q.OutDepth,
+		InDepth:    q.InDepth,
+		KernelSize: q.KernelSize,
+		Stride:     q.Stride,
+		Weights:    weights,
+	}
+}
+
+func (q *QuantizedDeconv) prepare() {
+	// Rearrange the weights like Deconv.weightTaps.
+	k := q.KernelSize
+	half := q.Weights.Format == QuantFloat16
+	if half {
+		q.halfTaps = make([][]uint16, k)
+	} else {
+		q.taps = make([][]int8, k)
+		q.invScales = invScales(q.InputScales)
+	}
+	for kernelY := 0; kernelY < k; kernelY++ {
+		var dst int
+		if half {
+			q.halfTaps[kernelY] = make([]uint16, q.InDepth*k*q.OutDepth)
+		} else {
+			q.taps[kernelY] = make([]int8, q.InDepth*k*q.OutDepth)
+		}
+		for i := 0; i < q.InDepth; i++ {
+			for kernelX := 0; kernelX < k; kernelX++ {
+				for o := 0; o < q.OutDepth; o++ {
+					idx := ((i*q.OutDepth+o)*k+kernelY)*k + kernelX
+					if half {
+						q.halfTaps[kernelY][dst] = q.Weights.Float16[idx]
+					} else {
+						q.taps[kernelY][dst] = q.Weights.Int8[idx]
+					}
+					dst++
+				}
+			}
+		}
+	}
+}
+
+// dequantizeRow converts integer sums to floats, where
+// the values are interleaved channels with the given
+// scales.
+func dequantizeRow(sums []int32, scales, dst []float32) {
+	depth := len(scales)
+	for i := 0; i < len(sums); i += depth {
+		pixel := sums[i : i+depth]
+		dstPixel := dst[i : i+depth]
+		for z, x := range pixel {
+			dstPixel[z] = float32(x) * scales[z]
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package nn
+
+import (
+	"errors"
+	"image"
+
+	"github.com/unixpickle/essentials"
+)
+
+// maxSpatialPeriod is the largest combined stride for
+// which ReceptiveField is guaranteed to be exact.
+const maxSpatialPeriod = 64
+
+// maxDivisorSearch is the largest input size considered
+// by DimensionDivisor.
+const maxDivisorSearch = 256
+
+// A RegionMapper is a Layer which can report which input
+// pixels each output pixel depends on.
+type RegionMapper interface {
+	Layer
+
+	// InputRegion computes the region of the input that
+	// the given region of the output depends on.
+	//
+	// Regions are not clipped to the bounds of any
+	// particular Tensor, and may extend into negative
+	// coordinates.
+	InputRegion(out image.Rectangle) image.Rectangle
+}
+
+// InputRegion computes the region of the input that a
+// region of the output depends on.
+//
+// If any Layer in the network does not implement
+// RegionMapper, a *LayerError is returned.
+func InputRegion(l Layer, out image.Rectangle) (image.Rectangle, error) {
+	return inputRegion(l, out, nil)
+}
+
+func inputRegion(l Layer, out image.Rectangle, path []int) (image.Rectangle, error) {
+	switch l := l.(type) {
+	case NN:
+		res := out
+		for i := len(l) - 1; i >= 0; i-- {
+			var err error
+			res, err = inputRegion(l[i], res, appendPath(path, i))
+			if err != nil {
+				return image.Rectangle{}, err
+			}
+		}
+		return res, nil
+	case Residual:
+		inner, err := inputRegion(NN(l), out, path)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		return unionRegions(out, inner), nil
+	case *Graph:
+		return l.inputRegion(out, path)
+	case RegionMapper:
+		return l.InputRegion(out), nil
+	default:
+		return image.Rectangle{}, &LayerError{
+			Path:  path,
+			Layer: l,
+			Err:   errors.New("receptive field is unknown"),
+		}
+	}
+}
+
+// ReceptiveField computes the radius of the receptive
+// field of a Layer which preserves the spatial size of
+// its input.
+//
+// The radius is the maximum number of pixels to the left,
+// right, top, or bottom of an output pixel's location
+// that the Layer can "see" in the input.
+//
+// The result is exact for networks whose combined stride
+// divides 64, which includes all of the built-in models.
+func ReceptiveField(l Layer) (int, error) {
+	var radius int
+	for i := 0; i < maxSpatialPeriod; i++ {
+		out := image.Rect(i, i, i+1, i+1)
+		in, err := InputRegion(l, out)
+		if err != nil {
+			return 0, err
+		}
+		radius = essentials.MaxInt(radius, i-in.Min.X)
+		radius = essentials.MaxInt(radius, i-in.Min.Y)
+		radius = essentials.MaxInt(radius, in.Max.X-out.Max.X)
+		radius = essentials.MaxInt(radius, in.Max.Y-out.Max.Y)
+	}
+	return radius, nil
+}
+
+// DimensionDivisor computes the smallest factor which
+// must divide the width and height of an input for a
+// Layer to produce an output of the same size.
+//
+// The depth argument specifies the number of input
+// channels expected by the Layer.
+func DimensionDivisor(l Layer, depth int) (int, error) {
+	var divisor int
+	var firstErr error
+	for size := 1; size <= maxDivisorSearch; size++ {
+		in := Shape{Height: size, Width: size, Depth: depth}
+		out, err := OutputShape(l, in)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if out.Width == size && out.Height == size {
+			divisor = gcd(divisor, size)
+		}
+	}
+	if divisor == 0 {
+		if firstErr != nil {
+			return 0, firstErr
+		}
+		return 0, errors.New("layer does not preserve the size of any input")
+	}
+	return divisor, nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func unionRegions(r1, r2 image.Rectangle) image.Rectangle {
+	return image.Rectangle{
+		Min: image.Point{
+			X: essentials.MinInt(r1.Min.X, r2.Min.X),
+			Y: essentials.MinInt(r1.Min.Y, r2.Min.Y),
+		},
+		Max: image.Point{
+			X: essentials.MaxInt(r1.Max.X, r2.Max.X),
+			Y: essentials.MaxInt(r1.Max.Y, r2.Max.Y),
+		},
+	}
+}
+
+func convInputRegion(out image.Rectangle, kernelSize, stride int) image.Rectangle {
+	return image.Rectangle{
+		Min: out.Min.Mul(stride),
+		Max: out.Max.Sub(image.Pt(1, 1)).Mul(stride).Add(image.Pt(kernelSize, kernelSize)),
+	}
+}
+
+func deconvInputRegion(out image.Rectangle, kernelSize, stride int) image.Rectangle {
+	// Input pixel i contributes to outputs in the range
+	// [i*stride, i*stride+kernelSize).
+	return image.Rectangle{
+		Min: image.Point{
+			X: floorDiv(out.Min.X-kernelSize, stride) + 1,
+			Y: floorDiv(out.Min.Y-kernelSize, stride) + 1,
+		},
+		Max: image.Point{
+			X: floorDiv(out.Max.X-1, stride) + 1,
+			Y: floorDiv(out.Max.Y-1, stride) + 1,
+		},
+	}
+}
+
+func floorDiv(x, y int) int {
+	res := x / y
+	if (x%y != 0) && ((x < 0) != (y < 0)) {
+		res--
+	}
+	return res
+}
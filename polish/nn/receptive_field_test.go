@@ -0,0 +1,73 @@
+package nn
+
+import (
+	"image"
+	"testing"
+)
+
+func TestInputRegion(t *testing.T) {
+	ones := func(n int) []float32 {
+		res := make([]float32, n)
+		for i := range res {
+			res[i] = 1
+		}
+		return res
+	}
+	net := NN{
+		NewPad(2, 2, 2, 2),
+		&Conv{InDepth: 1, OutDepth: 1, KernelSize: 5, Stride: 2, Weights: ones(25)},
+		Residual{
+			NewPad(1, 1, 1, 1),
+			&SpatialConv{Depth: 1, KernelSize: 3, Stride: 1, Weights: ones(9)},
+		},
+		Residual{
+			NewPad(2, 2, 2, 2),
+			&Conv{InDepth: 1, OutDepth: 1, KernelSize: 3, Stride: 1, Dilation: 2,
+				Weights: ones(9)},
+		},
+		&Deconv{InDepth: 1, OutDepth: 1, KernelSize: 4, Stride: 2, Weights: ones(16)},
+		NewUnpad(1, 1, 1, 1),
+	}
+
+	// Find the true dependencies of each output pixel by
+	// perturbing one input pixel at a time.
+	in := NewTensor(20, 20, 1)
+	bounds := image.Rect(0, 0, in.Width, in.Height)
+	expected := map[image.Point]image.Rectangle{}
+	for y := 0; y < in.Height; y++ {
+		for x := 0; x < in.Width; x++ {
+			*in.At(y, x, 0) = 1
+			out := net.Apply(in)
+			*in.At(y, x, 0) = 0
+			for outY := 0; outY < out.Height; outY++ {
+				for outX := 0; outX < out.Width; outX++ {
+					if *out.At(outY, outX, 0) != 0 {
+						p := image.Pt(outX, outY)
+						expected[p] = expected[p].Union(image.Rect(x, y, x+1, y+1))
+					}
+				}
+			}
+		}
+	}
+
+	for p, expectedRegion := range expected {
+		region, err := InputRegion(net, image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := region.Intersect(bounds); actual != expectedRegion {
+			t.Errorf("output %v: expected region %v but got %v", p, expectedRegion, actual)
+		}
+	}
+
+	if rf, err := ReceptiveField(net); err != nil {
+		t.Error(err)
+	} else if rf != 10 {
+		t.Errorf("unexpected receptive field: %d", rf)
+	}
+	if lcd, err := DimensionDivisor(net, 1); err != nil {
+		t.Error(err)
+	} else if lcd != 2 {
+		t.Errorf("unexpected divisor: %d", lcd)
+	}
+}
@@ -0,0 +1,83 @@
+package nn
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Shape is the size of a Tensor.
+type Shape struct {
+	Height int
+	Width  int
+	Depth  int
+}
+
+// Size gets the number of values in a Tensor of the
+// Shape.
+func (s Shape) Size() int {
+	return s.Height * s.Width * s.Depth
+}
+
+// String formats the Shape as HxWxD.
+func (s Shape) String() string {
+	return fmt.Sprintf("%dx%dx%d", s.Height, s.Width, s.Depth)
+}
+
+// A Shaper is a Layer which can compute the shape of its
+// output without being applied.
+type Shaper interface {
+	Layer
+
+	// OutputShape computes the output shape for an input
+	// of the given shape, or returns an error if the
+	// Layer cannot be applied to such an input.
+	OutputShape(in Shape) (Shape, error)
+}
+
+// OutputShape computes the output shape of a Layer for
+// the given input shape.
+//
+// If any Layer in the network does not implement Shaper,
+// or cannot accept its input, a *LayerError is returned.
+func OutputShape(l Layer, in Shape) (Shape, error) {
+	return outputShape(l, in, nil)
+}
+
+func outputShape(l Layer, in Shape, path []int) (Shape, error) {
+	switch l := l.(type) {
+	case NN:
+		res := in
+		for i, subLayer := range l {
+			var err error
+			res, err = outputShape(subLayer, res, appendPath(path, i))
+			if err != nil {
+				return Shape{}, err
+			}
+		}
+		return res, nil
+	case Residual:
+		out, err := outputShape(NN(l), in, path)
+		if err != nil {
+			return Shape{}, err
+		}
+		if out != in {
+			return Shape{}, &LayerError{Path: path, Layer: l, Err: fmt.Errorf(
+				"output shape %v does not match input shape %v", out, in)}
+		}
+		return out, nil
+	case *Graph:
+		return l.outputShape(in, path)
+	case Shaper:
+		out, err := l.OutputShape(in)
+		if err != nil {
+			return Shape{}, &LayerError{Path: path, Layer: l, Err: err}
+		}
+		return out, nil
+	default:
+		return Shape{}, &LayerError{
+			Path:  path,
+			Layer: l,
+			Err:   errors.New("shape inference is not supported"),
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package nn
+
+import "testing"
+
+func TestOutputShape(t *testing.T) {
+	net := NN{
+		NewPad(1, 2, 3, 4),
+		&Conv{InDepth: 3, OutDepth: 4, KernelSize: 3, Stride: 2, Weights: make([]float32, 108)},
+		&Bias{Data: make([]float32, 4)},
+		Residual{
+			&GroupNorm{NumGroups: 2},
+			ReLU{},
+			&Mul{Data: make([]float32, 4)},
+		},
+		&SpatialConv{Depth: 4, KernelSize: 2, Stride: 1, Weights: make([]float32, 16)},
+		&Deconv{InDepth: 4, OutDepth: 2, KernelSize: 4, Stride: 2, Weights: make([]float32, 128)},
+		NewUnpad(1, 1, 1, 1),
+		&Bilateral{KernelSize: 3, SigmaBlur: 1, SigmaDiff: 1},
+	}
+	for _, in := range []Shape{{8, 8, 3}, {11, 6, 3}, {3, 10, 3}} {
+		expected := net.Apply(NewTensor(in.Height, in.Width, in.Depth)).Shape()
+		actual, err := net.OutputShape(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("input %v: expected %v but got %v", in, expected, actual)
+		}
+	}
+
+	if _, err := net.OutputShape(Shape{8, 8, 4}); err == nil {
+		t.Error("expected error for bad depth")
+	}
+
+	for _, layer := range []Layer{
+		&Conv{InDepth: 3, OutDepth: 1, KernelSize: 1, Weights: make([]float32, 3)},
+		&Conv{InDepth: 3, OutDepth: 1, Stride: 1},
+		&Conv{InDepth: 3, OutDepth: 1, KernelSize: 1, Stride: 1, Dilation: -1,
+			Weights: make([]float32, 3)},
+		&SpatialConv{Depth: 3, KernelSize: 1, Weights: make([]float32, 3)},
+		&SpatialConv{Depth: 3, Stride: 1},
+		&SpatialConv{Depth: 3, KernelSize: 1, Stride: 1, Dilation: -1,
+			Weights: make([]float32, 3)},
+		&Deconv{InDepth: 3, OutDepth: 1, KernelSize: 2, Weights: make([]float32, 12)},
+		&Deconv{InDepth: 3, OutDepth: 1, Stride: 2},
+		&Deconv{InDepth: 3, OutDepth: 1, KernelSize: -2, Stride: 2},
+	} {
+		if _, err := OutputShape(layer, Shape{8, 8, 3}); err == nil {
+			t.Errorf("expected error for %#v", layer)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nn
+
+// This file contains the portable versions of the vector
+// kernels used in the inner loops of the layers.
+//
+// On amd64 CPUs with AVX2 and FMA, the kernels are
+// implemented in assembly instead. The pure-Go versions
+// can be forced with the purego build tag.
+//
+// Every product is converted to float32 explicitly, which
+// prevents the compiler from fusing it with an addition
+// on architectures with FMA instructions. This way, the
+// kernels produce the same results on every machine.
+
+// dotGeneric computes the dot product of x and y.
+func dotGeneric(x, y []float32) float32 {
+	var res float32
+	y = y[:len(x)]
+	for i, v := range x {
+		res += float32(v * y[i])
+	}
+	return res
+}
+
+// axpyGeneric computes y += scale*x.
+func axpyGeneric(scale float32, x, y []float32) {
+	y = y[:len(x)]
+	for i, v := range x {
+		y[i] += float32(scale * v)
+	}
+}
+
+// axpy4Generic computes c[i] += scales[i]*x for each of
+// the four consecutive rows c[i] of c.
+func axpy4Generic(scales *[4]float32, x, c []float32) {
+	n := len(x)
+	c0 := c[:n]
+	c1 := c[n : 2*n]
+	c2 := c[2*n : 3*n]
+	c3 := c[3*n : 4*n]
+	s0, s1, s2, s3 := scales[0], scales[1], scales[2], scales[3]
+	for l, v := range x {
+		c0[l] += float32(s0 * v)
+		c1[l] += float32(s1 * v)
+		c2[l] += float32(s2 * v)
+		c3[l] += float32(s3 * v)
+	}
+}
+
+// addGeneric computes dst = x + y element-wise.
+func addGeneric(x, y, dst []float32) {
+	y = y[:len(x)]
+	dst = dst[:len(x)]
+	for i, v := range x {
+		dst[i] = v + y[i]
+	}
+}
+
+// mulGeneric computes dst = x * y element-wise.
+func mulGeneric(x, y, dst []float32) {
+	y = y[:len(x)]
+	dst = dst[:len(x)]
+	for i, v := range x {
+		dst[i] = v * y[i]
+	}
+}
+
+// mulAddGeneric computes dst += x * y element-wise.
+func mulAddGeneric(x, y, dst []float32) {
+	y = y[:len(x)]
+	dst = dst[:len(x)]
+	for i, v := range x {
+		dst[i] += float32(v * y[i])
+	}
+}
+
+// axpyInt8Generic computes y += scale*x.
+func axpyInt8Generic(scale int32, x []int8, y []int32) {
+	y = y[:len(x)]
+	for i, v := range x {
+		y[i] += scale * int32(v)
+	}
+}
@@ -0,0 +1,148 @@
+//go:build amd64 && !purego
+// +build amd64,!purego
+
+package nn
+
+// useAVX2 is true if the CPU and operating system support
+// the AVX2 and FMA instruction sets.
+var useAVX2 = hasAVX2FMA()
+
+// useSIMD checks if the assembly kernels should be used.
+//
+// In deterministic mode, the portable kernels are used
+// instead, since the assembly kernels use fused
+// multiply-adds and sum values in a different order.
+func useSIMD() bool {
+	return useAVX2 && !deterministic()
+}
+
+func hasAVX2FMA() bool {
+	maxLeaf, _, _, _ := cpuid(0, 0)
+	if maxLeaf < 7 {
+		return false
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	const (
+		fmaBit     = 1 << 12
+		osxsaveBit = 1 << 27
+		avxBit     = 1 << 28
+	)
+	if ecx1&(fmaBit|osxsaveBit|avxBit) != fmaBit|osxsaveBit|avxBit {
+		return false
+	}
+
+	// The OS must save the XMM and YMM registers.
+	xcr0, _ := xgetbv()
+	if xcr0&6 != 6 {
+		return false
+	}
+
+	_, ebx7, _, _ := cpuid(7, 0)
+	const avx2Bit = 1 << 5
+	return ebx7&avx2Bit != 0
+}
+
+// dot computes the dot product of x and y.
+func dot(x, y []float32) float32 {
+	y = y[:len(x)]
+	if useSIMD() {
+		return dotAVX2(x, y)
+	}
+	return dotGeneric(x, y)
+}
+
+// axpy computes y += scale*x.
+func axpy(scale float32, x, y []float32) {
+	y = y[:len(x)]
+	if useSIMD() {
+		axpyAVX2(scale, x, y)
+	} else {
+		axpyGeneric(scale, x, y)
+	}
+}
+
+// axpy4 computes c[i] += scales[i]*x for each of the four
+// consecutive rows c[i] of c.
+func axpy4(scales *[4]float32, x, c []float32) {
+	c = c[:4*len(x)]
+	if useSIMD() {
+		axpy4AVX2(scales, x, c)
+	} else {
+		axpy4Generic(scales, x, c)
+	}
+}
+
+// addVec computes dst = x + y element-wise.
+func addVec(x, y, dst []float32) {
+	y = y[:len(x)]
+	dst = dst[:len(x)]
+	if useSIMD() {
+		addAVX2(x, y, dst)
+	} else {
+		addGeneric(x, y, dst)
+	}
+}
+
+// mulVec computes dst = x * y element-wise.
+func mulVec(x, y, dst []float32) {
+	y = y[:len(x)]
+	dst = dst[:len(x)]
+	if useSIMD() {
+		mulAVX2(x, y, dst)
+	} else {
+		mulGeneric(x, y, dst)
+	}
+}
+
+// mulAddVec computes dst += x * y element-wise.
+func mulAddVec(x, y, dst []float32) {
+	y = y[:len(x)]
+	dst = dst[:len(x)]
+	if useSIMD() {
+		mulAddAVX2(x, y, dst)
+	} else {
+		mulAddGeneric(x, y, dst)
+	}
+}
+
+// axpyInt8 computes y += scale*x.
+//
+// Integer arithmetic is exact, so the assembly kernel is
+// used even in deterministic mode.
+func axpyInt8(scale int32, x []int8, y []int32) {
+	y = y[:len(x)]
+	if useAVX2 {
+		axpyInt8AVX2(scale, x, y)
+	} else {
+		axpyInt8Generic(scale, x, y)
+	}
+}
+
+// The following functions are implemented in simd_amd64.s.
+// They assume that all slices have at least len(x)
+// elements (or 4*len(x) for c).
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+//go:noescape
+func dotAVX2(x, y []float32) float32
+
+//go:noescape
+func axpyAVX2(scale float32, x, y []float32)
+
+//go:noescape
+func axpy4AVX2(scales *[4]float32, x, c []float32)
+
+//go:noescape
+func addAVX2(x, y, dst []float32)
+
+//go:noescape
+func mulAVX2(x, y, dst []float32)
+
+//go:noescape
+func mulAddAVX2(x, y, dst []float32)
+
+//go:noescape
+func axpyInt8AVX2(scale int32, x []int8, y []int32)
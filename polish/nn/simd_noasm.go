@@ -0,0 +1,45 @@
+//go:build !amd64 || purego
+// +build !amd64 purego
+
+package nn
+
+// useSIMD is always false without assembly kernels.
+func useSIMD() bool {
+	return false
+}
+
+// dot computes the dot product of x and y.
+func dot(x, y []float32) float32 {
+	return dotGeneric(x, y)
+}
+
+// axpy computes y += scale*x.
+func axpy(scale float32, x, y []float32) {
+	axpyGeneric(scale, x, y)
+}
+
+// axpy4 computes c[i] += scales[i]*x for each of the four
+// consecutive rows c[i] of c.
+func axpy4(scales *[4]float32, x, c []float32) {
+	axpy4Generic(scales, x, c)
+}
+
+// addVec computes dst = x + y element-wise.
+func addVec(x, y, dst []float32) {
+	addGeneric(x, y, dst)
+}
+
+// mulVec computes dst = x * y element-wise.
+func mulVec(x, y, dst []float32) {
+	mulGeneric(x, y, dst)
+}
+
+// mulAddVec computes dst += x * y element-wise.
+func mulAddVec(x, y, dst []float32) {
+	mulAddGeneric(x, y, dst)
+}
+
+// axpyInt8 computes y += scale*x.
+func axpyInt8(scale int32, x []int8, y []int32) {
+	axpyInt8Generic(scale, x, y)
+}
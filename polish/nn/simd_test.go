@@ -0,0 +1,90 @@
+package nn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestVectorKernels(t *testing.T) {
+	for n := 0; n < 70; n++ {
+		x := randomVector(n)
+		y := randomVector(n)
+
+		expectedDot := dotGeneric(x, y)
+		if actual := dot(x, y); math.Abs(float64(actual-expectedDot)) > 1e-4 {
+			t.Errorf("dot (n=%d): expected %f but got %f", n, expectedDot, actual)
+		}
+
+		checkKernel := func(name string, expected, actual []float32) {
+			for i, x := range expected {
+				if math.Abs(float64(x-actual[i])) > 1e-4 {
+					t.Errorf("%s (n=%d): bad value at %d: expected %f but got %f",
+						name, n, i, x, actual[i])
+					return
+				}
+			}
+		}
+
+		expected := append([]float32{}, y...)
+		actual := append([]float32{}, y...)
+		axpyGeneric(0.3, x, expected)
+		axpy(0.3, x, actual)
+		checkKernel("axpy", expected, actual)
+
+		scales := [4]float32{0.5, -1, 0, 2}
+		c := randomVector(4 * n)
+		expected = append([]float32{}, c...)
+		actual = append([]float32{}, c...)
+		axpy4Generic(&scales, x, expected)
+		axpy4(&scales, x, actual)
+		checkKernel("axpy4", expected, actual)
+
+		dst := randomVector(n)
+		expected = append([]float32{}, dst...)
+		actual = append([]float32{}, dst...)
+		mulAddGeneric(x, y, expected)
+		mulAddVec(x, y, actual)
+		checkKernel("mulAddVec", expected, actual)
+
+		addGeneric(x, y, expected)
+		addVec(x, y, actual)
+		checkKernel("addVec", expected, actual)
+
+		mulGeneric(x, y, expected)
+		mulVec(x, y, actual)
+		checkKernel("mulVec", expected, actual)
+
+		xInt := make([]int8, n)
+		expectedInt := make([]int32, n)
+		for i := range xInt {
+			xInt[i] = int8(rand.Intn(255) - 127)
+			expectedInt[i] = rand.Int31n(1000)
+		}
+		actualInt := append([]int32{}, expectedInt...)
+		axpyInt8Generic(-93, xInt, expectedInt)
+		axpyInt8(-93, xInt, actualInt)
+		for i, x := range expectedInt {
+			if actualInt[i] != x {
+				t.Errorf("axpyInt8 (n=%d): bad value at %d: expected %d but got %d", n, i, x,
+					actualInt[i])
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkVectorKernels(b *testing.B) {
+	x := randomVector(128)
+	y := randomVector(128)
+	b.Run("Dot", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dot(x, y)
+		}
+	})
+	b.Run("Axpy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			axpy(1e-3, x, y)
+		}
+	})
+}
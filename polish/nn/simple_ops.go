@@ -1,10 +1,19 @@
 package nn
 
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/unixpickle/essentials"
+)
+
 // A ReLU layer applies the rectified linear unit.
 type ReLU struct{}
 
 // Apply applies the rectified linear unit.
 func (r ReLU) Apply(t *Tensor) *Tensor {
+	t = t.Contiguous()
 	res := NewTensor(t.Height, t.Width, t.Depth)
 	for i, x := range t.Data {
 		if x > 0 {
@@ -14,22 +23,143 @@ func (r ReLU) Apply(t *Tensor) *Tensor {
 	return res
 }
 
+// ApplyInPlace applies the rectified linear unit to t in
+// place.
+func (r ReLU) ApplyInPlace(t *Tensor) {
+	if !t.IsContiguous() {
+		applyToView(t, r.ApplyInPlace)
+		return
+	}
+	convEpilogue(t.Data, nil, true)
+}
+
+// OutputShape returns the input shape.
+func (r ReLU) OutputShape(in Shape) (Shape, error) {
+	return in, nil
+}
+
+// InputRegion returns the output region, since the
+// activation is applied to each value independently.
+func (r ReLU) InputRegion(out image.Rectangle) image.Rectangle {
+	return out
+}
+
+// PadMode determines the values that a Pad layer fills
+// the padding with.
+type PadMode int
+
+const (
+	// PadZero pads with zeros.
+	PadZero PadMode = iota
+
+	// PadReflect mirrors the input around its edges,
+	// without repeating the edge pixels.
+	PadReflect
+
+	// PadReplicate repeats the edge pixels of the input.
+	PadReplicate
+
+	// PadCircular wraps around to the opposite edge of
+	// the input, as if it were tiled.
+	PadCircular
+)
+
+// sourceIndex finds the coordinate in an input of the
+// given size which supplies the padding at coordinate i,
+// or returns -1 if the padding is zero.
+func (p PadMode) sourceIndex(i, size int) int {
+	if i >= 0 && i < size {
+		return i
+	}
+	switch p {
+	case PadReflect:
+		if size == 1 {
+			return 0
+		}
+		period := 2 * (size - 1)
+		i = ((i % period) + period) % period
+		if i >= size {
+			i = period - i
+		}
+		return i
+	case PadReplicate:
+		return essentials.MaxInt(0, essentials.MinInt(size-1, i))
+	case PadCircular:
+		return ((i % size) + size) % size
+	}
+	return -1
+}
+
 // A Pad layer pads input Tensors.
 type Pad struct {
 	Top    int
 	Right  int
 	Bottom int
 	Left   int
+
+	// Mode determines the values in the padding.
+	//
+	// Reflections and wrap-arounds are repeated if the
+	// padding is larger than the input.
+	Mode PadMode
 }
 
-// NewPad creates a Pad with the given values.
+// NewPad creates a zero Pad with the given values.
 func NewPad(t, r, b, l int) *Pad {
-	return &Pad{t, r, b, l}
+	return &Pad{Top: t, Right: r, Bottom: b, Left: l}
 }
 
 // Apply pads the Tensor.
 func (p *Pad) Apply(t *Tensor) *Tensor {
-	return t.Pad(p.Top, p.Right, p.Bottom, p.Left)
+	if err := p.Check(t); err != nil {
+		panic(err)
+	}
+	return t.PadWith(p.Mode, p.Top, p.Right, p.Bottom, p.Left)
+}
+
+// ApplyTo pads the Tensor into out.
+func (p *Pad) ApplyTo(t, out *Tensor) {
+	if err := p.Check(t); err != nil {
+		panic(err)
+	}
+	padInto(t, out, p.Mode, p.Top, p.Left)
+}
+
+// Check verifies that the padding amounts are
+// non-negative.
+func (p *Pad) Check(t *Tensor) error {
+	_, err := p.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the padded shape.
+func (p *Pad) OutputShape(in Shape) (Shape, error) {
+	if p.Top < 0 || p.Right < 0 || p.Bottom < 0 || p.Left < 0 {
+		return Shape{}, errors.New("padding must be non-negative")
+	}
+	if p.Mode < PadZero || p.Mode > PadCircular {
+		return Shape{}, fmt.Errorf("unknown padding mode: %d", p.Mode)
+	}
+	if p.Mode != PadZero && ((in.Height == 0 && p.Top+p.Bottom > 0) ||
+		(in.Width == 0 && p.Left+p.Right > 0)) {
+		return Shape{}, errors.New("cannot pad an empty input without PadZero")
+	}
+	return Shape{
+		Height: in.Height + p.Top + p.Bottom,
+		Width:  in.Width + p.Left + p.Right,
+		Depth:  in.Depth,
+	}, nil
+}
+
+// InputRegion shifts the output region into the
+// coordinates of the unpadded input.
+//
+// For modes other than PadZero, pixels in the padding
+// also depend on pixels near the edges of the input,
+// which are not included since regions do not depend on
+// the size of the input.
+func (p *Pad) InputRegion(out image.Rectangle) image.Rectangle {
+	return out.Sub(image.Pt(p.Left, p.Top))
 }
 
 // An Unpad layer unpads (crops) input Tensors.
@@ -47,5 +177,91 @@ func NewUnpad(t, r, b, l int) *Unpad {
 
 // Apply unpads (crops) the Tensor.
 func (u *Unpad) Apply(t *Tensor) *Tensor {
+	if err := u.Check(t); err != nil {
+		panic(err)
+	}
 	return t.Unpad(u.Top, u.Right, u.Bottom, u.Left)
 }
+
+// ApplyTo crops the Tensor into out.
+func (u *Unpad) ApplyTo(t, out *Tensor) {
+	if err := u.Check(t); err != nil {
+		panic(err)
+	}
+	out.CopyFrom(t.View(out.Bounds().Add(image.Pt(u.Left, u.Top))))
+}
+
+// Check verifies that the Tensor is large enough to be
+// cropped by the given amounts.
+func (u *Unpad) Check(t *Tensor) error {
+	_, err := u.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the cropped shape.
+func (u *Unpad) OutputShape(in Shape) (Shape, error) {
+	if u.Top < 0 || u.Right < 0 || u.Bottom < 0 || u.Left < 0 {
+		return Shape{}, errors.New("unpadding must be non-negative")
+	}
+	if u.Top+u.Bottom > in.Height || u.Left+u.Right > in.Width {
+		return Shape{}, fmt.Errorf("cannot crop %dx%d input by (%d, %d, %d, %d)", in.Height,
+			in.Width, u.Top, u.Right, u.Bottom, u.Left)
+	}
+	return Shape{
+		Height: in.Height - (u.Top + u.Bottom),
+		Width:  in.Width - (u.Left + u.Right),
+		Depth:  in.Depth,
+	}, nil
+}
+
+// InputRegion shifts the output region into the
+// coordinates of the uncropped input.
+func (u *Unpad) InputRegion(out image.Rectangle) image.Rectangle {
+	return out.Add(image.Pt(u.Left, u.Top))
+}
+
+// A ChannelSlice layer selects the channels in the range
+// [Start, End) of every pixel.
+type ChannelSlice struct {
+	Start int
+	End   int
+}
+
+// Apply copies the selected channels to a new Tensor.
+func (c *ChannelSlice) Apply(t *Tensor) *Tensor {
+	if err := c.Check(t); err != nil {
+		panic(err)
+	}
+	return copyTensor(t.Channels(c.Start, c.End))
+}
+
+// ApplyTo copies the selected channels into out.
+func (c *ChannelSlice) ApplyTo(t, out *Tensor) {
+	if err := c.Check(t); err != nil {
+		panic(err)
+	}
+	out.CopyFrom(t.Channels(c.Start, c.End))
+}
+
+// Check verifies that the Tensor has the selected
+// channels.
+func (c *ChannelSlice) Check(t *Tensor) error {
+	_, err := c.OutputShape(t.Shape())
+	return err
+}
+
+// OutputShape computes the shape with the selected number
+// of channels.
+func (c *ChannelSlice) OutputShape(in Shape) (Shape, error) {
+	if c.Start < 0 || c.End > in.Depth || c.Start > c.End {
+		return Shape{}, fmt.Errorf("channels [%d, %d) are out of bounds for depth %d",
+			c.Start, c.End, in.Depth)
+	}
+	return Shape{Height: in.Height, Width: in.Width, Depth: c.End - c.Start}, nil
+}
+
+// InputRegion returns the output region, since each pixel
+// is sliced independently.
+func (c *ChannelSlice) InputRegion(out image.Rectangle) image.Rectangle {
+	return out
+}
@@ -15,6 +15,16 @@ type Tensor struct {
 	Depth  int
 
 	Data []float32
+
+	// RowStride and PixelStride, if non-zero, are the
+	// distances in Data between vertically and horizontally
+	// adjacent pixels.
+	//
+	// They are set for views created by View and Channels,
+	// which share Data with another Tensor. If they are
+	// zero, the values are packed like those of NewTensor.
+	RowStride   int
+	PixelStride int
 }
 
 // NewTensorRGB creates an RGB Tensor from an image.
@@ -44,15 +54,20 @@ func NewTensor(height, width, depth int) *Tensor {
 	}
 }
 
+// Shape gets the shape of the Tensor.
+func (t *Tensor) Shape() Shape {
+	return Shape{Height: t.Height, Width: t.Width, Depth: t.Depth}
+}
+
 // At gets a pointer to the given coordinate.
 func (t *Tensor) At(y, x, z int) *float32 {
-	return &t.Data[z+t.Depth*(x+y*t.Width)]
+	return &t.Data[z+x*t.pixelStride()+y*t.rowStride()]
 }
 
 // Add adds a scalar to every entry.
 func (t *Tensor) Add(s float32) *Tensor {
-	res := NewTensor(t.Height, t.Width, t.Depth)
-	for i, x := range t.Data {
+	res := copyTensor(t)
+	for i, x := range res.Data {
 		res.Data[i] = x + s
 	}
 	return res
@@ -60,24 +75,52 @@ func (t *Tensor) Add(s float32) *Tensor {
 
 // Pad creates a zero-padded version of the Tensor.
 func (t *Tensor) Pad(top, right, bottom, left int) *Tensor {
+	return t.PadWith(PadZero, top, right, bottom, left)
+}
+
+// PadWith creates a padded version of the Tensor, using
+// the given mode to fill in the padding.
+func (t *Tensor) PadWith(mode PadMode, top, right, bottom, left int) *Tensor {
 	res := NewTensor(t.Height+top+bottom, t.Width+left+right, t.Depth)
-	rowSize := t.Depth * t.Width
-	for i := 0; i < t.Height; i++ {
-		start := t.Depth * t.Width * i
-		copy(res.Data[res.Depth*(left+(i+top)*res.Width):], t.Data[start:start+rowSize])
-	}
+	padInto(t, res, mode, top, left)
 	return res
 }
 
+// padInto writes a padded version of t into out, which
+// must be large enough to contain t at the offset given
+// by top and left.
+func padInto(t, out *Tensor, mode PadMode, top, left int) {
+	inner := t.Bounds().Add(image.Pt(left, top))
+	out.View(inner).CopyFrom(t)
+	for y := 0; y < out.Height; y++ {
+		srcY := mode.sourceIndex(y-top, t.Height)
+		for x := 0; x < out.Width; x++ {
+			if x == inner.Min.X && y >= inner.Min.Y && y < inner.Max.Y {
+				// Skip the pixels copied from t.
+				x = inner.Max.X - 1
+				continue
+			}
+			dst := out.Pixel(y, x)
+			srcX := mode.sourceIndex(x-left, t.Width)
+			if srcY < 0 || srcX < 0 {
+				for i := range dst {
+					dst[i] = 0
+				}
+			} else {
+				copy(dst, t.Pixel(srcY, srcX))
+			}
+		}
+	}
+}
+
 // Unpad cuts out the edges of the Tensor, effectively
 // inverting the operation done by Pad.
+//
+// The result is a copy. To crop a Tensor without copying
+// it, use View.
 func (t *Tensor) Unpad(top, right, bottom, left int) *Tensor {
 	res := NewTensor(t.Height-(top+bottom), t.Width-(left+right), t.Depth)
-	rowSize := t.Depth * (t.Width - (left + right))
-	for i := top; i < t.Height-bottom; i++ {
-		start := t.Depth * (left + t.Width*i)
-		copy(res.Data[res.Depth*res.Width*(i-top):], t.Data[start:start+rowSize])
-	}
+	res.CopyFrom(t.View(image.Rect(left, top, t.Width-right, t.Height-bottom)))
 	return res
 }
 
@@ -89,6 +132,7 @@ func (t *Tensor) RGB() image.Image {
 	if t.Depth != 3 {
 		panic("expected exactly 3 output channels")
 	}
+	t = t.Contiguous()
 	res := image.NewRGBA(image.Rect(0, 0, t.Width, t.Height))
 	var idx int
 	for y := 0; y < t.Height; y++ {
@@ -31,3 +31,46 @@ func TestPadUnpad(t *testing.T) {
 	runShape(1, 1, 1, 1)
 	runShape(1, 2, 3, 4)
 }
+
+func TestPadModes(t *testing.T) {
+	expected := map[PadMode][]float32{
+		PadZero:      {0, 0, 1, 2, 3, 0, 0, 0},
+		PadReflect:   {3, 2, 1, 2, 3, 2, 1, 2},
+		PadReplicate: {1, 1, 1, 2, 3, 3, 3, 3},
+		PadCircular:  {2, 3, 1, 2, 3, 1, 2, 3},
+	}
+	for mode, values := range expected {
+		row := &Tensor{Height: 1, Width: 3, Depth: 1, Data: []float32{1, 2, 3}}
+		if actual := row.PadWith(mode, 0, 3, 0, 2).Data; !reflect.DeepEqual(actual, values) {
+			t.Errorf("mode %d: expected %v but got %v", mode, values, actual)
+		}
+		column := &Tensor{Height: 3, Width: 1, Depth: 1, Data: []float32{1, 2, 3}}
+		if actual := column.PadWith(mode, 2, 0, 3, 0).Data; !reflect.DeepEqual(actual, values) {
+			t.Errorf("mode %d: expected %v but got %v", mode, values, actual)
+		}
+
+		tensor := NewTensor(4, 5, 3)
+		copy(tensor.Data, randomVector(len(tensor.Data)))
+		layer := &Pad{Top: 2, Right: 7, Bottom: 1, Left: 3, Mode: mode}
+		padded := layer.Apply(tensor)
+		for y := 0; y < padded.Height; y++ {
+			for x := 0; x < padded.Width; x++ {
+				srcY := mode.sourceIndex(y-layer.Top, tensor.Height)
+				srcX := mode.sourceIndex(x-layer.Left, tensor.Width)
+				var expected float32
+				if srcY >= 0 && srcX >= 0 {
+					expected = *tensor.At(srcY, srcX, 1)
+				}
+				if *padded.At(y, x, 1) != expected {
+					t.Fatalf("mode %d: unexpected value at %d,%d", mode, y, x)
+				}
+			}
+		}
+		out := NewTensor(padded.Height, padded.Width, padded.Depth)
+		for i := range out.Data {
+			out.Data[i] = 1
+		}
+		layer.ApplyTo(tensor, out)
+		checkTensorsClose(t, padded, out, 0)
+	}
+}
@@ -0,0 +1,144 @@
+package nn
+
+import (
+	"fmt"
+	"image"
+)
+
+// Bounds gets the rectangle of pixel coordinates in the
+// Tensor, with the top-left pixel at (0, 0).
+func (t *Tensor) Bounds() image.Rectangle {
+	return image.Rect(0, 0, t.Width, t.Height)
+}
+
+// View creates a Tensor for the pixels of t within r,
+// which must be contained in t.Bounds().
+//
+// The view shares Data with t, so changes to one Tensor
+// are visible in the other.
+// The pixel r.Min of t is the top-left pixel of the view.
+func (t *Tensor) View(r image.Rectangle) *Tensor {
+	if !r.In(t.Bounds()) {
+		panic(fmt.Sprintf("view %v is out of bounds %v", r, t.Bounds()))
+	}
+	return t.view(r.Min.Y, r.Min.X, r.Dy(), r.Dx(), 0, t.Depth)
+}
+
+// Channels creates a view of the channels in the range
+// [start, end) of every pixel in t.
+//
+// Like View, the result shares Data with t.
+func (t *Tensor) Channels(start, end int) *Tensor {
+	if start < 0 || end > t.Depth || start > end {
+		panic(fmt.Sprintf("channels [%d, %d) are out of bounds for depth %d", start, end,
+			t.Depth))
+	}
+	return t.view(0, 0, t.Height, t.Width, start, end)
+}
+
+func (t *Tensor) view(y, x, height, width, startZ, endZ int) *Tensor {
+	res := &Tensor{
+		Height:      height,
+		Width:       width,
+		Depth:       endZ - startZ,
+		RowStride:   t.rowStride(),
+		PixelStride: t.pixelStride(),
+	}
+	if height == 0 || width == 0 || res.Depth == 0 {
+		res.Data = []float32{}
+		return res
+	}
+	start := y*res.RowStride + x*res.PixelStride + startZ
+	end := start + (height-1)*res.RowStride + (width-1)*res.PixelStride + res.Depth
+	res.Data = t.Data[start:end]
+	return res
+}
+
+// IsContiguous checks if the values of t are packed in
+// Data in order, as they are for NewTensor.
+//
+// Views are contiguous when they span whole rows and
+// every channel of the Tensor they were created from.
+func (t *Tensor) IsContiguous() bool {
+	return t.packedPixels() && (t.Height <= 1 || t.rowStride() == t.Width*t.Depth)
+}
+
+// Contiguous returns t if it is contiguous, or a packed
+// copy of t otherwise.
+//
+// The result should not be modified, since it may share
+// Data with t.
+func (t *Tensor) Contiguous() *Tensor {
+	if t.IsContiguous() {
+		return t
+	}
+	return copyTensor(t)
+}
+
+// Pixel gets the channels of the pixel at the given
+// coordinate.
+func (t *Tensor) Pixel(y, x int) []float32 {
+	idx := y*t.rowStride() + x*t.pixelStride()
+	return t.Data[idx : idx+t.Depth]
+}
+
+// CopyFrom copies the values from a Tensor of the same
+// shape into t.
+//
+// Either Tensor may be a view.
+func (t *Tensor) CopyFrom(src *Tensor) {
+	if err := checkSameShape(t, src); err != nil {
+		panic(err)
+	}
+	if t.IsContiguous() && src.IsContiguous() {
+		copy(t.Data, src.Data)
+		return
+	}
+	rowSize := t.Width * t.Depth
+	for y := 0; y < t.Height; y++ {
+		if t.packedPixels() && src.packedPixels() {
+			copy(t.row(y)[:rowSize], src.row(y)[:rowSize])
+			continue
+		}
+		for x := 0; x < t.Width; x++ {
+			copy(t.Pixel(y, x), src.Pixel(y, x))
+		}
+	}
+}
+
+// row gets the data starting at row y.
+//
+// If the pixels are packed, the first Width*Depth values
+// are the values of the row.
+func (t *Tensor) row(y int) []float32 {
+	return t.Data[y*t.rowStride():]
+}
+
+// packedPixels checks if the pixels in each row are
+// adjacent in Data, so that rows can be used as matrices.
+func (t *Tensor) packedPixels() bool {
+	return t.pixelStride() == t.Depth
+}
+
+func (t *Tensor) rowStride() int {
+	if t.RowStride == 0 {
+		return t.Width * t.pixelStride()
+	}
+	return t.RowStride
+}
+
+func (t *Tensor) pixelStride() int {
+	if t.PixelStride == 0 {
+		return t.Depth
+	}
+	return t.PixelStride
+}
+
+// applyToView applies an in-place operation f to a view
+// by applying it to a packed copy and copying back the
+// result.
+func applyToView(t *Tensor, f func(t *Tensor)) {
+	packed := copyTensor(t)
+	f(packed)
+	t.CopyFrom(packed)
+}
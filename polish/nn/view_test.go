@@ -0,0 +1,123 @@
+package nn
+
+import (
+	"fmt"
+	"image"
+	"testing"
+)
+
+func TestView(t *testing.T) {
+	tensor := NewTensor(6, 7, 4)
+	copy(tensor.Data, randomVector(len(tensor.Data)))
+
+	view := tensor.View(image.Rect(2, 1, 5, 4)).Channels(1, 3)
+	if view.Shape() != (Shape{Height: 3, Width: 3, Depth: 2}) {
+		t.Fatalf("unexpected shape: %v", view.Shape())
+	}
+	for y := 0; y < view.Height; y++ {
+		for x := 0; x < view.Width; x++ {
+			for z := 0; z < view.Depth; z++ {
+				if *view.At(y, x, z) != *tensor.At(y+1, x+2, z+1) {
+					t.Fatalf("unexpected value at %d,%d,%d", y, x, z)
+				}
+			}
+		}
+	}
+
+	packed := view.Contiguous()
+	if !packed.IsContiguous() || len(packed.Data) != 18 {
+		t.Fatal("expected a packed copy")
+	}
+	checkTensorsClose(t, packed, view.Contiguous(), 0)
+	*view.At(1, 1, 1) = 1337
+	if *tensor.At(2, 3, 2) != 1337 {
+		t.Error("view does not share data")
+	}
+	view.CopyFrom(packed)
+	if *tensor.At(2, 3, 2) != *packed.At(1, 1, 1) {
+		t.Error("unexpected value after CopyFrom")
+	}
+
+	for i, r := range []image.Rectangle{
+		image.Rect(0, 2, 7, 5),
+		image.Rect(3, 4, 7, 5),
+		image.Rect(2, 4, 6, 5),
+	} {
+		if !tensor.View(r).IsContiguous() {
+			t.Errorf("case %d: expected contiguous view", i)
+		}
+	}
+	for i, v := range []*Tensor{
+		tensor.View(image.Rect(1, 2, 7, 5)),
+		tensor.Channels(0, 3),
+	} {
+		if v.IsContiguous() {
+			t.Errorf("case %d: expected strided view", i)
+		}
+	}
+}
+
+func TestLayerViews(t *testing.T) {
+	layers := []Layer{
+		&Conv{InDepth: 8, OutDepth: 4, KernelSize: 1, Stride: 1, Weights: randomVector(8 * 4)},
+		&Conv{InDepth: 8, OutDepth: 4, KernelSize: 3, Stride: 2, Weights: randomVector(8 * 4 * 9),
+			Padding: *NewPad(1, 2, 1, 0), Bias: randomVector(4), ReLU: true},
+		&Conv{InDepth: 8, OutDepth: 16, KernelSize: 3, Stride: 1,
+			Weights: randomVector(8 * 16 * 9), Padding: *NewPad(1, 1, 1, 1)},
+		&SpatialConv{Depth: 8, KernelSize: 3, Stride: 1, Weights: randomVector(8 * 9),
+			Padding: *NewPad(1, 1, 1, 1)},
+		&SpatialConv{Depth: 8, KernelSize: 3, Stride: 2, Weights: randomVector(8 * 9)},
+		&Deconv{InDepth: 8, OutDepth: 3, KernelSize: 4, Stride: 2, Weights: randomVector(8 * 3 * 16)},
+		&GroupNorm{NumGroups: 2},
+		&Affine{Scale: randomVector(8), Bias: randomVector(8), ReLU: true},
+		ReLU{},
+		&Bilateral{KernelSize: 3, SigmaBlur: 1, SigmaDiff: 1},
+		&Bilateral{SigmaBlur: 1, SigmaDiff: 1, Method: BilateralGrid},
+		&JointBilateral{KernelSize: 3, Depth: 5, SigmaBlur: 1, SigmaDiff: 1,
+			SigmaGuide: []float64{0.5, 0.5, 1}},
+		&ATrous{Depth: 6, Iterations: 2, SigmaColor: 1, SigmaGuide: []float64{0.5, 1}},
+		&NonLocalMeans{SearchSize: 5, PatchSize: 3, Strength: 2},
+		NewPad(1, 2, 3, 4),
+		NewUnpad(1, 2, 3, 4),
+		Residual{&Mul{Data: randomVector(8)}},
+		&MaxPool{Size: 2},
+		&AvgPool{Size: 3},
+		&Upsample{Scale: 2},
+		&Upsample{Scale: 3, Mode: UpsampleBilinear},
+		&ChannelSlice{Start: 2, End: 5},
+		&Graph{Nodes: []GraphNode{
+			{Name: "relu", Inputs: []string{GraphInput}, Layer: ReLU{}},
+			{Name: "cat", Inputs: []string{"relu", GraphInput}, Merge: Concat{}},
+		}},
+	}
+	parent := NewTensor(12, 15, 10)
+	copy(parent.Data, randomVector(len(parent.Data)))
+	view := parent.View(image.Rect(2, 1, 13, 11)).Channels(1, 9)
+	packed := view.Contiguous()
+
+	for i, layer := range layers {
+		t.Run(fmt.Sprintf("Layer%d", i), func(t *testing.T) {
+			expected := layer.Apply(packed)
+			checkTensorsClose(t, expected, layer.Apply(view), 0)
+			if l, ok := layer.(TargetLayer); ok {
+				out := NewTensor(expected.Height, expected.Width, expected.Depth)
+				l.ApplyTo(view, out)
+				checkTensorsClose(t, expected, out, 0)
+			}
+			plan, err := NewPlan(NN{layer}, view.Shape())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTensorsClose(t, expected, plan.Apply(view), 0)
+		})
+	}
+
+	parentCopy := copyTensor(parent)
+	ReLU{}.ApplyInPlace(view)
+	checkTensorsClose(t, ReLU{}.Apply(packed), view.Contiguous(), 0)
+	for i, x := range parent.Data {
+		if z := i % parent.Depth; (z == 0 || z == 9) && x != parentCopy.Data[i] {
+			t.Fatal("in-place operation modified data outside of the view")
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package nn
+
+import "github.com/unixpickle/essentials"
+
+// This file implements 3x3, stride 1 convolutions using
+// the Winograd F(2x2, 3x3) algorithm.
+//
+// Each 2x2 block of outputs (a "tile") is computed from a
+// 4x4 block of inputs, which is transformed so that the
+// convolution becomes an element-wise product with a
+// transformed 4x4 filter. This requires 16 multiplications
+// per tile instead of the 36 used by a direct convolution.
+//
+// Dense convolutions (Conv) with many output channels
+// benefit the most, since the input transform is shared
+// by every output channel. For a 128->128 channel
+// convolution on a 64x64 input (see BenchmarkConvWinograd),
+// the Winograd algorithm is at least 1.3x as fast as the
+// direct algorithm with SIMD kernels, and at least 1.5x as
+// fast with the pure-Go kernels.
+//
+// Depthwise convolutions (SpatialConv) cannot share the
+// input transform, so they only use the Winograd algorithm
+// when SIMD kernels are unavailable (see useSIMD), which
+// includes deterministic mode. For 128 channels on a
+// 128x128 input (see BenchmarkSpatialConvWinograd), it is
+// about 2x as fast as the direct algorithm with the pure-Go
+// kernels, but about half as fast as the direct algorithm
+// with SIMD kernels.
+//
+// The residual blocks of the deep models use depthwise
+// 3x3 convolutions, but most of their time is spent in
+// 1x1 convolutions, so without SIMD kernels the models are
+// only a few percent faster. Their final convolution has
+// only 3 output channels, so it always uses the direct
+// algorithm.
+
+// winogradMinDepth is the smallest number of output
+// channels for which a Conv uses the Winograd algorithm.
+// With fewer channels, the cost of transforming the input
+// outweighs the savings in multiplications.
+const winogradMinDepth = 16
+
+// winogradFilter transforms a 3x3 filter g into a 4x4
+// filter u, computing G*g*G^T.
+func winogradFilter(g, u []float32) {
+	var tmp [12]float32
+	for col := 0; col < 3; col++ {
+		g0, g1, g2 := g[col], g[3+col], g[6+col]
+		tmp[col] = g0
+		tmp[3+col] = (g0 + g1 + g2) / 2
+		tmp[6+col] = (g0 - g1 + g2) / 2
+		tmp[9+col] = g2
+	}
+	for row := 0; row < 4; row++ {
+		g0, g1, g2 := tmp[row*3], tmp[row*3+1], tmp[row*3+2]
+		u[row*4] = g0
+		u[row*4+1] = (g0 + g1 + g2) / 2
+		u[row*4+2] = (g0 - g1 + g2) / 2
+		u[row*4+3] = g2
+	}
+}
+
+// winogradInput transforms 4x4 input tiles for many
+// channels at once, computing B^T*d*B for each channel.
+//
+// Entry i of rows holds the values of all channels at
+// position i of the tile, and the transformed value at
+// position i of channel c is written to dst[i][offset+c].
+func winogradInput(rows *[16][]float32, depth int, dst *[16][]float32, offset int) {
+	for c := 0; c < depth; c++ {
+		d00, d01, d02, d03 := rows[0][c], rows[1][c], rows[2][c], rows[3][c]
+		d10, d11, d12, d13 := rows[4][c], rows[5][c], rows[6][c], rows[7][c]
+		d20, d21, d22, d23 := rows[8][c], rows[9][c], rows[10][c], rows[11][c]
+		d30, d31, d32, d33 := rows[12][c], rows[13][c], rows[14][c], rows[15][c]
+
+		t00, t01, t02, t03 := d00-d20, d01-d21, d02-d22, d03-d23
+		t10, t11, t12, t13 := d10+d20, d11+d21, d12+d22, d13+d23
+		t20, t21, t22, t23 := d20-d10, d21-d11, d22-d12, d23-d13
+		t30, t31, t32, t33 := d10-d30, d11-d31, d12-d32, d13-d33
+
+		idx := offset + c
+		dst[0][idx], dst[1][idx], dst[2][idx], dst[3][idx] = t00-t02, t01+t02, t02-t01, t01-t03
+		dst[4][idx], dst[5][idx], dst[6][idx], dst[7][idx] = t10-t12, t11+t12, t12-t11, t11-t13
+		dst[8][idx], dst[9][idx], dst[10][idx], dst[11][idx] = t20-t22, t21+t22, t22-t21, t21-t23
+		dst[12][idx], dst[13][idx], dst[14][idx], dst[15][idx] = t30-t32, t31+t32, t32-t31, t31-t33
+	}
+}
+
+// winogradOutput transforms a 4x4 product tile m into a
+// 2x2 output tile, computing A^T*m*A.
+func winogradOutput(m *[16]float32) (y00, y01, y10, y11 float32) {
+	s0 := m[0] + m[4] + m[8]
+	s1 := m[1] + m[5] + m[9]
+	s2 := m[2] + m[6] + m[10]
+	s3 := m[3] + m[7] + m[11]
+	r0 := m[4] - m[8] - m[12]
+	r1 := m[5] - m[9] - m[13]
+	r2 := m[6] - m[10] - m[14]
+	r3 := m[7] - m[11] - m[15]
+	return s0 + s1 + s2, s1 - s2 - s3, r0 + r1 + r2, r1 - r2 - r3
+}
+
+// winogradRows points rows at the values of each position
+// in the 4x4 input tile with the given top-left corner.
+//
+// The corner may be negative to account for padding.
+// Positions outside of t are filled in with zeros from
+// zeros, which must contain at least t.Depth values.
+func winogradRows(t *Tensor, x, y int, zeros []float32, rows *[16][]float32) {
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			if y+i >= 0 && y+i < t.Height && x+j >= 0 && x+j < t.Width {
+				rows[i*4+j] = t.Pixel(y+i, x+j)
+			} else {
+				rows[i*4+j] = zeros[:t.Depth]
+			}
+		}
+	}
+}
+
+// writeWinogradOutput writes the valid entries of a 2x2
+// output tile for channel z.
+func writeWinogradOutput(out *Tensor, x, y, z int, y00, y01, y10, y11 float32) {
+	idx := (x+y*out.Width)*out.Depth + z
+	out.Data[idx] = y00
+	hasRight := x+1 < out.Width
+	if hasRight {
+		out.Data[idx+out.Depth] = y01
+	}
+	if y+1 < out.Height {
+		idx += out.Width * out.Depth
+		out.Data[idx] = y10
+		if hasRight {
+			out.Data[idx+out.Depth] = y11
+		}
+	}
+}
+
+// winogradOutputRows gets the output data for the row of
+// tiles at index tileY.
+func winogradOutputRows(out *Tensor, tileY int) []float32 {
+	rowSize := out.Width * out.Depth
+	end := essentials.MinInt(out.Height, tileY*2+2)
+	return out.Data[tileY*2*rowSize : end*rowSize]
+}
+
+// useWinograd checks if c should use the Winograd
+// algorithm.
+func (c *Conv) useWinograd() bool {
+	return c.KernelSize == 3 && c.Stride == 1 && c.groups() == 1 && c.dilation() == 1 &&
+		c.OutDepth >= winogradMinDepth
+}
+
+// winogradMatrices computes the transformed filters of a
+// Conv as 16 matrices of shape [in_depth x out_depth],
+// one per position in a 4x4 tile.
+func (c *Conv) winogradMatrices() [16][]float32 {
+	var result [16][]float32
+	for i := range result {
+		result[i] = make([]float32, c.InDepth*c.OutDepth)
+	}
+	var u [16]float32
+	for o := 0; o < c.OutDepth; o++ {
+		for z := 0; z < c.InDepth; z++ {
+			offset := (o*c.InDepth + z) * 9
+			winogradFilter(c.Weights[offset:offset+9], u[:])
+			for i, x := range u {
+				result[i][z*c.OutDepth+o] = x
+			}
+		}
+	}
+	return result
+}
+
+func (c *Conv) applyWinograd(t, out *Tensor) {
+	c.winogradOnce.Do(func() {
+		c.winograd = c.winogradMatrices()
+	})
+
+	tilesW := (out.Width + 1) / 2
+	tilesH := (out.Height + 1) / 2
+	interleaveRows(tilesH, func(start, stride int) {
+		zeros := make([]float32, c.InDepth)
+		var rows, inputs, products [16][]float32
+		for i := range inputs {
+			inputs[i] = make([]float32, tilesW*c.InDepth)
+			products[i] = make([]float32, tilesW*c.OutDepth)
+		}
+		var m [16]float32
+		for tileY := start; tileY < tilesH; tileY += stride {
+			for tileX := 0; tileX < tilesW; tileX++ {
+				winogradRows(t, tileX*2-c.Padding.Left, tileY*2-c.Padding.Top, zeros, &rows)
+				winogradInput(&rows, c.InDepth, &inputs, tileX*c.InDepth)
+			}
+			for i, product := range products {
+				for j := range product {
+					product[j] = 0
+				}
+				gemm(tilesW, c.OutDepth, c.InDepth, inputs[i], c.winograd[i], product)
+			}
+			for tileX := 0; tileX < tilesW; tileX++ {
+				offset := tileX * c.OutDepth
+				for o := 0; o < c.OutDepth; o++ {
+					for i, product := range products {
+						m[i] = product[offset+o]
+					}
+					y00, y01, y10, y11 := winogradOutput(&m)
+					writeWinogradOutput(out, tileX*2, tileY*2, o, y00, y01, y10, y11)
+				}
+			}
+			convEpilogue(winogradOutputRows(out, tileY), c.Bias, c.ReLU)
+		}
+	})
+}
+
+// useWinograd checks if s should use the Winograd
+// algorithm.
+//
+// Unlike a Conv, a SpatialConv cannot share the input
+// transform between output channels, so the Winograd
+// algorithm only beats the direct algorithm when the
+// direct algorithm cannot use SIMD kernels.
+func (s *SpatialConv) useWinograd() bool {
+	return s.KernelSize == 3 && s.Stride == 1 && s.dilation() == 1 && !useSIMD()
+}
+
+// winogradTaps computes the transformed filters of a
+// SpatialConv, with the 16 values for each channel stored
+// contiguously.
+func (s *SpatialConv) winogradTaps() []float32 {
+	result := make([]float32, s.Depth*16)
+	for z := 0; z < s.Depth; z++ {
+		winogradFilter(s.Weights[z*9:(z+1)*9], result[z*16:(z+1)*16])
+	}
+	return result
+}
+
+func (s *SpatialConv) applyWinograd(t, out *Tensor) {
+	s.winogradOnce.Do(func() {
+		s.winograd = s.winogradTaps()
+	})
+
+	tilesW := (out.Width + 1) / 2
+	tilesH := (out.Height + 1) / 2
+	interleaveRows(tilesH, func(start, stride int) {
+		zeros := make([]float32, s.Depth)
+		scratch := make([]float32, 4*s.Depth)
+		var rows [16][]float32
+		var outputs [4][]float32
+		for tileY := start; tileY < tilesH; tileY += stride {
+			for tileX := 0; tileX < tilesW; tileX++ {
+				x, y := tileX*2, tileY*2
+				winogradRows(t, x-s.Padding.Left, y-s.Padding.Top, zeros, &rows)
+				inside := x+1 < out.Width && y+1 < out.Height
+				for i := range outputs {
+					if inside {
+						outputs[i] = out.Pixel(y+i/2, x+i%2)
+					} else {
+						outputs[i] = scratch[i*s.Depth : (i+1)*s.Depth]
+					}
+				}
+				winogradDepthwise(&rows, s.winograd, &outputs)
+				if !inside {
+					for i, output := range outputs {
+						if x+i%2 < out.Width && y+i/2 < out.Height {
+							copy(out.Pixel(y+i/2, x+i%2), output)
+						}
+					}
+				}
+			}
+			convEpilogue(winogradOutputRows(out, tileY), s.Bias, s.ReLU)
+		}
+	})
+}
+
+// winogradDepthwise computes a 2x2 output tile of a
+// depthwise convolution for every channel, given the rows
+// of the input tile and the transformed filters, writing
+// the four output pixels in row-major order.
+//
+// The products are rounded explicitly so that they cannot
+// be fused with the sums of the output transform.
+func winogradDepthwise(rows *[16][]float32, taps []float32, outputs *[4][]float32) {
+	depth := len(outputs[0])
+	r0, r1, r2, r3 := rows[0][:depth], rows[1][:depth], rows[2][:depth], rows[3][:depth]
+	r4, r5, r6, r7 := rows[4][:depth], rows[5][:depth], rows[6][:depth], rows[7][:depth]
+	r8, r9, r10, r11 := rows[8][:depth], rows[9][:depth], rows[10][:depth], rows[11][:depth]
+	r12, r13, r14, r15 := rows[12][:depth], rows[13][:depth], rows[14][:depth], rows[15][:depth]
+	o0, o1, o2, o3 := outputs[0][:depth], outputs[1][:depth], outputs[2][:depth], outputs[3][:depth]
+	taps = taps[:depth*16]
+	for c := range o0 {
+		u := taps[c*16 : c*16+16 : c*16+16]
+		d00, d01, d02, d03 := r0[c], r1[c], r2[c], r3[c]
+		d10, d11, d12, d13 := r4[c], r5[c], r6[c], r7[c]
+		d20, d21, d22, d23 := r8[c], r9[c], r10[c], r11[c]
+		d30, d31, d32, d33 := r12[c], r13[c], r14[c], r15[c]
+
+		t00, t01, t02, t03 := d00-d20, d01-d21, d02-d22, d03-d23
+		t10, t11, t12, t13 := d10+d20, d11+d21, d12+d22, d13+d23
+		t20, t21, t22, t23 := d20-d10, d21-d11, d22-d12, d23-d13
+		t30, t31, t32, t33 := d10-d30, d11-d31, d12-d32, d13-d33
+
+		m0, m1 := float32(u[0]*(t00-t02)), float32(u[1]*(t01+t02))
+		m2, m3 := float32(u[2]*(t02-t01)), float32(u[3]*(t01-t03))
+		m4, m5 := float32(u[4]*(t10-t12)), float32(u[5]*(t11+t12))
+		m6, m7 := float32(u[6]*(t12-t11)), float32(u[7]*(t11-t13))
+		m8, m9 := float32(u[8]*(t20-t22)), float32(u[9]*(t21+t22))
+		m10, m11 := float32(u[10]*(t22-t21)), float32(u[11]*(t21-t23))
+		m12, m13 := float32(u[12]*(t30-t32)), float32(u[13]*(t31+t32))
+		m14, m15 := float32(u[14]*(t32-t31)), float32(u[15]*(t31-t33))
+
+		// The output transform, as in winogradOutput.
+		s0, s1, s2, s3 := m0+m4+m8, m1+m5+m9, m2+m6+m10, m3+m7+m11
+		q0, q1, q2, q3 := m4-m8-m12, m5-m9-m13, m6-m10-m14, m7-m11-m15
+		o0[c], o1[c] = s0+s1+s2, s1-s2-s3
+		o2[c], o3[c] = q0+q1+q2, q1-q2-q3
+	}
+}
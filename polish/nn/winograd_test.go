@@ -0,0 +1,113 @@
+package nn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestConvWinograd(t *testing.T) {
+	for _, c := range []*Conv{
+		{InDepth: 5, OutDepth: 16, KernelSize: 3, Stride: 1},
+		{InDepth: 7, OutDepth: 21, KernelSize: 3, Stride: 1},
+	} {
+		c.Weights = randomVector(c.OutDepth * c.InDepth * 9)
+		for _, size := range [][2]int{{3, 3}, {8, 10}, {11, 9}} {
+			in := NewTensor(size[0], size[1], c.InDepth)
+			copy(in.Data, randomVector(len(in.Data)))
+			if !c.useWinograd() {
+				t.Fatal("expected Winograd to be used")
+			}
+			expected := NewTensor(size[0]-2, size[1]-2, c.OutDepth)
+			c.applyDirect(in, expected)
+			actual := c.Apply(in)
+			checkTensorsClose(t, expected, actual, 1e-4)
+		}
+	}
+}
+
+func BenchmarkConvWinograd(b *testing.B) {
+	c := &Conv{InDepth: 128, OutDepth: 128, KernelSize: 3, Stride: 1,
+		Weights: randomVector(128 * 128 * 9)}
+	in := NewTensor(66, 66, c.InDepth)
+	copy(in.Data, randomVector(len(in.Data)))
+	out := NewTensor(in.Height-2, in.Width-2, c.OutDepth)
+	b.Run("Direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.applyDirect(in, out)
+		}
+	})
+	b.Run("Winograd", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.applyWinograd(in, out)
+		}
+	})
+}
+
+func TestSpatialConvWinograd(t *testing.T) {
+	for _, s := range []*SpatialConv{
+		{Depth: 5, KernelSize: 3, Stride: 1},
+		{Depth: 7, KernelSize: 3, Stride: 1, Padding: *NewPad(1, 2, 0, 1), ReLU: true},
+	} {
+		s.Weights = randomVector(s.Depth * 9)
+		s.Bias = randomVector(s.Depth)
+		for _, size := range [][2]int{{3, 3}, {8, 10}, {11, 9}} {
+			in := NewTensor(size[0], size[1], s.Depth)
+			copy(in.Data, randomVector(len(in.Data)))
+			outH, outW := s.outputSize(in)
+			expected := NewTensor(outH, outW, s.Depth)
+			s.applyDirect(in, expected)
+			actual := NewTensor(outH, outW, s.Depth)
+			s.applyWinograd(in, actual)
+			checkTensorsClose(t, expected, actual, 1e-4)
+		}
+	}
+
+	// Every machine uses the same algorithm in
+	// deterministic mode.
+	defer SetDefaultDeterminism(DefaultDeterminism())
+	SetDefaultDeterminism(DeterminismStrict)
+	s := &SpatialConv{Depth: 3, KernelSize: 3, Stride: 1}
+	if !s.useWinograd() {
+		t.Error("expected Winograd to be used in deterministic mode")
+	}
+}
+
+func BenchmarkSpatialConvWinograd(b *testing.B) {
+	s := &SpatialConv{Depth: 128, KernelSize: 3, Stride: 1, Weights: randomVector(128 * 9)}
+	in := NewTensor(130, 130, s.Depth)
+	copy(in.Data, randomVector(len(in.Data)))
+	out := NewTensor(in.Height-2, in.Width-2, s.Depth)
+	b.Run("Direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.applyDirect(in, out)
+		}
+	})
+	b.Run("Winograd", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.applyWinograd(in, out)
+		}
+	})
+}
+
+func randomVector(n int) []float32 {
+	res := make([]float32, n)
+	for i := range res {
+		res[i] = float32(rand.NormFloat64())
+	}
+	return res
+}
+
+func checkTensorsClose(t *testing.T, expected, actual *Tensor, epsilon float64) {
+	if expected.Shape() != actual.Shape() {
+		t.Fatalf("expected shape %v but got %v", expected.Shape(), actual.Shape())
+	}
+	for i, x := range expected.Data {
+		a := actual.Data[i]
+		if math.Abs(float64(x-a)) > epsilon {
+			t.Errorf("shape %v: bad value at %d: expected %f but got %f", expected.Shape(),
+				i, x, a)
+			return
+		}
+	}
+}
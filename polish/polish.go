@@ -1,8 +1,10 @@
 package polish
 
 import (
+	"fmt"
 	"image"
 
+	"github.com/pkg/errors"
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/polish/polish/nn"
 )
@@ -16,6 +18,14 @@ func PolishImage(t ModelType, img image.Image) image.Image {
 	return PolishImagePatches(t, img, patchSize, 0)
 }
 
+// PolishImageChecked is like PolishImage, but it returns
+// an error instead of panicking if the model cannot be
+// applied to the image.
+func PolishImageChecked(t ModelType, img image.Image) (image.Image, error) {
+	patchSize := essentials.MaxInt(img.Bounds().Dx(), img.Bounds().Dy())
+	return PolishImagePatchesChecked(t, img, patchSize, 0)
+}
+
 // PolishImagePatches is like PolishImage, but it applies
 // the operation to patches of the image at a time to save
 // memory.
@@ -29,23 +39,39 @@ func PolishImage(t ModelType, img image.Image) image.Image {
 // The border argument specifies how many extra pixels are
 // included on the side of each patch before it is fed
 // into the network.
-// A value of -1 will use a reasonable default border.
+// A value of -1 will use the model's receptive field as
+// the border, which makes the result match PolishImage()
+// for models that do not use global normalization.
+// Models with an unbounded receptive field use half of the
+// patch size instead, which was formerly the default for
+// every model.
 // Larger border values ensure more accuracy at the cost
 // of redundant computation, while lower values may cause
 // checkerboarding artifacts.
+//
+// To denoise many images with the same model, create a
+// Denoiser once and reuse it instead.
 func PolishImagePatches(t ModelType, img image.Image, patchSize, border int) image.Image {
+	res, err := PolishImagePatchesChecked(t, img, patchSize, border)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// PolishImagePatchesChecked is like PolishImagePatches,
+// but it returns an error instead of panicking if the
+// model cannot be applied to the image.
+func PolishImagePatchesChecked(t ModelType, img image.Image, patchSize,
+	border int) (image.Image, error) {
 	if t.Aux() {
-		panic("model requires auxiliary features")
-	}
-	inTensor := nn.NewTensorRGB(img)
-	outTensor := operatePatches(inTensor, patchSize, border, func(in *nn.Tensor) *nn.Tensor {
-		pad, unpad := padAndUnpad(t, in)
-		outTensor := pad.Apply(in)
-		outTensor = t.Layer().Apply(outTensor)
-		outTensor = unpad.Apply(outTensor)
-		return outTensor
-	})
-	return outTensor.RGB()
+		return nil, errors.New("model requires auxiliary features")
+	}
+	d, err := NewDenoiserChecked(t)
+	if err != nil {
+		return nil, err
+	}
+	return d.PolishImagePatchesChecked(img, patchSize, border)
 }
 
 // PolishAux applies a denoising network to an image with
@@ -60,79 +86,199 @@ func PolishAux(t ModelType, auxImage *nn.Tensor) image.Image {
 	return PolishAuxPatches(t, auxImage, patchSize, 0)
 }
 
+// PolishAuxChecked is like PolishAux, but it returns an
+// error instead of panicking if the model cannot be
+// applied to the Tensor.
+func PolishAuxChecked(t ModelType, auxImage *nn.Tensor) (image.Image, error) {
+	patchSize := essentials.MaxInt(auxImage.Width, auxImage.Height)
+	return PolishAuxPatchesChecked(t, auxImage, patchSize, 0)
+}
+
 // PolishAuxPatches is like PolishAux, but it applies the
 // operation to patches of the image at a time to save
 // memory.
 //
 // See PolishImagePatches for more information.
 func PolishAuxPatches(t ModelType, auxImage *nn.Tensor, patchSize, border int) image.Image {
+	res, err := PolishAuxPatchesChecked(t, auxImage, patchSize, border)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// PolishAuxPatchesChecked is like PolishAuxPatches, but it
+// returns an error instead of panicking if the model
+// cannot be applied to the Tensor.
+func PolishAuxPatchesChecked(t ModelType, auxImage *nn.Tensor, patchSize,
+	border int) (image.Image, error) {
 	if !t.Aux() {
-		panic("model does not support auxiliary features")
-	}
-	outTensor := operatePatches(auxImage, patchSize, border, func(in *nn.Tensor) *nn.Tensor {
-		pad, unpad := padAndUnpad(t, in)
-		outTensor := pad.Apply(in)
-		outTensor = t.Layer().Apply(outTensor)
-		outTensor = unpad.Apply(outTensor)
-		return outTensor
-	})
-	return outTensor.RGB()
+		return nil, errors.New("model does not support auxiliary features")
+	}
+	d, err := NewDenoiserChecked(t)
+	if err != nil {
+		return nil, err
+	}
+	return d.PolishAuxPatchesChecked(auxImage, patchSize, border)
+}
+
+// maxModelPadding is the largest amount of padding that
+// padAndUnpad will add to each dimension of an input.
+const maxModelPadding = 256
+
+// edgePadding describes how one axis of an image is
+// padded before it is fed to a model.
+type edgePadding struct {
+	// margin is the minimum number of pixels added to
+	// each side.
+	margin int
+	mode   nn.PadMode
+}
+
+// padAndUnpad finds the smallest amount of padding on the
+// right and bottom of the input for which the model
+// produces an output of the same spatial size.
+//
+// Additionally, the margin of each axis is added to both
+// of its sides. The top and left margins are rounded up
+// to a multiple of align, so that strided models see the
+// same pixel grid as they would without the margin.
+//
+// This uses the model's shape inference, relying on the
+// fact that the output width of every layer depends only
+// on its input width (and likewise for height).
+func padAndUnpad(layer nn.Layer, in nn.Shape, align int,
+	horizontal, vertical edgePadding) (pad, unpad nn.Layer, err error) {
+	left := roundUp(horizontal.margin, align)
+	top := roundUp(vertical.margin, align)
+	right, err := paddingForSize(layer, in.Width+left+horizontal.margin, in.Depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	bottom, err := paddingForSize(layer, in.Height+top+vertical.margin, in.Depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	right += horizontal.margin
+	bottom += vertical.margin
+	unpad = nn.NewUnpad(top, right, bottom, left)
+	if horizontal.mode == vertical.mode {
+		pad = &nn.Pad{Top: top, Right: right, Bottom: bottom, Left: left, Mode: horizontal.mode}
+		return pad, unpad, nil
+	}
+	// Pad each axis separately, so that the corners are
+	// padded along both axes.
+	pad = nn.NN{
+		&nn.Pad{Right: right, Left: left, Mode: horizontal.mode},
+		&nn.Pad{Top: top, Bottom: bottom, Mode: vertical.mode},
+	}
+	return pad, unpad, nil
 }
 
-func padAndUnpad(t ModelType, in *nn.Tensor) (pad, unpad nn.Layer) {
-	lcd := t.LCD()
-	rightPad := (lcd - in.Width%lcd) % lcd
-	bottomPad := (lcd - in.Height%lcd) % lcd
-	return nn.NewPad(0, rightPad, bottomPad, 0), nn.NewUnpad(0, rightPad, bottomPad, 0)
+func roundUp(x, align int) int {
+	return (x + align - 1) / align * align
 }
 
-func operatePatches(t *nn.Tensor, patchSize, border int, f func(*nn.Tensor) *nn.Tensor) *nn.Tensor {
+func paddingForSize(layer nn.Layer, size, depth int) (int, error) {
+	var firstErr error
+	for pad := 0; pad <= maxModelPadding; pad++ {
+		padded := size + pad
+		out, err := nn.OutputShape(layer, nn.Shape{Height: padded, Width: padded, Depth: depth})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if out.Width == padded && out.Height == padded {
+			return pad, nil
+		}
+	}
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return 0, fmt.Errorf("model cannot preserve input size %d", size)
+}
+
+// operatePatches applies f to patches of t and joins the
+// results.
+//
+// The top-left corner of every patch, including its
+// border, is aligned to a multiple of align, so that
+// strided models see the same pixel grid as they would
+// for the full image.
+//
+// If the image wraps around, the borders of the patches
+// along its edges come from the opposite edges.
+func operatePatches(t *nn.Tensor, patchSize, border, align int, wrap WrapMode,
+	f func(*nn.Tensor) (*nn.Tensor, error)) (*nn.Tensor, error) {
+	if t.Width == 0 || t.Height == 0 {
+		return nil, errors.New("image is empty")
+	} else if patchSize <= 0 {
+		return nil, errors.New("patch size must be positive")
+	} else if border < 0 {
+		return nil, errors.New("border must be non-negative or -1")
+	}
+
 	if patchSize >= t.Width && patchSize >= t.Height {
 		// Special case when the patch fills the image.
 		// This is utilized by PolishImage().
 		return f(t)
 	}
 
-	if border == -1 {
-		border = patchSize / 2
+	if wrap != WrapNone {
+		// Surround the image with the pixels that wrap
+		// around, and then tile the result as usual.
+		offset := roundUp(border, align)
+		pad := &nn.Pad{Left: offset, Right: border, Mode: nn.PadCircular}
+		if wrap == WrapBoth {
+			pad.Top, pad.Bottom = offset, border
+		}
+		output, err := operatePatches(pad.Apply(t), patchSize, border, align, WrapNone, f)
+		if err != nil {
+			return nil, err
+		}
+		return output.View(t.Bounds().Add(image.Pt(pad.Left, pad.Top))), nil
 	}
+
 	var output *nn.Tensor
 	for y := 0; y < t.Height; y += patchSize {
 		patchHeight := essentials.MinInt(patchSize, t.Height-y)
-		extraTop := essentials.MinInt(y, border)
+		extraTop := alignedBorder(y, border, align)
 		extraBottom := essentials.MinInt(t.Height-(y+patchHeight), border)
 		for x := 0; x < t.Width; x += patchSize {
 			patchWidth := essentials.MinInt(patchSize, t.Width-x)
-			extraLeft := essentials.MinInt(x, border)
+			extraLeft := alignedBorder(x, border, align)
 			extraRight := essentials.MinInt(t.Width-(x+patchWidth), border)
 
-			patch := nn.NewTensor(patchHeight+extraTop+extraBottom,
-				patchWidth+extraLeft+extraRight, t.Depth)
-			for subY := 0; subY < patch.Height; subY++ {
-				for subX := 0; subX < patch.Width; subX++ {
-					destIdx := (subX + subY*patch.Width) * patch.Depth
-					dest := patch.Data[destIdx : destIdx+patch.Depth]
-					sourceIdx := ((subX + x - extraLeft) + (subY+y-extraTop)*t.Width) * t.Depth
-					source := t.Data[sourceIdx : sourceIdx+t.Depth]
-					copy(dest, source)
-				}
+			// Patches are views of t, so they are not copied.
+			patch := t.View(image.Rect(x-extraLeft, y-extraTop, x+patchWidth+extraRight,
+				y+patchHeight+extraBottom))
+			patchOut, err := f(patch)
+			if err != nil {
+				return nil, err
 			}
-
-			patchOut := f(patch)
-			patchOut = patchOut.Unpad(extraTop, extraRight, extraBottom, extraLeft)
 			if output == nil {
 				output = nn.NewTensor(t.Height, t.Width, patchOut.Depth)
 			}
-			for subY := 0; subY < patchHeight; subY++ {
-				for subX := 0; subX < patchWidth; subX++ {
-					destIdx := ((subX + x) + (subY+y)*t.Width) * output.Depth
-					dest := output.Data[destIdx : destIdx+output.Depth]
-					sourceIdx := (subX + subY*patchOut.Width) * patchOut.Depth
-					source := patchOut.Data[sourceIdx : sourceIdx+patchOut.Depth]
-					copy(dest, source)
-				}
-			}
+			inner := image.Rect(0, 0, patchWidth, patchHeight)
+			src := patchOut.View(inner.Add(image.Pt(extraLeft, extraTop)))
+			output.View(inner.Add(image.Pt(x, y))).CopyFrom(src)
 		}
 	}
-	return output
+	return output, nil
+}
+
+func alignedBorder(start, border, align int) int {
+	if border >= start {
+		return start
+	}
+	return start - ((start-border)/align)*align
+}
+
+func tensorToRGB(t *nn.Tensor) (image.Image, error) {
+	if t.Depth != 3 {
+		return nil, fmt.Errorf("model produced %d output channels instead of 3", t.Depth)
+	}
+	return t.RGB(), nil
 }
@@ -4,9 +4,12 @@ import (
 	"image"
 	"image/color"
 	"math/rand"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/polish/polish/nn"
 )
 
 func TestPatchEquivalence(t *testing.T) {
@@ -34,6 +37,113 @@ func TestPatchEquivalence(t *testing.T) {
 		PolishImagePatches(ModelTypeShallow, img, 55, 18),
 	}
 
+	checkImagesClose(t, expected, actual)
+}
+
+func TestPatchEquivalenceDeep(t *testing.T) {
+	if testing.Short() {
+		t.Skip("deep model is slow")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 110, 61))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(256))
+	}
+	d := NewDenoiser(ModelTypeDeep)
+	expected := d.PolishImage(img)
+
+	// The default border is the receptive field, which
+	// should make patches exactly match the full image.
+	actual := []image.Image{
+		d.PolishImagePatches(img, 64, -1),
+		d.PolishImagePatches(img, 29, -1),
+	}
+	checkImagesClose(t, expected, actual)
+}
+
+func TestBorderMode(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 37, 30))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	d := NewDenoiser(ModelTypeShallow)
+	for _, mode := range []nn.PadMode{nn.PadReflect, nn.PadReplicate, nn.PadCircular} {
+		// The model only sees a constant image, so the
+		// edges should look like the middle.
+		out := d.WithBorderMode(mode).PolishImage(img)
+		checkImagesClose(t, image.NewUniform(out.At(18, 15)), []image.Image{out})
+	}
+	zeroPadded := d.PolishImage(img)
+	if zeroPadded.At(0, 0) == zeroPadded.At(18, 15) {
+		t.Error("expected zero padding to affect the corner")
+	}
+
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(256))
+	}
+	reflected := d.WithBorderMode(nn.PadReflect)
+	expected := reflected.PolishImage(img)
+	checkImagesClose(t, expected, []image.Image{
+		reflected.PolishImagePatches(img, 16, -1),
+		reflected.PolishImagePatches(img, 7, -1),
+	})
+}
+
+func TestWrapMode(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 23))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(256))
+	}
+	roll := func(img image.Image, dx, dy int) image.Image {
+		b := img.Bounds()
+		res := image.NewRGBA(b)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				res.Set((x+dx)%b.Dx(), (y+dy)%b.Dy(), img.At(x, y))
+			}
+		}
+		return res
+	}
+	d := NewDenoiser(ModelTypeShallow)
+	for _, mode := range []WrapMode{WrapHorizontal, WrapBoth} {
+		// Shifting a wrapped image should shift the output
+		// without introducing seams.
+		dy := 0
+		if mode == WrapBoth {
+			dy = 9
+		}
+		wrapped := d.WithWrapMode(mode)
+		expected := roll(wrapped.PolishImage(img), 13, dy)
+		checkImagesClose(t, expected, []image.Image{
+			wrapped.PolishImage(roll(img, 13, dy)),
+			wrapped.PolishImagePatches(roll(img, 13, dy), 16, -1),
+			wrapped.PolishImagePatches(roll(img, 13, dy), 7, 5),
+		})
+	}
+}
+
+func TestWrapModeUnboundedRF(t *testing.T) {
+	layer := nn.NN{ModelTypeShallow.Layer(), &nn.GroupNorm{NumGroups: 1}}
+	d := newDenoiserLayer(ModelTypeShallow, layer).WithWrapMode(WrapBoth)
+	if d.RF() != -1 {
+		t.Fatalf("expected unbounded RF but got %d", d.RF())
+	}
+	// Without a receptive field, the wrapped edges are
+	// padded by half of the image.
+	in := nn.Shape{Height: 23, Width: 40, Depth: 3}
+	pad, _, err := d.padAndUnpad(in, d.WrapMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded, err := nn.OutputShape(pad, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if padded.Width < in.Width*2 || padded.Height < in.Height/2*2+in.Height {
+		t.Errorf("input %v was only padded to %v", in, padded)
+	}
+}
+
+func checkImagesClose(t *testing.T, expected image.Image, actual []image.Image) {
 CaseLoop:
 	for i, a := range actual {
 		for y := 0; y < a.Bounds().Dy(); y++ {
@@ -53,3 +163,68 @@ CaseLoop:
 		}
 	}
 }
+
+func TestDenoiserConcurrent(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(256))
+	}
+	expected := PolishImage(ModelTypeShallow, img)
+
+	d := NewDenoiser(ModelTypeShallow)
+	results := make([]image.Image, 4)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = d.PolishImagePatches(img, 20, 10)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, actual := range results {
+		if !reflect.DeepEqual(actual, results[0]) {
+			t.Fatalf("result %d differs from result 0", i)
+		}
+	}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			r1, g1, b1, _ := results[0].At(x, y).RGBA()
+			r2, g2, b2, _ := expected.At(x, y).RGBA()
+			threshold := 0x200
+			if essentials.AbsInt(int(r1-r2)) > threshold ||
+				essentials.AbsInt(int(g1-g2)) > threshold ||
+				essentials.AbsInt(int(b1-b2)) > threshold {
+				t.Fatalf("mismatch at (%d, %d)", x, y)
+			}
+		}
+	}
+}
+
+func TestPolishChecked(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	if _, err := PolishImageChecked(ModelTypeShallowAux, img); err == nil {
+		t.Error("expected error for aux model")
+	}
+	if _, err := PolishAuxChecked(ModelTypeShallowAux, nn.NewTensor(16, 16, 3)); err == nil {
+		t.Error("expected error for missing channels")
+	} else if _, ok := err.(*nn.LayerError); !ok {
+		t.Errorf("unexpected error type: %T", err)
+	}
+	if _, err := PolishImagePatchesChecked(ModelTypeShallow, img, 0, 0); err == nil {
+		t.Error("expected error for zero patch size")
+	}
+	if _, err := PolishImageChecked(ModelTypeShallow, img); err != nil {
+		t.Error(err)
+	}
+	if _, err := PolishImageChecked(ModelTypeKPCN, img); err == nil {
+		t.Error("expected error for model without built-in parameters")
+	}
+	if _, err := PolishAuxChecked(ModelTypeKPCNAux, nn.NewTensor(16, 16, 7)); err == nil {
+		t.Error("expected error for model without built-in parameters")
+	}
+	if _, err := NewDenoiserChecked(ModelType(-1)); err == nil {
+		t.Error("expected error for unknown model type")
+	}
+}
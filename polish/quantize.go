@@ -0,0 +1,183 @@
+package polish
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/polish/polish/nn"
+)
+
+const (
+	// calibrationImages is the number of synthetic images
+	// used to calibrate the built-in int8 models.
+	calibrationImages = 4
+
+	// calibrationSize is the width and height of each
+	// calibration image.
+	calibrationSize = 64
+)
+
+// Quantize creates a Denoiser which uses a quantized
+// version of d's model.
+//
+// For nn.QuantInt8, the samples are used to calibrate the
+// range of the activations, so they should be typical
+// inputs for the model. They may be rendered images (see
+// nn.NewTensorRGB) or auxiliary Tensors, depending on the
+// model type. The samples are not needed for
+// nn.QuantFloat16.
+func (d *Denoiser) Quantize(format nn.QuantFormat, samples []*nn.Tensor) (*Denoiser, error) {
+	var padded []*nn.Tensor
+	for _, sample := range samples {
+		pad, _, err := d.padAndUnpad(sample.Shape(), d.wrapMode)
+		if err != nil {
+			return nil, errors.Wrap(err, "quantize")
+		}
+		padded = append(padded, pad.Apply(sample))
+	}
+	layer, err := nn.Quantize(d.layer, format, padded)
+	if err != nil {
+		return nil, err
+	}
+	res := newDenoiserLayer(d.modelType, layer)
+	res.borderMode = d.borderMode
+	res.wrapMode = d.wrapMode
+	return res, nil
+}
+
+// PSNR computes the peak signal-to-noise ratio, in
+// decibels, of an image relative to a reference image of
+// the same size.
+//
+// If the images are identical, the result is +Inf.
+func PSNR(reference, img image.Image) float64 {
+	rb, b := reference.Bounds(), img.Bounds()
+	if rb.Dx() != b.Dx() || rb.Dy() != b.Dy() {
+		panic("image sizes do not match")
+	}
+	var sqErr float64
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r1, g1, b1, _ := reference.At(x+rb.Min.X, y+rb.Min.Y).RGBA()
+			r2, g2, b2, _ := img.At(x+b.Min.X, y+b.Min.Y).RGBA()
+			c1 := [3]uint32{r1, g1, b1}
+			c2 := [3]uint32{r2, g2, b2}
+			for i := range c1 {
+				diff := (float64(c1[i]) - float64(c2[i])) / 0xffff
+				sqErr += float64(diff * diff)
+			}
+		}
+	}
+	mse := sqErr / float64(3*b.Dx()*b.Dy())
+	return -10 * math.Log10(mse)
+}
+
+// A quantizedModel caches a quantized built-in model, so
+// that it is only calibrated once per process.
+type quantizedModel struct {
+	once  sync.Once
+	layer nn.Layer
+	err   error
+}
+
+var quantizedModels = map[ModelType]*quantizedModel{
+	ModelTypeDeepInt8:       {},
+	ModelTypeDeepFloat16:    {},
+	ModelTypeDeepAuxInt8:    {},
+	ModelTypeDeepAuxFloat16: {},
+}
+
+// quantizedLayer gets the cached layer for a quantized
+// built-in model, creating it on the first call.
+//
+// Quantized layers are not modified after they are
+// created, so they may be shared by every Denoiser.
+func quantizedLayer(m ModelType) (nn.Layer, error) {
+	cached, ok := quantizedModels[m]
+	if !ok {
+		return nil, errors.New("unknown quantized model type")
+	}
+	cached.once.Do(func() {
+		format, _ := m.Quantization()
+		cached.layer, cached.err = quantizeModel(m.FloatModel().Layer(), format, m.Aux())
+	})
+	return cached.layer, cached.err
+}
+
+// quantizeModel quantizes a built-in model, calibrating
+// int8 models on synthetic renderings.
+func quantizeModel(layer nn.Layer, format nn.QuantFormat, aux bool) (nn.Layer, error) {
+	return nn.Quantize(nn.Optimize(layer), format, calibrationSamples(aux))
+}
+
+// calibrationSamples creates noisy renderings of random
+// diffuse spheres in front of a backdrop, along with
+// their auxiliary features if aux is true.
+//
+// The renderings are deterministic, so that quantized
+// models are always the same. Every product is rounded
+// explicitly so that it cannot be fused with an addition,
+// and the noise avoids math.Exp and math.Log, which may
+// use FMA instructions.
+func calibrationSamples(aux bool) []*nn.Tensor {
+	depth := 3
+	if aux {
+		depth = 7
+	}
+	var res []*nn.Tensor
+	for i := 0; i < calibrationImages; i++ {
+		gen := rand.New(rand.NewSource(int64(i)))
+		// Float64 is computed with a product, which may
+		// be fused after it is inlined.
+		uniform := func() float64 {
+			return float64(gen.Float64())
+		}
+		type sphere struct {
+			x, y, radius float64
+			albedo       [3]float64
+		}
+		var spheres []sphere
+		for j := 0; j < 3; j++ {
+			spheres = append(spheres, sphere{
+				x:      uniform() * calibrationSize,
+				y:      uniform() * calibrationSize,
+				radius: calibrationSize * (0.1 + float64(0.3*uniform())),
+				albedo: [3]float64{uniform(), uniform(), uniform()},
+			})
+		}
+		brightness := 0.5 + uniform()
+
+		t := nn.NewTensor(calibrationSize, calibrationSize, depth)
+		for y := 0; y < t.Height; y++ {
+			for x := 0; x < t.Width; x++ {
+				albedo := [3]float64{0.8, 0.8, 0.8}
+				cosine := 1 - float64(0.5*float64(y)/calibrationSize)
+				for _, s := range spheres {
+					dx, dy := (float64(x)-s.x)/s.radius, (float64(y)-s.y)/s.radius
+					if r2 := float64(dx*dx) + float64(dy*dy); r2 < 1 {
+						albedo = s.albedo
+						cosine = math.Sqrt(1 - r2)
+					}
+				}
+				for c, a := range albedo {
+					// Monte Carlo noise is roughly multiplicative,
+					// with occasional bright outliers.
+					noise := 0.8 * uniform() / (1 - float64(0.9*uniform()))
+					value := brightness * a * cosine * noise
+					*t.At(y, x, c) = float32(math.Min(1, value))
+					if aux {
+						*t.At(y, x, c+3) = float32(a)
+					}
+				}
+				if aux {
+					*t.At(y, x, 6) = float32(cosine)
+				}
+			}
+		}
+		res = append(res, t)
+	}
+	return res
+}
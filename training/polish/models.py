@@ -20,6 +20,8 @@ def all_models(**kwargs):
         'linear': LinearDenoiser(**kwargs),
         'shallow': ShallowDenoiser(**kwargs),
         'deep': DeepDenoiser(**kwargs),
+        'kpcn': KPCNDenoiser(**kwargs),
+        'unet': UNetDenoiser(**kwargs),
         'bilateral': BilateralDenoiser(**kwargs),
     }
 
@@ -105,31 +107,38 @@ class SepConv2d(nn.Module):
 class DeepDenoiser(Denoiser):
     """
     A denoiser that has multiple hidden layers.
+
+    The channels argument lists the outputs of conv1,
+    the outputs of conv2, the hidden layers of the
+    residual blocks, and the outputs of deconv2. Custom
+    values must be passed to the Go loader as well.
     """
 
-    def __init__(self, aux=False, conv2d=SepConv2d, batch_norm=True):
+    def __init__(self, aux=False, conv2d=SepConv2d, batch_norm=True,
+                 channels=(64, 128, 256, 32)):
         super().__init__()
+        c1, c2, hidden, c3 = channels
         self.conv1 = nn.Conv2d(3 + AUX_FEATURE_CHANNELS if aux else 3,
-                               64, 5, padding=2, stride=2)
-        self.conv2 = conv2d(64, 128, 5, padding=2, stride=2)
+                               c1, 5, padding=2, stride=2)
+        self.conv2 = conv2d(c1, c2, 5, padding=2, stride=2)
 
         def create_norm():
             if batch_norm:
-                return nn.BatchNorm2d(128)
+                return nn.BatchNorm2d(c2)
             else:
-                return nn.GroupNorm(8, 128)
+                return nn.GroupNorm(8, c2)
 
         self.residuals = nn.ModuleList([nn.Sequential(
             create_norm(),
             nn.ReLU(),
-            conv2d(128, 256, 3, padding=1),
+            conv2d(c2, hidden, 3, padding=1),
             nn.ReLU(),
-            conv2d(256, 128, 3, padding=1),
+            conv2d(hidden, c2, 3, padding=1),
         ) for _ in range(4)])
 
-        self.deconv1 = nn.ConvTranspose2d(128, 64, 4, padding=1, stride=2)
-        self.deconv2 = nn.ConvTranspose2d(64, 32, 4, padding=1, stride=2)
-        self.conv3 = nn.Conv2d(32, 3, 3, padding=1)
+        self.deconv1 = nn.ConvTranspose2d(c2, c1, 4, padding=1, stride=2)
+        self.deconv2 = nn.ConvTranspose2d(c1, c3, 4, padding=1, stride=2)
+        self.conv3 = nn.Conv2d(c3, 3, 3, padding=1)
 
     @property
     def dim_lcd(self):
@@ -151,6 +160,90 @@ class DeepDenoiser(Denoiser):
         return x
 
 
+class KPCNDenoiser(DeepDenoiser):
+    """
+    A deep denoiser that predicts a kernel for every pixel,
+    which is applied to the noisy input.
+    """
+
+    def __init__(self, aux=False, kernel_size=21, **kwargs):
+        super().__init__(aux=aux, **kwargs)
+        if not kernel_size % 2:
+            raise ValueError('kernel_size must be odd')
+        self.kernel_size = kernel_size
+        self.conv3 = nn.Conv2d(self.conv3.in_channels, kernel_size**2, 3, padding=1)
+
+    def forward(self, x):
+        logits = super().forward(x)
+        radiance = x[:, :3]
+
+        # Create patches tensor: [N x C x K^2 x H x W]
+        padding = self.kernel_size // 2
+        patches = F.unfold(radiance, self.kernel_size, padding=padding)
+        patches = patches.view(*radiance.shape[:2], self.kernel_size**2, *x.shape[2:])
+
+        # Exclude the padding from the softmax, so that
+        # outputs are averages of pixels in the image.
+        inside = F.unfold(torch.ones_like(radiance[:, :1]), self.kernel_size, padding=padding)
+        inside = inside.view(x.shape[0], self.kernel_size**2, *x.shape[2:])
+        logits = logits.masked_fill(inside == 0, -float('inf'))
+        probs = F.softmax(logits, dim=1)
+
+        return torch.sum(patches * probs[:, None], dim=2)
+
+
+class UNetDenoiser(Denoiser):
+    """
+    A U-Net denoiser, where each decoder level concatenates
+    the features of the encoder level with the same
+    resolution.
+
+    The channels argument lists the channels of each level,
+    starting at full resolution. Each level after the first
+    halves the resolution.
+    """
+
+    def __init__(self, aux=False, channels=(32, 64, 128)):
+        super().__init__()
+        self.channels = channels
+
+        def block(depth_in, depth_out):
+            return nn.Sequential(
+                nn.Conv2d(depth_in, depth_out, 3, padding=1),
+                nn.ReLU(),
+                nn.Conv2d(depth_out, depth_out, 3, padding=1),
+                nn.ReLU(),
+            )
+
+        depth_in = 3 + AUX_FEATURE_CHANNELS if aux else 3
+        self.encoders = nn.ModuleList()
+        for depth in channels:
+            self.encoders.append(block(depth_in, depth))
+            depth_in = depth
+        self.decoders = nn.ModuleList()
+        for depth in channels[-2::-1]:
+            self.decoders.append(block(depth_in + depth, depth))
+            depth_in = depth
+        self.out = nn.Conv2d(depth_in, 3, 1)
+
+    @property
+    def dim_lcd(self):
+        return 2 ** (len(self.channels) - 1)
+
+    def forward(self, x):
+        skips = []
+        for i, encoder in enumerate(self.encoders):
+            if i:
+                x = F.max_pool2d(x, 2)
+            x = encoder(x)
+            skips.append(x)
+        skips.pop()
+        for decoder in self.decoders:
+            x = F.interpolate(x, scale_factor=2, mode='bilinear', align_corners=False)
+            x = decoder(torch.cat([x, skips.pop()], dim=1))
+        return self.out(x)
+
+
 class BilateralDenoiser(Denoiser):
     """
     A denoiser that uses a bilateral filter with learned